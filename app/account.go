@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	AccountTokenVerifyEmail   = "verify_email"
+	AccountTokenResetPassword = "reset_password"
+)
+
+type ErrAccountTokenInvalid string
+
+func (e ErrAccountTokenInvalid) Error() string {
+	return string(e)
+}
+
+// AccountTokens sign the expiring tokens of links sent by mail. A token
+// carries a fingerprint of the state it changes, like the current password
+// hash, so it stops working once it has been used.
+type AccountTokens struct {
+	key []byte
+}
+
+// NewAccountTokens derives the signing key from secret, so the tokens cannot
+// be used as sign-in tokens signed with the same secret.
+func NewAccountTokens(secret []byte) AccountTokens {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("account tokens"))
+	return AccountTokens{key: mac.Sum(nil)}
+}
+
+func (t AccountTokens) Create(purpose string, userID int, state string, lifetime time.Duration) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"purpose": purpose,
+		"sub":     strconv.Itoa(userID),
+		"state":   accountTokenState(state),
+		"exp":     time.Now().Add(lifetime).Unix(),
+	})
+	return token.SignedString(t.key)
+}
+
+// Verify checks the signature, expiry and purpose of the token and returns
+// the user it was created for, if state still matches.
+func (t AccountTokens) Verify(tokenString string, purpose string, state func(userID int) (string, error)) (int, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Method.Alg())
+		}
+		return t.key, nil
+	})
+	if err != nil || !token.Valid {
+		return 0, ErrAccountTokenInvalid("token is invalid or has expired")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != purpose {
+		return 0, ErrAccountTokenInvalid("token is invalid or has expired")
+	}
+
+	userID, err := strconv.Atoi(fmt.Sprint(claims["sub"]))
+	if err != nil || userID < 1 {
+		return 0, ErrAccountTokenInvalid("token is invalid or has expired")
+	}
+
+	current, err := state(userID)
+	var userNotFound ErrUserNotFound
+	if errors.As(err, &userNotFound) {
+		return 0, ErrAccountTokenInvalid("token is invalid or has expired")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	tokenState, _ := claims["state"].(string)
+	if !hmac.Equal([]byte(tokenState), []byte(accountTokenState(current))) {
+		return 0, ErrAccountTokenInvalid("token has already been used")
+	}
+
+	return userID, nil
+}
+
+func accountTokenState(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// AccountManager sends the mails to verify emails and to reset passwords of
+// password accounts. The links point to {homepage}/verify-email and
+// {homepage}/reset-password, which post the token back to the API.
+type AccountManager struct {
+	repository            Repository
+	authenticator         Authenticator
+	roleManager           RoleManager
+	passwordAuthenticator PasswordAuthenticator
+	tokens                AccountTokens
+	mailer                Mailer
+	templates             MailTemplates
+	homepageURL           string
+	verificationLifetime  time.Duration
+	resetLifetime         time.Duration
+}
+
+func NewAccountManager(
+	repository Repository,
+	authenticator Authenticator,
+	roleManager RoleManager,
+	passwordAuthenticator PasswordAuthenticator,
+	tokens AccountTokens,
+	mailer Mailer,
+	templates MailTemplates,
+	homepageURL string,
+	verificationLifetime time.Duration,
+	resetLifetime time.Duration,
+) AccountManager {
+	return AccountManager{
+		repository:            repository,
+		authenticator:         authenticator,
+		roleManager:           roleManager,
+		passwordAuthenticator: passwordAuthenticator,
+		tokens:                tokens,
+		mailer:                mailer,
+		templates:             templates,
+		homepageURL:           homepageURL,
+		verificationLifetime:  verificationLifetime,
+		resetLifetime:         resetLifetime,
+	}
+}
+
+func (m AccountManager) SendEmailVerification(user User) error {
+	if user.EmailVerified {
+		return errors.New("email is already verified")
+	}
+
+	token, err := m.tokens.Create(AccountTokenVerifyEmail, user.ID, user.Email, m.verificationLifetime)
+	if err != nil {
+		return err
+	}
+
+	return m.send(MailVerifyEmail, user, "/verify-email", token, m.verificationLifetime)
+}
+
+// VerifyEmail marks the email of the user as verified, which grants the
+// admin role to users listed as admin. The token is bound to the email it
+// was sent to.
+func (m AccountManager) VerifyEmail(token string) error {
+	userID, err := m.tokens.Verify(token, AccountTokenVerifyEmail, func(userID int) (string, error) {
+		user, err := m.repository.GetUserByID(userID)
+		if err != nil {
+			return "", err
+		}
+		if user.EmailVerified {
+			return "", ErrAccountTokenInvalid("email is already verified")
+		}
+		return user.Email, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.setEmailVerified(userID)
+}
+
+func (m AccountManager) setEmailVerified(userID int) error {
+	if err := m.repository.SetUserEmailVerified(userID); err != nil {
+		return err
+	}
+
+	user, err := m.repository.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	return m.roleManager.AssignAdminRole(user)
+}
+
+// SendPasswordReset mails a reset link if an account exists for the email.
+// Unknown emails are not reported, so the endpoint does not reveal which
+// emails have accounts.
+func (m AccountManager) SendPasswordReset(email string) error {
+	user, err := m.repository.GetUserByEmail(email)
+	var userNotFound ErrUserNotFound
+	if errors.As(err, &userNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	passwordHash, err := m.repository.GetUserPasswordHash(user.ID)
+	if err != nil {
+		return err
+	}
+
+	token, err := m.tokens.Create(AccountTokenResetPassword, user.ID, passwordHash, m.resetLifetime)
+	if err != nil {
+		return err
+	}
+
+	return m.send(MailResetPassword, user, "/reset-password", token, m.resetLifetime)
+}
+
+// ResetPassword sets a new password for the user of the token and revokes
+// the tokens issued to the user so far. As the token was received by mail,
+// the email of the user is verified as well.
+func (m AccountManager) ResetPassword(token string, password string) error {
+	userID, err := m.tokens.Verify(token, AccountTokenResetPassword, m.repository.GetUserPasswordHash)
+	if err != nil {
+		return err
+	}
+
+	user, err := m.repository.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if err := m.passwordAuthenticator.SetPassword(user, password); err != nil {
+		return err
+	}
+
+	if err := m.authenticator.RevokeTokens(user.ID); err != nil {
+		return fmt.Errorf("failed to revoke tokens: %v", err)
+	}
+
+	if !user.EmailVerified {
+		if err := m.setEmailVerified(user.ID); err != nil {
+			log.Printf("failed to verify email of user %d: %v", user.ID, err)
+		}
+	}
+	return nil
+}
+
+func (m AccountManager) send(template string, user User, path string, token string, lifetime time.Duration) error {
+	link := fmt.Sprintf("%s%s?token=%s", m.homepageURL, path, url.QueryEscape(token))
+	data := struct {
+		Name     string
+		Email    string
+		Link     string
+		Lifetime time.Duration
+	}{
+		Name:     user.Name,
+		Email:    user.Email,
+		Link:     link,
+		Lifetime: lifetime,
+	}
+
+	mail, err := m.templates.Render(template, user.Email, data)
+	if err != nil {
+		return fmt.Errorf("failed to render mail: %v", err)
+	}
+
+	return m.mailer.Send(mail)
+}
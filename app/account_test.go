@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func newTestAccountManager(t *testing.T, repository *memoryRepository, lifetime time.Duration) (AccountManager, string) {
+	factory := newTestSingleSignOnFactory(repository)
+	passwordAuthenticator, err := NewPasswordAuthenticator(
+		true,
+		false,
+		repository,
+		NewPasswordHasher(Argon2Params{Time: 1, Memory: 64, Threads: 1}),
+		NewPasswordPolicy(8, 64, 1),
+		factory.NewUnverifiedSingleSignOn("password", true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := NewMailTemplates("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory, err := ioutil.TempDir("", "mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(directory) })
+
+	return NewAccountManager(
+		repository,
+		newTestAuthenticator(repository),
+		NewRoleManager(repository, "", []string{"alice@example.com"}),
+		passwordAuthenticator,
+		NewAccountTokens([]byte("secret")),
+		NewFileMailer(directory, "sso@example.com"),
+		templates,
+		"https://example.com",
+		lifetime,
+		lifetime,
+	), directory
+}
+
+var mailTokenPattern = regexp.MustCompile(`\?token=([^\s"<&]+)`)
+
+// readMailToken returns the token of the link in the only mail written to
+// directory, and removes the mail.
+func readMailToken(t *testing.T, directory string) string {
+	files, err := filepath.Glob(filepath.Join(directory, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one mail, got %d: %v", len(files), err)
+	}
+	defer os.Remove(files[0])
+
+	file, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	message, err := ioutil.ReadAll(quotedprintable.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match := mailTokenPattern.FindSubmatch(message)
+	if match == nil {
+		t.Fatalf("expected a link in the mail:\n%s", message)
+	}
+	token, err := url.QueryUnescape(string(match[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAccountManagerVerifyEmail(t *testing.T) {
+	repository := newMemoryRepository()
+	manager, directory := newTestAccountManager(t, repository, time.Hour)
+	user, _ := repository.CreateUser(User{Email: "alice@example.com"})
+
+	if err := manager.SendEmailVerification(user); err != nil {
+		t.Fatal(err)
+	}
+	token := readMailToken(t, directory)
+
+	if err := manager.VerifyEmail(token); err != nil {
+		t.Fatalf("expected the email to be verified, got %v", err)
+	}
+	if user, _ := repository.GetUserByID(user.ID); !user.EmailVerified {
+		t.Error("expected the email to be verified")
+	}
+	if !contains(repository.roles[user.ID], adminRole) {
+		t.Error("expected the user listed as admin to get the admin role once verified")
+	}
+
+	var tokenInvalid ErrAccountTokenInvalid
+	if err := manager.VerifyEmail(token); !errors.As(err, &tokenInvalid) {
+		t.Errorf("expected the token to be single-use, got %v", err)
+	}
+}
+
+func TestAccountManagerResetPassword(t *testing.T) {
+	repository := newMemoryRepository()
+	manager, directory := newTestAccountManager(t, repository, time.Hour)
+	user, _ := repository.CreateUser(User{Email: "alice@example.com"})
+	if err := manager.passwordAuthenticator.SetPassword(user, "old-password"); err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator := newTestAuthenticator(repository)
+	session, err := authenticator.CreateToken(user.ID, nil, []string{AMRPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := manager.SendPasswordReset("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	token := readMailToken(t, directory)
+
+	if err := manager.ResetPassword(token, "new-password"); err != nil {
+		t.Fatalf("expected the password to be reset, got %v", err)
+	}
+	if _, err := manager.passwordAuthenticator.Authenticate("alice@example.com", "new-password"); err != nil {
+		t.Errorf("expected the new password to work, got %v", err)
+	}
+	if user, _ := repository.GetUserByID(user.ID); !user.EmailVerified {
+		t.Error("expected the email to be verified")
+	}
+	if _, err := authenticator.GetTokenPayload(session); err == nil {
+		t.Error("expected the tokens issued before the reset to be revoked")
+	}
+
+	var tokenInvalid ErrAccountTokenInvalid
+	if err := manager.ResetPassword(token, "other-password"); !errors.As(err, &tokenInvalid) {
+		t.Errorf("expected the token to be single-use, got %v", err)
+	}
+}
+
+func TestAccountManagerExpiredToken(t *testing.T) {
+	repository := newMemoryRepository()
+	manager, directory := newTestAccountManager(t, repository, -time.Minute)
+	user, _ := repository.CreateUser(User{Email: "alice@example.com"})
+
+	if err := manager.SendPasswordReset(user.Email); err != nil {
+		t.Fatal(err)
+	}
+
+	var tokenInvalid ErrAccountTokenInvalid
+	if err := manager.ResetPassword(readMailToken(t, directory), "new-password"); !errors.As(err, &tokenInvalid) {
+		t.Errorf("expected the expired token to be rejected, got %v", err)
+	}
+
+	if err := manager.SendEmailVerification(user); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.VerifyEmail(readMailToken(t, directory)); !errors.As(err, &tokenInvalid) {
+		t.Errorf("expected the expired token to be rejected, got %v", err)
+	}
+}
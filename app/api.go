@@ -1,39 +1,149 @@
 package main
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func NewRouter(
 	homepageURL string,
 	statusHandler StatusHandler,
 	userHandler UserHandler,
-	googleSingleSignOn SingleSignOn,
-	facebookSingleSignOn SingleSignOn,
-	githubSingleSignOn SingleSignOn,
+	adminHandler AdminHandler,
+	organizationHandler OrganizationHandler,
+	authorizer Authorizer,
+	providerRegistry ProviderRegistry,
+	signInHandler SignInHandler,
+	accountHandler AccountHandler,
+	mfaHandler MFAHandler,
+	webAuthnHandler WebAuthnHandler,
 ) http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/api/v1/status", statusHandler.GetStatus)
 	mux.HandleFunc("/api/v1/me", userHandler.getSignedInUser)
+	mux.HandleFunc("/api/v1/admin/invitations", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: authorizer.RequirePermission(PermissionInvitationsWrite)(authorizer.RequireStepUp(adminHandler.CreateInvitation)),
+	}))
+	mux.HandleFunc("/api/v1/admin/roles", byMethod(map[string]http.HandlerFunc{
+		http.MethodGet:  authorizer.RequirePermission(PermissionRolesRead)(adminHandler.GetRoles),
+		http.MethodPost: authorizer.RequirePermission(PermissionRolesWrite)(authorizer.RequireStepUp(adminHandler.CreateRole)),
+	}))
+	mux.HandleFunc("/api/v1/admin/users/", byMethod(map[string]http.HandlerFunc{
+		http.MethodGet:    authorizer.RequirePermission(PermissionUsersRead)(adminHandler.GetUserRoles),
+		http.MethodPut:    authorizer.RequirePermission(PermissionRolesWrite)(authorizer.RequireStepUp(adminHandler.AssignUserRole)),
+		http.MethodDelete: authorizer.RequirePermission(PermissionRolesWrite)(authorizer.RequireStepUp(adminHandler.UnassignUserRole)),
+	}))
 
-	googleSingleSignOnHandler := NewSingleSignOnHandler(googleSingleSignOn, homepageURL)
-	mux.HandleFunc("/api/v1/single-sign-on/google/sign-in", googleSingleSignOnHandler.SignIn)
-	mux.HandleFunc("/api/v1/single-sign-on/google/callback", googleSingleSignOnHandler.Callback)
+	mux.HandleFunc("/api/v1/organizations", byMethod(map[string]http.HandlerFunc{
+		http.MethodGet:  authorizer.RequireAuthentication(organizationHandler.GetOrganizations),
+		http.MethodPost: authorizer.RequireAuthentication(organizationHandler.CreateOrganization),
+	}))
+	mux.HandleFunc("/api/v1/organizations/", byMethod(map[string]http.HandlerFunc{
+		http.MethodGet:    authorizer.RequireAuthentication(organizationHandler.GetResource),
+		http.MethodPost:   authorizer.RequireAuthentication(organizationHandler.PostResource),
+		http.MethodPut:    authorizer.RequireAuthentication(organizationHandler.PutResource),
+		http.MethodDelete: authorizer.RequireAuthentication(organizationHandler.DeleteResource),
+	}))
+	mux.HandleFunc("/api/v1/invitations/accept", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: authorizer.RequireAuthentication(organizationHandler.AcceptInvitation),
+	}))
 
-	facebookSingleSignOnHandler := NewSingleSignOnHandler(facebookSingleSignOn, homepageURL)
-	mux.HandleFunc("/api/v1/single-sign-on/facebook/sign-in", facebookSingleSignOnHandler.SignIn)
-	mux.HandleFunc("/api/v1/single-sign-on/facebook/callback", facebookSingleSignOnHandler.Callback)
-
-	githubSingleSignOnHandler := NewSingleSignOnHandler(githubSingleSignOn, homepageURL)
-	mux.HandleFunc("/api/v1/single-sign-on/github/sign-in", githubSingleSignOnHandler.SignIn)
-	mux.HandleFunc("/api/v1/single-sign-on/github/callback", githubSingleSignOnHandler.Callback)
+	singleSignOnRouter := NewSingleSignOnRouter(providerRegistry, homepageURL)
+	mux.HandleFunc("/api/v1/single-sign-on/providers", singleSignOnRouter.GetProviders)
+	mux.HandleFunc("/api/v1/single-sign-on/", singleSignOnRouter.Route)
+	mux.HandleFunc("/api/v1/saml/", NewSAMLRouter(providerRegistry, homepageURL).Route)
+	mux.HandleFunc("/api/v1/sign-in/ldap", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: signInHandler.LDAP,
+	}))
+	mux.HandleFunc("/api/v1/sign-in/password", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: signInHandler.Password,
+	}))
+	mux.HandleFunc("/api/v1/sign-in/magic-link", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: signInHandler.MagicLink,
+	}))
+	mux.HandleFunc("/api/v1/sign-in/magic-link/callback", byMethod(map[string]http.HandlerFunc{
+		http.MethodGet: signInHandler.MagicLinkCallback,
+	}))
+	mux.HandleFunc("/api/v1/sign-up/password", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: signInHandler.PasswordSignUp,
+	}))
+	mux.HandleFunc("/api/v1/mfa/totp", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost:   authorizer.RequireStepUp(mfaHandler.EnrollTOTP),
+		http.MethodDelete: authorizer.RequireStepUp(mfaHandler.DisableTOTP),
+	}))
+	mux.HandleFunc("/api/v1/mfa/totp/confirm", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: mfaHandler.ConfirmTOTP,
+	}))
+	mux.HandleFunc("/api/v1/mfa/recovery-codes", byMethod(map[string]http.HandlerFunc{
+		http.MethodGet:  mfaHandler.GetRecoveryCodes,
+		http.MethodPost: authorizer.RequireStepUp(mfaHandler.GenerateRecoveryCodes),
+	}))
+	mux.HandleFunc("/api/v1/mfa/recovery-codes/uses", byMethod(map[string]http.HandlerFunc{
+		http.MethodGet: mfaHandler.GetRecoveryCodeUses,
+	}))
+	mux.HandleFunc("/api/v1/mfa/verify", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: mfaHandler.Verify,
+	}))
+	mux.HandleFunc("/api/v1/webauthn/registration", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: authorizer.RequireStepUp(webAuthnHandler.BeginRegistration),
+	}))
+	mux.HandleFunc("/api/v1/webauthn/registration/finish", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: authorizer.RequireStepUp(webAuthnHandler.FinishRegistration),
+	}))
+	mux.HandleFunc("/api/v1/webauthn/sign-in", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: webAuthnHandler.BeginSignIn,
+	}))
+	mux.HandleFunc("/api/v1/webauthn/sign-in/finish", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: webAuthnHandler.FinishSignIn,
+	}))
+	mux.HandleFunc("/api/v1/webauthn/verify", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: webAuthnHandler.BeginVerify,
+	}))
+	mux.HandleFunc("/api/v1/webauthn/verify/finish", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: webAuthnHandler.FinishVerify,
+	}))
+	mux.HandleFunc("/api/v1/webauthn/credentials", byMethod(map[string]http.HandlerFunc{
+		http.MethodGet: webAuthnHandler.GetCredentials,
+	}))
+	mux.HandleFunc("/api/v1/webauthn/credentials/", byMethod(map[string]http.HandlerFunc{
+		http.MethodDelete: authorizer.RequireStepUp(webAuthnHandler.DeleteCredential),
+	}))
+	mux.HandleFunc("/api/v1/email-verification", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: accountHandler.SendEmailVerification,
+	}))
+	mux.HandleFunc("/api/v1/email-verification/confirm", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: accountHandler.VerifyEmail,
+	}))
+	mux.HandleFunc("/api/v1/password-reset", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: accountHandler.SendPasswordReset,
+	}))
+	mux.HandleFunc("/api/v1/password-reset/confirm", byMethod(map[string]http.HandlerFunc{
+		http.MethodPost: accountHandler.ResetPassword,
+	}))
 
 	return mux
 }
 
+// byMethod dispatches a request to the handler registered for its method.
+func byMethod(handlers map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler, ok := handlers[r.Method]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
+
 type StatusHandler struct{}
 
 func NewStatusHandler() StatusHandler {
@@ -94,72 +204,1974 @@ func (h UserHandler) getSignedInUser(w http.ResponseWriter, r *http.Request) {
 	HttpReplyJson(w, http.StatusOK, rsp)
 }
 
-type SingleSignOnHandler struct {
-	singleSignOn SingleSignOn
-	homepageURL  string
+type AdminHandler struct {
+	userManager       UserManager
+	invitationManager InvitationManager
+	roleManager       RoleManager
 }
 
-func NewSingleSignOnHandler(
-	singleSignOn SingleSignOn,
-	homepageURL string,
-) SingleSignOnHandler {
-	return SingleSignOnHandler{
-		singleSignOn: singleSignOn,
-		homepageURL:  homepageURL,
+func NewAdminHandler(
+	userManager UserManager,
+	invitationManager InvitationManager,
+	roleManager RoleManager,
+) AdminHandler {
+	return AdminHandler{
+		userManager:       userManager,
+		invitationManager: invitationManager,
+		roleManager:       roleManager,
 	}
 }
 
-func (h SingleSignOnHandler) SignIn(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+func (h AdminHandler) CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	req := struct {
+		Email     string    `json:"email"`
+		Role      string    `json:"role"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(req.Role) > 0 {
+		if _, err := h.roleManager.GetRole(req.Role); err != nil {
+			err = fmt.Errorf("invalid role: %v", err)
+			HttpReplyError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	ok, err := h.roleManager.CanGrantRole(payload.Roles, req.Role)
+	if err != nil {
+		err = fmt.Errorf("could not retrieve permissions: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		HttpReplyError(w, http.StatusForbidden, fmt.Errorf("missing permission %s to invite with role %s", PermissionRolesWrite, req.Role))
+		return
+	}
+
+	invitation, token, err := h.invitationManager.CreateInvitation(Invitation{
+		Email:     req.Email,
+		Role:      req.Role,
+		CreatedBy: payload.UserID,
+		ExpiresAt: req.ExpiresAt,
+	})
+	if err != nil {
+		err = fmt.Errorf("could not create invitation: %v", err)
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	rsp := struct {
+		Invitation Invitation `json:"invitation"`
+		Token      string     `json:"token"`
+	}{Invitation: invitation, Token: token}
+	HttpReplyJson(w, http.StatusCreated, rsp)
+}
+
+func (h AdminHandler) GetRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := h.roleManager.GetRoles()
+	if err != nil {
+		err = fmt.Errorf("could not retrieve roles: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	rsp := struct {
+		Roles []Role `json:"roles"`
+	}{Roles: roles}
+	HttpReplyJson(w, http.StatusOK, rsp)
+}
+
+func (h AdminHandler) CreateRole(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	role, err := h.roleManager.CreateRole(req.Name, req.Description, req.Permissions)
+	if err != nil {
+		err = fmt.Errorf("could not create role: %v", err)
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	rsp := struct {
+		Role Role `json:"role"`
+	}{Role: role}
+	HttpReplyJson(w, http.StatusCreated, rsp)
+}
+
+// GetUserRoles handles GET /api/v1/admin/users/{id}/roles.
+func (h AdminHandler) GetUserRoles(w http.ResponseWriter, r *http.Request) {
+	userID, roleName, ok := parseUserRolesPath(r.URL.Path)
+	if !ok || len(roleName) > 0 {
 		http.NotFound(w, r)
 		return
 	}
 
-	token := getToken(r)
-	if h.singleSignOn.IsSignedIn(token) {
-		http.Redirect(w, r, h.homepageURL, http.StatusSeeOther)
+	if _, err := h.userManager.GetUserByID(userID); err != nil {
+		HttpReplyError(w, http.StatusNotFound, err)
 		return
 	}
 
-	authorizationURL, err := h.singleSignOn.GetAuthorizationURL()
+	roles, err := h.roleManager.GetUserRoles(userID)
 	if err != nil {
-		err = fmt.Errorf("invalid authorization url: %v", err)
+		err = fmt.Errorf("could not retrieve roles: %v", err)
 		HttpReplyError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	http.Redirect(w, r, authorizationURL, http.StatusSeeOther)
+	rsp := struct {
+		Roles []string `json:"roles"`
+	}{Roles: roles}
+	HttpReplyJson(w, http.StatusOK, rsp)
 }
 
-func (h SingleSignOnHandler) Callback(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+// AssignUserRole handles PUT /api/v1/admin/users/{id}/roles/{role}.
+func (h AdminHandler) AssignUserRole(w http.ResponseWriter, r *http.Request) {
+	h.changeUserRole(w, r, h.roleManager.AssignRole)
+}
+
+// UnassignUserRole handles DELETE /api/v1/admin/users/{id}/roles/{role}.
+func (h AdminHandler) UnassignUserRole(w http.ResponseWriter, r *http.Request) {
+	h.changeUserRole(w, r, h.roleManager.UnassignRole)
+}
+
+func (h AdminHandler) changeUserRole(
+	w http.ResponseWriter,
+	r *http.Request,
+	change func(userID int, roleName string) error,
+) {
+	userID, roleName, ok := parseUserRolesPath(r.URL.Path)
+	if !ok || len(roleName) < 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if _, err := h.userManager.GetUserByID(userID); err != nil {
+		HttpReplyError(w, http.StatusNotFound, err)
+		return
+	}
+
+	err := change(userID, roleName)
+	var roleNotFound ErrRoleNotFound
+	if errors.As(err, &roleNotFound) {
+		HttpReplyError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("could not change role: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseUserRolesPath parses /api/v1/admin/users/{id}/roles[/{role}].
+func parseUserRolesPath(path string) (int, string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/api/v1/admin/users/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] != "roles" {
+		return 0, "", false
+	}
+
+	userID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", false
+	}
+
+	if len(parts) == 3 {
+		return userID, parts[2], len(parts[2]) > 0
+	}
+	return userID, "", true
+}
+
+type OrganizationHandler struct {
+	authenticator           Authenticator
+	organizationManager     OrganizationManager
+	invitationManager       InvitationManager
+	userManager             UserManager
+	identityProviderHandler IdentityProviderHandler
+}
+
+func NewOrganizationHandler(
+	authenticator Authenticator,
+	organizationManager OrganizationManager,
+	invitationManager InvitationManager,
+	userManager UserManager,
+	identityProviderHandler IdentityProviderHandler,
+) OrganizationHandler {
+	return OrganizationHandler{
+		authenticator:           authenticator,
+		organizationManager:     organizationManager,
+		invitationManager:       invitationManager,
+		userManager:             userManager,
+		identityProviderHandler: identityProviderHandler,
+	}
+}
+
+func (h OrganizationHandler) GetOrganizations(w http.ResponseWriter, r *http.Request) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	memberships, err := h.organizationManager.GetUserOrganizations(payload.UserID)
+	if err != nil {
+		err = fmt.Errorf("could not retrieve organizations: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	rsp := struct {
+		Organizations []OrganizationMembership `json:"organizations"`
+		Current       int                      `json:"current_organization_id,omitempty"`
+	}{Organizations: memberships, Current: payload.OrganizationID}
+	HttpReplyJson(w, http.StatusOK, rsp)
+}
+
+func (h OrganizationHandler) CreateOrganization(w http.ResponseWriter, r *http.Request) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	req := struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	organization, err := h.organizationManager.CreateOrganization(payload.UserID, req.Name, req.Slug)
+	if err != nil {
+		err = fmt.Errorf("could not create organization: %v", err)
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	rsp := struct {
+		Organization Organization `json:"organization"`
+	}{Organization: organization}
+	HttpReplyJson(w, http.StatusCreated, rsp)
+}
+
+// GetResource handles GET /api/v1/organizations/{id}/{resource}.
+func (h OrganizationHandler) GetResource(w http.ResponseWriter, r *http.Request) {
+	organizationID, resource, ok := parseOrganizationPath(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(resource) == 1 && resource[0] == "members":
+		h.getMembers(w, r, organizationID)
+	case len(resource) == 1 && resource[0] == "identity-providers":
+		h.identityProviderHandler.GetIdentityProviders(w, r, organizationID)
+	case len(resource) == 2 && resource[0] == "identity-providers":
+		h.identityProviderHandler.GetIdentityProvider(w, r, organizationID, resource[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// PostResource handles POST /api/v1/organizations/{id}/{resource}.
+func (h OrganizationHandler) PostResource(w http.ResponseWriter, r *http.Request) {
+	organizationID, resource, ok := parseOrganizationPath(r.URL.Path)
+	if !ok || len(resource) != 1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch resource[0] {
+	case "invitations":
+		h.inviteMember(w, r, organizationID)
+	case "leave":
+		h.leave(w, r, organizationID)
+	case "switch":
+		h.switchOrganization(w, r, organizationID)
+	case "identity-providers":
+		h.identityProviderHandler.CreateIdentityProvider(w, r, organizationID)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// PutResource handles PUT /api/v1/organizations/{id}/identity-providers/{name}.
+func (h OrganizationHandler) PutResource(w http.ResponseWriter, r *http.Request) {
+	organizationID, resource, ok := parseOrganizationPath(r.URL.Path)
+	if !ok || len(resource) != 2 || resource[0] != "identity-providers" {
+		http.NotFound(w, r)
+		return
+	}
+
+	h.identityProviderHandler.UpdateIdentityProvider(w, r, organizationID, resource[1])
+}
+
+// DeleteResource handles DELETE /api/v1/organizations/{id}/identity-providers/{name}.
+func (h OrganizationHandler) DeleteResource(w http.ResponseWriter, r *http.Request) {
+	organizationID, resource, ok := parseOrganizationPath(r.URL.Path)
+	if !ok || len(resource) != 2 || resource[0] != "identity-providers" {
 		http.NotFound(w, r)
 		return
 	}
 
-	code := r.URL.Query().Get("code")
-	token, err := h.singleSignOn.SignIn(code)
+	h.identityProviderHandler.DeleteIdentityProvider(w, r, organizationID, resource[1])
+}
+
+func (h OrganizationHandler) getMembers(w http.ResponseWriter, r *http.Request, organizationID int) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	members, err := h.organizationManager.GetMembers(organizationID, payload.UserID)
 	if err != nil {
-		err = fmt.Errorf("invalid authorization code: %v", err)
+		replyOrganizationError(w, err)
+		return
+	}
+
+	rsp := struct {
+		Members []Member `json:"members"`
+	}{Members: members}
+	HttpReplyJson(w, http.StatusOK, rsp)
+}
+
+func (h OrganizationHandler) inviteMember(w http.ResponseWriter, r *http.Request, organizationID int) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	req := struct {
+		Email     string    `json:"email"`
+		Role      string    `json:"role"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
 		HttpReplyError(w, http.StatusBadRequest, err)
 		return
 	}
 
+	invitation, token, err := h.organizationManager.InviteMember(
+		payload.UserID,
+		organizationID,
+		req.Email,
+		req.Role,
+		req.ExpiresAt,
+	)
+	if err != nil {
+		replyOrganizationError(w, err)
+		return
+	}
+
+	rsp := struct {
+		Invitation Invitation `json:"invitation"`
+		Token      string     `json:"token"`
+	}{Invitation: invitation, Token: token}
+	HttpReplyJson(w, http.StatusCreated, rsp)
+}
+
+func (h OrganizationHandler) leave(w http.ResponseWriter, r *http.Request, organizationID int) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	if err := h.organizationManager.LeaveOrganization(organizationID, payload.UserID); err != nil {
+		replyOrganizationError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h OrganizationHandler) switchOrganization(w http.ResponseWriter, r *http.Request, organizationID int) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	membership, err := h.organizationManager.GetMembership(organizationID, payload.UserID)
+	if err != nil {
+		replyOrganizationError(w, err)
+		return
+	}
+
+	token, err := h.authenticator.SwitchOrganization(payload, organizationID, membership.Role)
+	if err != nil {
+		err = fmt.Errorf("could not switch organization: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	http.SetCookie(w, &http.Cookie{Name: "token", Value: token, Path: "/"})
-	http.Redirect(w, r, h.homepageURL, http.StatusSeeOther)
+	rsp := struct {
+		Token string `json:"token"`
+	}{Token: token}
+	HttpReplyJson(w, http.StatusOK, rsp)
 }
 
-func getToken(r *http.Request) string {
-	auth := r.Header.Get("Authorization")
-	if len(auth) < 1 {
-		return ""
+// AcceptInvitation lets a signed in user accept an invitation to an organization.
+func (h OrganizationHandler) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	req := struct {
+		Token string `json:"token"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
 	}
-	words := strings.Split(auth, " ")
-	if len(words) != 2 {
-		return ""
+
+	user, err := h.userManager.GetUserByID(payload.UserID)
+	if err != nil {
+		err = fmt.Errorf("could not retrieve authorized user: %v", err)
+		HttpReplyError(w, http.StatusUnauthorized, err)
+		return
 	}
-	if words[0] != "Bearer" {
-		return ""
+
+	invitation, err := h.invitationManager.AcceptInvitation(req.Token, user.Email)
+	if err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.organizationManager.JoinByInvitation(user, invitation); err != nil {
+		err = fmt.Errorf("could not join organization: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	rsp := struct {
+		Invitation Invitation `json:"invitation"`
+	}{Invitation: invitation}
+	HttpReplyJson(w, http.StatusOK, rsp)
+}
+
+func replyOrganizationError(w http.ResponseWriter, err error) {
+	var organizationNotFound ErrOrganizationNotFound
+	var organizationForbidden ErrOrganizationForbidden
+	switch {
+	case errors.As(err, &organizationNotFound):
+		HttpReplyError(w, http.StatusNotFound, err)
+	case errors.As(err, &organizationForbidden):
+		HttpReplyError(w, http.StatusForbidden, err)
+	default:
+		HttpReplyError(w, http.StatusBadRequest, err)
+	}
+}
+
+// parseOrganizationPath parses /api/v1/organizations/{id}/{resource...}.
+func parseOrganizationPath(path string) (int, []string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/api/v1/organizations/"), "/")
+	if len(parts) < 2 {
+		return 0, nil, false
+	}
+
+	organizationID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, nil, false
+	}
+
+	for _, part := range parts[1:] {
+		if len(part) < 1 {
+			return 0, nil, false
+		}
+	}
+
+	return organizationID, parts[1:], true
+}
+
+type IdentityProviderHandler struct {
+	identityProviderManager IdentityProviderManager
+	providerRegistry        ProviderRegistry
+}
+
+func NewIdentityProviderHandler(
+	identityProviderManager IdentityProviderManager,
+	providerRegistry ProviderRegistry,
+) IdentityProviderHandler {
+	return IdentityProviderHandler{
+		identityProviderManager: identityProviderManager,
+		providerRegistry:        providerRegistry,
+	}
+}
+
+type identityProviderResponse struct {
+	IdentityProviderConfig
+	CallbackURL string `json:"callback_url"`
+	MetadataURL string `json:"metadata_url,omitempty"`
+}
+
+func (h IdentityProviderHandler) GetIdentityProviders(w http.ResponseWriter, r *http.Request, organizationID int) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	configs, err := h.identityProviderManager.GetIdentityProviders(payload.UserID, organizationID)
+	if err != nil {
+		replyIdentityProviderError(w, err)
+		return
+	}
+
+	identityProviders := []identityProviderResponse{}
+	for _, config := range configs {
+		identityProviders = append(identityProviders, h.toResponse(config))
+	}
+
+	rsp := struct {
+		IdentityProviders []identityProviderResponse `json:"identity_providers"`
+	}{IdentityProviders: identityProviders}
+	HttpReplyJson(w, http.StatusOK, rsp)
+}
+
+func (h IdentityProviderHandler) GetIdentityProvider(w http.ResponseWriter, r *http.Request, organizationID int, name string) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	config, err := h.identityProviderManager.GetIdentityProvider(payload.UserID, organizationID, name)
+	if err != nil {
+		replyIdentityProviderError(w, err)
+		return
+	}
+
+	rsp := struct {
+		IdentityProvider identityProviderResponse `json:"identity_provider"`
+	}{IdentityProvider: h.toResponse(config)}
+	HttpReplyJson(w, http.StatusOK, rsp)
+}
+
+func (h IdentityProviderHandler) CreateIdentityProvider(w http.ResponseWriter, r *http.Request, organizationID int) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	config, ok := readIdentityProviderConfig(w, r)
+	if !ok {
+		return
+	}
+	config.OrganizationID = organizationID
+
+	config, err := h.identityProviderManager.CreateIdentityProvider(payload.UserID, config)
+	if err != nil {
+		replyIdentityProviderError(w, err)
+		return
+	}
+
+	rsp := struct {
+		IdentityProvider identityProviderResponse `json:"identity_provider"`
+	}{IdentityProvider: h.toResponse(config)}
+	HttpReplyJson(w, http.StatusCreated, rsp)
+}
+
+func (h IdentityProviderHandler) UpdateIdentityProvider(w http.ResponseWriter, r *http.Request, organizationID int, name string) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	config, ok := readIdentityProviderConfig(w, r)
+	if !ok {
+		return
+	}
+	config.OrganizationID = organizationID
+	config.Name = name
+
+	config, err := h.identityProviderManager.UpdateIdentityProvider(payload.UserID, config)
+	if err != nil {
+		replyIdentityProviderError(w, err)
+		return
+	}
+
+	rsp := struct {
+		IdentityProvider identityProviderResponse `json:"identity_provider"`
+	}{IdentityProvider: h.toResponse(config)}
+	HttpReplyJson(w, http.StatusOK, rsp)
+}
+
+func (h IdentityProviderHandler) DeleteIdentityProvider(w http.ResponseWriter, r *http.Request, organizationID int, name string) {
+	payload, _ := TokenPayloadFromContext(r.Context())
+
+	if err := h.identityProviderManager.DeleteIdentityProvider(payload.UserID, organizationID, name); err != nil {
+		replyIdentityProviderError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h IdentityProviderHandler) toResponse(config IdentityProviderConfig) identityProviderResponse {
+	if config.Type == samlProviderType {
+		return identityProviderResponse{
+			IdentityProviderConfig: config,
+			CallbackURL:            h.providerRegistry.SAMLACSURL(config.Name),
+			MetadataURL:            h.providerRegistry.SAMLMetadataURL(config.Name),
+		}
+	}
+
+	return identityProviderResponse{
+		IdentityProviderConfig: config,
+		CallbackURL:            h.providerRegistry.CallbackURL(config.Name),
+	}
+}
+
+func readIdentityProviderConfig(w http.ResponseWriter, r *http.Request) (IdentityProviderConfig, bool) {
+	req := struct {
+		Name         string            `json:"name"`
+		Type         string            `json:"type"`
+		ClientID     string            `json:"client_id"`
+		ClientSecret string            `json:"client_secret"`
+		Scopes       []string          `json:"scopes"`
+		Issuer       string            `json:"issuer"`
+		Options      map[string]string `json:"options"`
+		Enabled      *bool             `json:"enabled"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return IdentityProviderConfig{}, false
+	}
+
+	enabled := true
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+
+	return IdentityProviderConfig{
+		Name:         req.Name,
+		Type:         req.Type,
+		ClientID:     req.ClientID,
+		ClientSecret: req.ClientSecret,
+		Scopes:       req.Scopes,
+		Issuer:       req.Issuer,
+		Options:      req.Options,
+		Enabled:      enabled,
+	}, true
+}
+
+func replyIdentityProviderError(w http.ResponseWriter, err error) {
+	var identityProviderNotFound ErrIdentityProviderNotFound
+	if errors.As(err, &identityProviderNotFound) {
+		HttpReplyError(w, http.StatusNotFound, err)
+		return
+	}
+	replyOrganizationError(w, err)
+}
+
+// SingleSignOnRouter serves /api/v1/single-sign-on/{provider}/sign-in and
+// /api/v1/single-sign-on/{provider}/callback for every provider in the
+// registry.
+type SingleSignOnRouter struct {
+	providerRegistry ProviderRegistry
+	homepageURL      string
+}
+
+func NewSingleSignOnRouter(
+	providerRegistry ProviderRegistry,
+	homepageURL string,
+) SingleSignOnRouter {
+	return SingleSignOnRouter{
+		providerRegistry: providerRegistry,
+		homepageURL:      homepageURL,
+	}
+}
+
+func (h SingleSignOnRouter) GetProviders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+
+	rsp := struct {
+		Providers []ProviderInfo `json:"providers"`
+	}{Providers: h.providerRegistry.Providers()}
+	HttpReplyJson(w, http.StatusOK, rsp)
+}
+
+func (h SingleSignOnRouter) Route(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/single-sign-on/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	singleSignOn, err := h.providerRegistry.Lookup(parts[0])
+	var identityProviderNotFound ErrIdentityProviderNotFound
+	if errors.As(err, &identityProviderNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid identity provider: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	handler := NewSingleSignOnHandler(singleSignOn, h.homepageURL)
+	switch parts[1] {
+	case "sign-in":
+		handler.SignIn(w, r)
+	case "callback":
+		handler.Callback(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type SingleSignOnHandler struct {
+	singleSignOn  SingleSignOn
+	homepageURL   string
+	proxyCookies  bool
+	secureCookies bool
+}
+
+func NewSingleSignOnHandler(
+	singleSignOn SingleSignOn,
+	homepageURL string,
+) SingleSignOnHandler {
+	return SingleSignOnHandler{
+		singleSignOn: singleSignOn,
+		homepageURL:  homepageURL,
+	}
+}
+
+// NewProxySingleSignOnHandler creates a handler that sets the cookies of the
+// proxy, see proxyCookie.
+func NewProxySingleSignOnHandler(
+	singleSignOn SingleSignOn,
+	homepageURL string,
+	secureCookies bool,
+) SingleSignOnHandler {
+	handler := NewSingleSignOnHandler(singleSignOn, homepageURL)
+	handler.proxyCookies = true
+	handler.secureCookies = secureCookies
+	return handler
+}
+
+func (h SingleSignOnHandler) SignIn(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+
+	options, err := ParseAuthorizationOptions(r.URL.Query())
+	if err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	returnTo := r.URL.Query().Get("rd")
+	if _, ok := returnURL(h.homepageURL, returnTo); !ok {
+		HttpReplyError(w, http.StatusBadRequest, fmt.Errorf("invalid rd: %s", returnTo))
+		return
+	}
+
+	if skipSignIn(h.singleSignOn, getToken(r), options) {
+		redirectURL, _ := returnURL(h.homepageURL, returnTo)
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return
+	}
+
+	options.State, err = generateToken()
+	if err != nil {
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+	http.SetCookie(w, h.stateCookie(url.Values{"state": {options.State}, "rd": {returnTo}}.Encode(), signInStateLifetime))
+	setInvitationCookie(w, r)
+
+	authorizationURL, err := h.singleSignOn.GetAuthorizationURL(options)
+	if err != nil {
+		err = fmt.Errorf("invalid authorization url: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, authorizationURL, http.StatusSeeOther)
+}
+
+// Callback handles the redirect back from the provider, which is either a GET
+// request or, for providers using the form_post response mode, a POST request.
+func (h SingleSignOnHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	returnTo, ok := h.takeState(w, r)
+	if !ok {
+		err := ErrAuthorizationFailed{
+			Provider:    h.singleSignOn.name,
+			Code:        SignInBrowserMismatch,
+			Reason:      "state_mismatch",
+			Description: "the callback does not carry the state of a sign-in started in this browser",
+		}
+		redirectAuthorizationFailed(w, r, h.homepageURL, err)
+		return
+	}
+
+	token, err := h.singleSignOn.SignIn(r.Form, takeInvitationCookie(w, r))
+	var mfaRequired ErrMFARequired
+	if h.proxyCookies && errors.As(err, &mfaRequired) {
+		http.SetCookie(w, proxyCookie("mfa_token", mfaRequired.Token, int(mfaPendingLifetime.Seconds()), h.secureCookies))
+		http.Redirect(w, r, h.homepageURL, http.StatusSeeOther)
+		return
+	}
+	if redirectMFARequired(w, r, h.homepageURL, err) {
+		return
+	}
+	if redirectAuthorizationFailed(w, r, h.homepageURL, err) {
+		return
+	}
+	if err != nil {
+		replySignInError(w, fmt.Errorf("invalid authorization code: %w", err))
+		return
+	}
+
+	redirectURL, ok := returnURL(h.homepageURL, returnTo)
+	if !ok {
+		redirectURL = h.homepageURL
+	}
+
+	tokenCookie := &http.Cookie{Name: "token", Value: token, Path: "/"}
+	if h.proxyCookies {
+		tokenCookie = proxyCookie("token", token, 0, h.secureCookies)
+	}
+	http.SetCookie(w, tokenCookie)
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+// signInStateLifetime is how long a user has to sign in at the provider.
+const signInStateLifetime = 10 * time.Minute
+
+// stateCookie remembers the state and rd of a sign-in until the provider
+// redirects back, binding the callback to the browser that started it.
+func (h SingleSignOnHandler) stateCookie(value string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     "sign_in_state",
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		// form_post callbacks are cross-site POST requests, which
+		// only carry cookies with SameSite=None.
+		SameSite: http.SameSiteNoneMode,
+	}
+	// SameSite=None requires Secure, which a proxy served over http
+	// cannot set.
+	if h.proxyCookies && !h.secureCookies {
+		cookie.Secure = false
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	return cookie
+}
+
+// takeState removes the state cookie and returns the rd of the sign-in,
+// reporting false unless the state of the callback matches the cookie.
+func (h SingleSignOnHandler) takeState(w http.ResponseWriter, r *http.Request) (string, bool) {
+	cookie, err := r.Cookie("sign_in_state")
+	if err != nil {
+		return "", false
+	}
+	http.SetCookie(w, h.stateCookie("", -time.Second))
+
+	values, err := url.ParseQuery(cookie.Value)
+	state := r.Form.Get("state")
+	if err != nil || len(state) < 1 || subtle.ConstantTimeCompare([]byte(state), []byte(values.Get("state"))) != 1 {
+		return "", false
+	}
+	return values.Get("rd"), true
+}
+
+// returnURL resolves rd, the url a sign-in was started from, against the
+// homepage. It reports false for urls of another origin than the homepage,
+// so sign-ins cannot be used to redirect elsewhere.
+func returnURL(homepageURL string, rd string) (string, bool) {
+	if len(rd) < 1 {
+		return homepageURL, true
+	}
+	// Browsers read backslashes as slashes, making /\host a url of
+	// another host.
+	if strings.Contains(rd, "\\") {
+		return "", false
+	}
+
+	base, err := url.Parse(homepageURL)
+	if err != nil {
+		return "", false
+	}
+	target, err := url.Parse(rd)
+	if err != nil {
+		return "", false
+	}
+
+	resolved := base.ResolveReference(target)
+	if resolved.Scheme != base.Scheme || resolved.Host != base.Host {
+		return "", false
+	}
+	return resolved.String(), true
+}
+
+// setInvitationCookie remembers the invitation of the sign-in until the
+// provider redirects back.
+func setInvitationCookie(w http.ResponseWriter, r *http.Request) {
+	invitationToken := r.URL.Query().Get("invitation")
+	if len(invitationToken) < 1 {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "invitation",
+		Value:    invitationToken,
+		Path:     "/",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		// form_post callbacks are cross-site POST requests, which
+		// only carry cookies with SameSite=None.
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
+func takeInvitationCookie(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie("invitation")
+	if err != nil {
+		return ""
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "invitation", Value: "", Path: "/", MaxAge: -1})
+	return cookie.Value
+}
+
+// redirectMFARequired continues a sign-in that is pending the second factor
+// in the web app, which gets the mfa_pending token as mfa_token cookie to
+// post the code to /api/v1/mfa/verify with.
+func redirectMFARequired(w http.ResponseWriter, r *http.Request, homepageURL string, err error) bool {
+	var mfaRequired ErrMFARequired
+	if !errors.As(err, &mfaRequired) {
+		return false
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "mfa_token",
+		Value:    mfaRequired.Token,
+		Path:     "/",
+		MaxAge:   int(mfaPendingLifetime.Seconds()),
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, homepageURL, http.StatusSeeOther)
+	return true
+}
+
+// redirectAuthorizationFailed sends the user back to the web app when the
+// provider did not authorize the sign-in, or failed to complete it, or the
+// user was rejected, with the code of the error as sign_in_error query
+// parameter for the web app to display.
+func redirectAuthorizationFailed(w http.ResponseWriter, r *http.Request, homepageURL string, err error) bool {
+	var authorizationFailed ErrAuthorizationFailed
+	var providerError ProviderError
+	var signInRejected ErrSignInRejected
+	var signUpRejected ErrSignUpRejected
+	switch {
+	case errors.As(err, &signInRejected):
+		authorizationFailed.Code = signInRejected.Code
+	case errors.As(err, &signUpRejected):
+		authorizationFailed.Code = signUpRejected.Code
+	case errors.As(err, &authorizationFailed):
+		if authorizationFailed.Code != SignInCancelled {
+			log.Printf("%v", authorizationFailed)
+		}
+	case errors.As(err, &providerError):
+		log.Printf("sign-in failed: %v", err)
+		authorizationFailed.Code = providerError.SignInCode()
+	default:
+		return false
+	}
+
+	redirectURL, err := url.Parse(homepageURL)
+	if err != nil {
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return true
+	}
+	q := redirectURL.Query()
+	q.Set("sign_in_error", authorizationFailed.Code)
+	redirectURL.RawQuery = q.Encode()
+
+	http.Redirect(w, r, redirectURL.String(), http.StatusSeeOther)
+	return true
+}
+
+// replySignInError replies with the reason a user was rejected, or a bad
+// request for any other error.
+func replySignInError(w http.ResponseWriter, err error) {
+	var signUpRejected ErrSignUpRejected
+	if errors.As(err, &signUpRejected) {
+		rsp := struct {
+			Error ErrSignUpRejected `json:"error"`
+		}{Error: signUpRejected}
+		HttpReplyJson(w, http.StatusForbidden, rsp)
+		return
+	}
+
+	var signInRejected ErrSignInRejected
+	if errors.As(err, &signInRejected) {
+		rsp := struct {
+			Error ErrSignInRejected `json:"error"`
+		}{Error: signInRejected}
+		HttpReplyJson(w, http.StatusForbidden, rsp)
+		return
+	}
+
+	var mfaRequired ErrMFARequired
+	if errors.As(err, &mfaRequired) {
+		rsp := struct {
+			Error    ErrSignInRejected `json:"error"`
+			MFAToken string            `json:"mfa_token"`
+		}{
+			Error:    ErrSignInRejected{Code: SignInMFARequired, Message: mfaRequired.Error()},
+			MFAToken: mfaRequired.Token,
+		}
+		HttpReplyJson(w, http.StatusUnauthorized, rsp)
+		return
+	}
+
+	HttpReplyError(w, http.StatusBadRequest, err)
+}
+
+// SAMLRouter serves /api/v1/saml/{provider}/metadata, /sign-in and /acs for
+// the SAML identity providers of organizations.
+type SAMLRouter struct {
+	providerRegistry ProviderRegistry
+	homepageURL      string
+}
+
+func NewSAMLRouter(
+	providerRegistry ProviderRegistry,
+	homepageURL string,
+) SAMLRouter {
+	return SAMLRouter{
+		providerRegistry: providerRegistry,
+		homepageURL:      homepageURL,
+	}
+}
+
+func (h SAMLRouter) Route(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/saml/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	serviceProvider, singleSignOn, err := h.providerRegistry.LookupSAML(parts[0])
+	var identityProviderNotFound ErrIdentityProviderNotFound
+	if errors.As(err, &identityProviderNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("invalid identity provider: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch {
+	case parts[1] == "metadata" && r.Method == http.MethodGet:
+		h.Metadata(w, r, serviceProvider)
+	case parts[1] == "sign-in" && r.Method == http.MethodGet:
+		h.SignIn(w, r, serviceProvider, singleSignOn)
+	case parts[1] == "acs" && r.Method == http.MethodPost:
+		h.ACS(w, r, serviceProvider, singleSignOn)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h SAMLRouter) Metadata(w http.ResponseWriter, r *http.Request, serviceProvider SAMLServiceProvider) {
+	metadata, err := serviceProvider.Metadata()
+	if err != nil {
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(metadata)
+}
+
+func (h SAMLRouter) SignIn(w http.ResponseWriter, r *http.Request, serviceProvider SAMLServiceProvider, singleSignOn SingleSignOn) {
+	options, err := ParseAuthorizationOptions(r.URL.Query())
+	if err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if skipSignIn(singleSignOn, getToken(r), options) {
+		http.Redirect(w, r, h.homepageURL, http.StatusSeeOther)
+		return
+	}
+
+	setInvitationCookie(w, r)
+
+	if serviceProvider.UsesPostBinding() {
+		form, err := serviceProvider.AuthnRequestForm(options)
+		if err != nil {
+			HttpReplyError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write(form)
+		return
+	}
+
+	authnRequestURL, err := serviceProvider.AuthnRequestURL(options)
+	if err != nil {
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	http.Redirect(w, r, authnRequestURL, http.StatusSeeOther)
+}
+
+// ACS is the assertion consumer service the IdP posts its response to.
+func (h SAMLRouter) ACS(w http.ResponseWriter, r *http.Request, serviceProvider SAMLServiceProvider, singleSignOn SingleSignOn) {
+	if err := r.ParseForm(); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	singleSignOnUser, err := serviceProvider.ParseResponse(r.PostForm.Get("SAMLResponse"))
+	if redirectAuthorizationFailed(w, r, h.homepageURL, err) {
+		takeInvitationCookie(w, r)
+		return
+	}
+	if err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	token, err := singleSignOn.SignInUser(singleSignOnUser, takeInvitationCookie(w, r))
+	if redirectMFARequired(w, r, h.homepageURL, err) {
+		return
+	}
+	if redirectAuthorizationFailed(w, r, h.homepageURL, err) {
+		return
+	}
+	if err != nil {
+		replySignInError(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "token", Value: token, Path: "/"})
+	http.Redirect(w, r, h.homepageURL, http.StatusSeeOther)
+}
+
+// skipSignIn reports whether the token is signed in already. Step-up
+// sign-ins pass prompt=login, or max_age in seconds, to sign in again, and
+// prompt=select_account to pick another account.
+func skipSignIn(singleSignOn SingleSignOn, token string, options AuthorizationOptions) bool {
+	if options.HasPrompt("login") || options.HasPrompt("select_account") {
+		return false
+	}
+
+	if options.MaxAge >= 0 {
+		return singleSignOn.IsAuthenticatedSince(token, time.Now().Add(-time.Duration(options.MaxAge)*time.Second))
+	}
+	return singleSignOn.IsSignedIn(token)
+}
+
+func getToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 1 {
+		return ""
+	}
+	words := strings.Split(auth, " ")
+	if len(words) != 2 {
+		return ""
+	}
+	if words[0] != "Bearer" {
+		return ""
+	}
+	return words[1]
+}
+
+// SignInHandler signs users in with credentials posted to the API instead of
+// through the redirects of a provider.
+type SignInHandler struct {
+	homepageURL            string
+	ldapAuthenticator      LDAPAuthenticator
+	passwordAuthenticator  PasswordAuthenticator
+	accountManager         AccountManager
+	magicLinkAuthenticator MagicLinkAuthenticator
+}
+
+func NewSignInHandler(
+	homepageURL string,
+	ldapAuthenticator LDAPAuthenticator,
+	passwordAuthenticator PasswordAuthenticator,
+	accountManager AccountManager,
+	magicLinkAuthenticator MagicLinkAuthenticator,
+) SignInHandler {
+	return SignInHandler{
+		homepageURL:            homepageURL,
+		ldapAuthenticator:      ldapAuthenticator,
+		passwordAuthenticator:  passwordAuthenticator,
+		accountManager:         accountManager,
+		magicLinkAuthenticator: magicLinkAuthenticator,
+	}
+}
+
+func (h SignInHandler) LDAP(w http.ResponseWriter, r *http.Request) {
+	if !h.ldapAuthenticator.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := struct {
+		Username   string `json:"username"`
+		Password   string `json:"password"`
+		Invitation string `json:"invitation"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	token, err := h.ldapAuthenticator.SignIn(req.Username, req.Password, req.Invitation)
+	h.replyToken(w, token, err)
+}
+
+func (h SignInHandler) Password(w http.ResponseWriter, r *http.Request) {
+	if !h.passwordAuthenticator.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := struct {
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		Invitation string `json:"invitation"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	token, err := h.passwordAuthenticator.SignIn(req.Email, req.Password, req.Invitation)
+	h.replyToken(w, token, err)
+}
+
+func (h SignInHandler) PasswordSignUp(w http.ResponseWriter, r *http.Request) {
+	if !h.passwordAuthenticator.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := struct {
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		Name       string `json:"name"`
+		Invitation string `json:"invitation"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user, token, err := h.passwordAuthenticator.SignUp(req.Email, req.Password, req.Name, req.Invitation)
+	if user.ID > 0 && !user.EmailVerified {
+		if err := h.accountManager.SendEmailVerification(user); err != nil {
+			log.Printf("failed to send email verification to user %d: %v", user.ID, err)
+		}
+	}
+	h.replyToken(w, token, err)
+}
+
+// MagicLink mails a sign-in link. The browser gets a cookie for the link,
+// which binds the link to it without affecting links requested before.
+func (h SignInHandler) MagicLink(w http.ResponseWriter, r *http.Request) {
+	if !h.magicLinkAuthenticator.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := struct {
+		Email      string `json:"email"`
+		Invitation string `json:"invitation"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	link, browserSecret, err := h.magicLinkAuthenticator.Send(req.Email, req.Invitation)
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicLinkCookiePrefix + strconv.Itoa(link.ID),
+		Value:    browserSecret,
+		Path:     magicLinkCookiePath,
+		MaxAge:   int(h.magicLinkAuthenticator.Lifetime().Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		// Links opened from a mail client are cross-site navigations,
+		// which carry cookies with SameSite=Lax.
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h SignInHandler) MagicLinkCallback(w http.ResponseWriter, r *http.Request) {
+	if !h.magicLinkAuthenticator.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	browserSecrets := map[int]string{}
+	for _, cookie := range r.Cookies() {
+		if !strings.HasPrefix(cookie.Name, magicLinkCookiePrefix) {
+			continue
+		}
+		if linkID, err := strconv.Atoi(strings.TrimPrefix(cookie.Name, magicLinkCookiePrefix)); err == nil {
+			browserSecrets[linkID] = cookie.Value
+		}
+	}
+
+	q := r.URL.Query()
+	token, err := h.magicLinkAuthenticator.SignIn(q.Get("token"), browserSecrets, q.Get("invitation"))
+	if redirectMFARequired(w, r, h.homepageURL, err) {
+		clearMagicLinkCookies(w, browserSecrets)
+		return
+	}
+	if redirectAuthorizationFailed(w, r, h.homepageURL, err) {
+		return
+	}
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	clearMagicLinkCookies(w, browserSecrets)
+	http.SetCookie(w, &http.Cookie{Name: "token", Value: token, Path: "/"})
+	http.Redirect(w, r, h.homepageURL, http.StatusSeeOther)
+}
+
+const (
+	magicLinkCookiePrefix = "magic_link_"
+	magicLinkCookiePath   = "/api/v1/sign-in/magic-link"
+)
+
+// clearMagicLinkCookies removes the cookies of all links once the browser
+// signed in.
+func clearMagicLinkCookies(w http.ResponseWriter, browserSecrets map[int]string) {
+	for linkID := range browserSecrets {
+		http.SetCookie(w, &http.Cookie{
+			Name:   magicLinkCookiePrefix + strconv.Itoa(linkID),
+			Value:  "",
+			Path:   magicLinkCookiePath,
+			MaxAge: -1,
+		})
+	}
+}
+
+// replyToken replies with the token of a successful sign-in, which is also
+// set as cookie like after a single sign-on.
+func (h SignInHandler) replyToken(w http.ResponseWriter, token string, err error) {
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "token", Value: token, Path: "/"})
+	rsp := struct {
+		Token string `json:"token"`
+	}{Token: token}
+	HttpReplyJson(w, http.StatusOK, rsp)
+}
+
+func (h SignInHandler) replyError(w http.ResponseWriter, err error) {
+	var invalidCredentials ErrInvalidCredentials
+	var invalidEmail ErrInvalidEmail
+	var magicLinkInvalid ErrMagicLinkInvalid
+	var rateLimited ErrRateLimited
+	var passwordRejected ErrPasswordRejected
+	var signUpRejected ErrSignUpRejected
+	var signInRejected ErrSignInRejected
+	var mfaRequired ErrMFARequired
+	switch {
+	case errors.As(err, &invalidCredentials):
+		HttpReplyError(w, http.StatusUnauthorized, err)
+	case errors.As(err, &invalidEmail), errors.As(err, &magicLinkInvalid):
+		HttpReplyError(w, http.StatusBadRequest, err)
+	case errors.As(err, &rateLimited):
+		HttpReplyError(w, http.StatusTooManyRequests, err)
+	case errors.As(err, &passwordRejected):
+		rsp := struct {
+			Error ErrPasswordRejected `json:"error"`
+		}{Error: passwordRejected}
+		HttpReplyJson(w, http.StatusBadRequest, rsp)
+	case errors.As(err, &signUpRejected), errors.As(err, &signInRejected), errors.As(err, &mfaRequired):
+		replySignInError(w, err)
+	default:
+		err = fmt.Errorf("failed to sign in: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// AccountHandler serves the email verification and password reset flows of
+// password accounts.
+type AccountHandler struct {
+	authenticator         Authenticator
+	userManager           UserManager
+	passwordAuthenticator PasswordAuthenticator
+	accountManager        AccountManager
+}
+
+func NewAccountHandler(
+	authenticator Authenticator,
+	userManager UserManager,
+	passwordAuthenticator PasswordAuthenticator,
+	accountManager AccountManager,
+) AccountHandler {
+	return AccountHandler{
+		authenticator:         authenticator,
+		userManager:           userManager,
+		passwordAuthenticator: passwordAuthenticator,
+		accountManager:        accountManager,
+	}
+}
+
+// SendEmailVerification sends another verification mail to the signed in
+// user.
+func (h AccountHandler) SendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	if !h.passwordAuthenticator.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	userID, err := h.authenticator.GetUserID(getToken(r))
+	if err != nil {
+		err = fmt.Errorf("could not authorize user: %v", err)
+		HttpReplyError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	user, err := h.userManager.GetUserByID(userID)
+	if err != nil {
+		err = fmt.Errorf("could not retrieve authorized user: %v", err)
+		HttpReplyError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	if err := h.accountManager.SendEmailVerification(user); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h AccountHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	if !h.passwordAuthenticator.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := struct {
+		Token string `json:"token"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.accountManager.VerifyEmail(req.Token); err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SendPasswordReset replies with 202 whether an account exists or not.
+func (h AccountHandler) SendPasswordReset(w http.ResponseWriter, r *http.Request) {
+	if !h.passwordAuthenticator.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := struct {
+		Email string `json:"email"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.accountManager.SendPasswordReset(req.Email); err != nil {
+		log.Printf("failed to send password reset: %v", err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h AccountHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if !h.passwordAuthenticator.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.accountManager.ResetPassword(req.Token, req.Password); err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h AccountHandler) replyError(w http.ResponseWriter, err error) {
+	var tokenInvalid ErrAccountTokenInvalid
+	var passwordRejected ErrPasswordRejected
+	switch {
+	case errors.As(err, &tokenInvalid):
+		HttpReplyError(w, http.StatusBadRequest, err)
+	case errors.As(err, &passwordRejected):
+		rsp := struct {
+			Error ErrPasswordRejected `json:"error"`
+		}{Error: passwordRejected}
+		HttpReplyJson(w, http.StatusBadRequest, rsp)
+	default:
+		err = fmt.Errorf("failed to update account: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// MFAHandler enrolls the signed in user for TOTP and completes sign-ins that
+// are pending the second factor.
+type MFAHandler struct {
+	authenticator Authenticator
+	userManager   UserManager
+	mfaManager    MFAManager
+}
+
+func NewMFAHandler(
+	authenticator Authenticator,
+	userManager UserManager,
+	mfaManager MFAManager,
+) MFAHandler {
+	return MFAHandler{
+		authenticator: authenticator,
+		userManager:   userManager,
+		mfaManager:    mfaManager,
+	}
+}
+
+// EnrollTOTP replies with a new secret and its otpauth:// URI to show as QR
+// code. It has to be confirmed with a code to enable it.
+func (h MFAHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	secret, uri, err := h.mfaManager.EnrollTOTP(user)
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	rsp := struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{Secret: secret, URI: uri}
+	HttpReplyJson(w, http.StatusCreated, rsp)
+}
+
+func (h MFAHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	req := struct {
+		Code string `json:"code"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.mfaManager.ConfirmTOTP(user, req.Code); err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h MFAHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	req := struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.mfaManager.DisableTOTP(user, req.Code, req.RecoveryCode); err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GenerateRecoveryCodes replies with a new set of recovery codes, which are
+// not shown again. Codes of the previous set stop working.
+func (h MFAHandler) GenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := h.mfaManager.GenerateRecoveryCodes(user)
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	rsp := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{RecoveryCodes: codes}
+	HttpReplyJson(w, http.StatusCreated, rsp)
+}
+
+func (h MFAHandler) GetRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := h.mfaManager.GetRecoveryCodes(user)
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	HttpReplyJson(w, http.StatusOK, codes)
+}
+
+func (h MFAHandler) GetRecoveryCodeUses(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	uses, err := h.mfaManager.GetRecoveryCodeUses(user)
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	HttpReplyJson(w, http.StatusOK, uses)
+}
+
+// Verify exchanges the mfa_pending token, sent as bearer token, and a code
+// or a recovery code for the token of the sign-in.
+func (h MFAHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	token, err := h.mfaManager.Verify(getToken(r), req.Code, req.RecoveryCode)
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "mfa_token", Value: "", Path: "/", MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: "token", Value: token, Path: "/"})
+	rsp := struct {
+		Token string `json:"token"`
+	}{Token: token}
+	HttpReplyJson(w, http.StatusOK, rsp)
+}
+
+func (h MFAHandler) getSignedInUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	userID, err := h.authenticator.GetUserID(getToken(r))
+	if err != nil {
+		err = fmt.Errorf("could not authorize user: %v", err)
+		HttpReplyError(w, http.StatusUnauthorized, err)
+		return User{}, false
+	}
+
+	user, err := h.userManager.GetUserByID(userID)
+	if err != nil {
+		err = fmt.Errorf("could not retrieve authorized user: %v", err)
+		HttpReplyError(w, http.StatusUnauthorized, err)
+		return User{}, false
+	}
+
+	return user, true
+}
+
+func (h MFAHandler) replyError(w http.ResponseWriter, err error) {
+	var invalidCredentials ErrInvalidCredentials
+	var rateLimited ErrRateLimited
+	var totpNotFound ErrTOTPNotFound
+	var alreadyEnabled ErrMFAAlreadyEnabled
+	var notEnabled ErrMFANotEnabled
+	switch {
+	case errors.As(err, &invalidCredentials):
+		HttpReplyError(w, http.StatusUnauthorized, err)
+	case errors.As(err, &rateLimited):
+		HttpReplyError(w, http.StatusTooManyRequests, err)
+	case errors.As(err, &totpNotFound), errors.As(err, &notEnabled):
+		HttpReplyError(w, http.StatusBadRequest, err)
+	case errors.As(err, &alreadyEnabled):
+		HttpReplyError(w, http.StatusConflict, err)
+	default:
+		err = fmt.Errorf("failed to update multi-factor authentication: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// WebAuthnHandler serves the WebAuthn ceremonies. Each is started with a
+// request for the options and finished by posting the credential returned by
+// the browser.
+type WebAuthnHandler struct {
+	authenticator Authenticator
+	userManager   UserManager
+	webAuthn      WebAuthn
+}
+
+func NewWebAuthnHandler(
+	authenticator Authenticator,
+	userManager UserManager,
+	webAuthn WebAuthn,
+) WebAuthnHandler {
+	return WebAuthnHandler{
+		authenticator: authenticator,
+		userManager:   userManager,
+		webAuthn:      webAuthn,
+	}
+}
+
+func (h WebAuthnHandler) BeginRegistration(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	options, err := h.webAuthn.BeginRegistration(user)
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	HttpReplyJson(w, http.StatusOK, options)
+}
+
+func (h WebAuthnHandler) FinishRegistration(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	req := struct {
+		Name       string                      `json:"name"`
+		Credential WebAuthnAttestationResponse `json:"credential"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	credential, err := h.webAuthn.FinishRegistration(user, req.Name, req.Credential)
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	HttpReplyJson(w, http.StatusCreated, credential)
+}
+
+func (h WebAuthnHandler) BeginSignIn(w http.ResponseWriter, r *http.Request) {
+	if !h.webAuthn.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	options, err := h.webAuthn.BeginSignIn()
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	HttpReplyJson(w, http.StatusOK, options)
+}
+
+func (h WebAuthnHandler) FinishSignIn(w http.ResponseWriter, r *http.Request) {
+	if !h.webAuthn.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := struct {
+		Credential WebAuthnAssertionResponse `json:"credential"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	token, err := h.webAuthn.FinishSignIn(req.Credential)
+	h.replyToken(w, token, err)
+}
+
+// BeginVerify starts the second factor of a sign-in, authorized by the
+// mfa_pending token as bearer token.
+func (h WebAuthnHandler) BeginVerify(w http.ResponseWriter, r *http.Request) {
+	if !h.webAuthn.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	options, err := h.webAuthn.BeginVerify(getToken(r))
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	HttpReplyJson(w, http.StatusOK, options)
+}
+
+func (h WebAuthnHandler) FinishVerify(w http.ResponseWriter, r *http.Request) {
+	if !h.webAuthn.Enabled() {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := struct {
+		Credential WebAuthnAssertionResponse `json:"credential"`
+	}{}
+	if err := HttpReadJson(r, &req); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	token, err := h.webAuthn.FinishVerify(getToken(r), req.Credential)
+	if err == nil {
+		http.SetCookie(w, &http.Cookie{Name: "mfa_token", Value: "", Path: "/", MaxAge: -1})
+	}
+	h.replyToken(w, token, err)
+}
+
+func (h WebAuthnHandler) GetCredentials(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	credentials, err := h.webAuthn.GetCredentials(user)
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	HttpReplyJson(w, http.StatusOK, credentials)
+}
+
+// DeleteCredential handles DELETE /api/v1/webauthn/credentials/{id}.
+func (h WebAuthnHandler) DeleteCredential(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.getSignedInUser(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/v1/webauthn/credentials/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := h.webAuthn.DeleteCredential(user, id); err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getSignedInUser authorizes requests that manage credentials, which are
+// only served while WebAuthn is enabled.
+func (h WebAuthnHandler) getSignedInUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	if !h.webAuthn.Enabled() {
+		http.NotFound(w, r)
+		return User{}, false
+	}
+
+	userID, err := h.authenticator.GetUserID(getToken(r))
+	if err != nil {
+		err = fmt.Errorf("could not authorize user: %v", err)
+		HttpReplyError(w, http.StatusUnauthorized, err)
+		return User{}, false
+	}
+
+	user, err := h.userManager.GetUserByID(userID)
+	if err != nil {
+		err = fmt.Errorf("could not retrieve authorized user: %v", err)
+		HttpReplyError(w, http.StatusUnauthorized, err)
+		return User{}, false
+	}
+
+	return user, true
+}
+
+func (h WebAuthnHandler) replyToken(w http.ResponseWriter, token string, err error) {
+	if err != nil {
+		h.replyError(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "token", Value: token, Path: "/"})
+	rsp := struct {
+		Token string `json:"token"`
+	}{Token: token}
+	HttpReplyJson(w, http.StatusOK, rsp)
+}
+
+func (h WebAuthnHandler) replyError(w http.ResponseWriter, err error) {
+	var invalidCredentials ErrInvalidCredentials
+	var webAuthnInvalid ErrWebAuthnInvalid
+	var credentialNotFound ErrWebAuthnCredentialNotFound
+	switch {
+	case errors.As(err, &invalidCredentials):
+		HttpReplyError(w, http.StatusUnauthorized, err)
+	case errors.As(err, &webAuthnInvalid):
+		HttpReplyError(w, http.StatusBadRequest, err)
+	case errors.As(err, &credentialNotFound):
+		HttpReplyError(w, http.StatusNotFound, err)
+	default:
+		err = fmt.Errorf("failed to process webauthn request: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
 	}
-	return words[1]
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// fakeIdentityProvider signs in the user for the code "code".
+type fakeIdentityProvider struct {
+	user SingleSignOnUser
+}
+
+func (p fakeIdentityProvider) GetAuthorizationURL(options AuthorizationOptions) (string, error) {
+	return "https://provider.example.com/authorize?state=" + url.QueryEscape(options.State), nil
+}
+
+func (p fakeIdentityProvider) GetIdentityToken(code string) (string, error) {
+	if code != "code" {
+		return "", ErrAuthorizationFailed{Provider: "fake", Code: SignInAuthorizationExpired, Reason: "invalid_grant"}
+	}
+	return "identity-token", nil
+}
+
+func (p fakeIdentityProvider) GetSingleSignOnUser(identityToken string) (SingleSignOnUser, error) {
+	return p.user, nil
+}
+
+func newTestSingleSignOnHandler(signUpEnabled bool) SingleSignOnHandler {
+	repository := newMemoryRepository()
+	identityProvider := fakeIdentityProvider{user: SingleSignOnUser{Subject: "1", Email: "alice@example.com"}}
+	singleSignOn := newTestSingleSignOnFactory(repository).NewSingleSignOn("fake", identityProvider, signUpEnabled)
+	return NewSingleSignOnHandler(singleSignOn, "https://example.com/")
+}
+
+// startTestSignIn starts a sign-in returning to rd and returns the state
+// sent to the provider and the state cookie.
+func startTestSignIn(t *testing.T, handler SingleSignOnHandler, rd string) (string, *http.Cookie) {
+	w := httptest.NewRecorder()
+	handler.SignIn(w, httptest.NewRequest(http.MethodGet, "https://api.example.com/sign-in?rd="+url.QueryEscape(rd), nil))
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "sign_in_state" {
+			if !cookie.HttpOnly {
+				t.Error("expected the state cookie to be HttpOnly")
+			}
+			return location.Query().Get("state"), cookie
+		}
+	}
+	t.Fatal("expected a state cookie")
+	return "", nil
+}
+
+func TestSingleSignOnHandlerChecksState(t *testing.T) {
+	handler := newTestSingleSignOnHandler(true)
+	state, cookie := startTestSignIn(t, handler, "/settings")
+	if len(state) < 32 {
+		t.Fatalf("expected a random state, got %q", state)
+	}
+
+	tests := map[string]struct {
+		state    string
+		cookie   *http.Cookie
+		location string
+	}{
+		"matching state": {state, cookie, "https://example.com/settings"},
+		"other state":    {"other", cookie, "https://example.com/?sign_in_error=browser_mismatch"},
+		"no cookie":      {state, nil, "https://example.com/?sign_in_error=browser_mismatch"},
+		"no state":       {"", cookie, "https://example.com/?sign_in_error=browser_mismatch"},
+	}
+	for name, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "https://api.example.com/callback?code=code&state="+url.QueryEscape(test.state), nil)
+		if test.cookie != nil {
+			r.AddCookie(test.cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.Callback(w, r)
+
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("%s: expected a redirect to %s, got %s", name, test.location, location)
+		}
+	}
+}
+
+func TestSingleSignOnHandlerReturnsToHomepage(t *testing.T) {
+	handler := newTestSingleSignOnHandler(true)
+	state, cookie := startTestSignIn(t, handler, "")
+
+	r := httptest.NewRequest(http.MethodGet, "https://api.example.com/callback?code=code&state="+url.QueryEscape(state), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handler.Callback(w, r)
+
+	if location := w.Header().Get("Location"); location != "https://example.com/" {
+		t.Errorf("expected a redirect to the homepage, got %s", location)
+	}
+}
+
+func TestSingleSignOnHandlerRedirectsRejectedSignUps(t *testing.T) {
+	handler := newTestSingleSignOnHandler(false)
+	state, cookie := startTestSignIn(t, handler, "")
+
+	r := httptest.NewRequest(http.MethodGet, "https://api.example.com/callback?code=code&state="+url.QueryEscape(state), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handler.Callback(w, r)
+
+	if location := w.Header().Get("Location"); location != "https://example.com/?sign_in_error=signup_disabled" {
+		t.Errorf("expected a redirect with the signup_disabled error, got %d %s", w.Code, location)
+	}
+}
@@ -2,31 +2,126 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
 func Start() {
 	config := struct {
-		APIPort              int    `env:"API_PORT" default:"8080"`
-		DBHost               string `env:"DB_HOST" default:"sso-database"`
-		DBPort               int    `env:"DB_PORT" default:"5432"`
-		DBUser               string `env:"DB_USER" default:"sso"`
-		DBPassword           string `env:"DB_PASSWORD" default:"sso"`
-		DBName               string `env:"DB_NAME" default:"sso"`
-		JWTSecret            string `env:"JWT_SECRET"`
-		AuthTokenLifetime    string `env:"AUTH_TOKEN_LIFETIME" default:"604800s"` // 1 week
-		GoogleClientID       string `env:"GOOGLE_CLIENT_ID" default:""`
-		GoogleClientSecret   string `env:"GOOGLE_CLIENT_SECRET" default:""`
-		GoogleRedirectURI    string `env:"GOOGLE_REDIRECT_URI" default:"https://localhost/api/v1/single-sign-on/google/callback"`
-		FacebookClientID     string `env:"FACEBOOK_CLIENT_ID" default:""`
-		FacebookClientSecret string `env:"FACEBOOK_CLIENT_SECRET" default:""`
-		FacebookRedirectURI  string `env:"FACEBOOK_REDIRECT_URI" default:"https://localhost/api/v1/single-sign-on/facebook/callback"`
-		GithubClientID       string `env:"GITHUB_CLIENT_ID" default:""`
-		GithubClientSecret   string `env:"GITHUB_CLIENT_SECRET" default:""`
-		GithubRedirectURI    string `env:"GITHUB_REDIRECT_URI" default:"https://localhost/api/v1/single-sign-on/github/callback"`
-		HomepageURL          string `env:"HOMEPAGE_URL" default:"https://localhost"`
+		APIPort                      int      `env:"API_PORT" default:"8080"`
+		DBHost                       string   `env:"DB_HOST" default:"sso-database"`
+		DBPort                       int      `env:"DB_PORT" default:"5432"`
+		DBUser                       string   `env:"DB_USER" default:"sso"`
+		DBPassword                   string   `env:"DB_PASSWORD" default:"sso"`
+		DBName                       string   `env:"DB_NAME" default:"sso"`
+		JWTSecret                    string   `env:"JWT_SECRET"`
+		AuthTokenLifetime            string   `env:"AUTH_TOKEN_LIFETIME" default:"604800s"` // 1 week
+		SignUpAllowedDomains         []string `env:"SIGNUP_ALLOWED_DOMAINS" default:""`
+		SignUpAllowedEmails          []string `env:"SIGNUP_ALLOWED_EMAILS" default:""`
+		SignUpDeniedEmails           []string `env:"SIGNUP_DENIED_EMAILS" default:""`
+		SignUpInviteOnly             bool     `env:"SIGNUP_INVITE_ONLY" default:"false"`
+		InvitationLifetime           int      `env:"INVITATION_LIFETIME_HOURS" default:"168"` // 1 week
+		StepUpMaxAge                 int      `env:"STEP_UP_MAX_AGE_MINUTES" default:"5"`
+		AdminEmails                  []string `env:"ADMIN_EMAILS" default:""`
+		DefaultRole                  string   `env:"DEFAULT_ROLE" default:"member"`
+		GoogleClientID               string   `env:"GOOGLE_CLIENT_ID" default:""`
+		GoogleClientSecret           string   `env:"GOOGLE_CLIENT_SECRET" default:""`
+		GoogleRedirectURI            string   `env:"GOOGLE_REDIRECT_URI" default:""`
+		GoogleSignUpEnabled          bool     `env:"GOOGLE_SIGNUP_ENABLED" default:"true"`
+		GoogleHostedDomains          []string `env:"GOOGLE_HOSTED_DOMAINS" default:""`
+		FacebookClientID             string   `env:"FACEBOOK_CLIENT_ID" default:""`
+		FacebookClientSecret         string   `env:"FACEBOOK_CLIENT_SECRET" default:""`
+		FacebookRedirectURI          string   `env:"FACEBOOK_REDIRECT_URI" default:""`
+		FacebookSignUpEnabled        bool     `env:"FACEBOOK_SIGNUP_ENABLED" default:"true"`
+		GithubClientID               string   `env:"GITHUB_CLIENT_ID" default:""`
+		GithubClientSecret           string   `env:"GITHUB_CLIENT_SECRET" default:""`
+		GithubRedirectURI            string   `env:"GITHUB_REDIRECT_URI" default:""`
+		GithubSignUpEnabled          bool     `env:"GITHUB_SIGNUP_ENABLED" default:"true"`
+		GithubBaseURL                string   `env:"GITHUB_BASE_URL" default:""`
+		GithubAllowedOrganizations   []string `env:"GITHUB_ALLOWED_ORGANIZATIONS" default:""`
+		GithubAllowedTeams           []string `env:"GITHUB_ALLOWED_TEAMS" default:""`
+		GitlabClientID               string   `env:"GITLAB_CLIENT_ID" default:""`
+		GitlabClientSecret           string   `env:"GITLAB_CLIENT_SECRET" default:""`
+		GitlabRedirectURI            string   `env:"GITLAB_REDIRECT_URI" default:""`
+		GitlabBaseURL                string   `env:"GITLAB_BASE_URL" default:"https://gitlab.com"`
+		GitlabSignUpEnabled          bool     `env:"GITLAB_SIGNUP_ENABLED" default:"true"`
+		LinkedinClientID             string   `env:"LINKEDIN_CLIENT_ID" default:""`
+		LinkedinClientSecret         string   `env:"LINKEDIN_CLIENT_SECRET" default:""`
+		LinkedinRedirectURI          string   `env:"LINKEDIN_REDIRECT_URI" default:""`
+		LinkedinSignUpEnabled        bool     `env:"LINKEDIN_SIGNUP_ENABLED" default:"true"`
+		BitbucketClientID            string   `env:"BITBUCKET_CLIENT_ID" default:""`
+		BitbucketClientSecret        string   `env:"BITBUCKET_CLIENT_SECRET" default:""`
+		BitbucketRedirectURI         string   `env:"BITBUCKET_REDIRECT_URI" default:""`
+		BitbucketSignUpEnabled       bool     `env:"BITBUCKET_SIGNUP_ENABLED" default:"true"`
+		SlackClientID                string   `env:"SLACK_CLIENT_ID" default:""`
+		SlackClientSecret            string   `env:"SLACK_CLIENT_SECRET" default:""`
+		SlackRedirectURI             string   `env:"SLACK_REDIRECT_URI" default:""`
+		SlackSignUpEnabled           bool     `env:"SLACK_SIGNUP_ENABLED" default:"true"`
+		DiscordClientID              string   `env:"DISCORD_CLIENT_ID" default:""`
+		DiscordClientSecret          string   `env:"DISCORD_CLIENT_SECRET" default:""`
+		DiscordRedirectURI           string   `env:"DISCORD_REDIRECT_URI" default:""`
+		DiscordSignUpEnabled         bool     `env:"DISCORD_SIGNUP_ENABLED" default:"true"`
+		LDAPURL                      string   `env:"LDAP_URL" default:""`
+		LDAPStartTLS                 bool     `env:"LDAP_START_TLS" default:"false"`
+		LDAPBindDN                   string   `env:"LDAP_BIND_DN" default:""`
+		LDAPBindPassword             string   `env:"LDAP_BIND_PASSWORD" default:""`
+		LDAPBaseDN                   string   `env:"LDAP_BASE_DN" default:""`
+		LDAPUserFilter               string   `env:"LDAP_USER_FILTER" default:"(uid={username})"`
+		LDAPEmailAttribute           string   `env:"LDAP_EMAIL_ATTRIBUTE" default:"mail"`
+		LDAPNameAttribute            string   `env:"LDAP_NAME_ATTRIBUTE" default:"displayName"`
+		LDAPGroupsAttribute          string   `env:"LDAP_GROUPS_ATTRIBUTE" default:"memberOf"`
+		LDAPSubjectAttribute         string   `env:"LDAP_SUBJECT_ATTRIBUTE" default:""`
+		LDAPSignUpEnabled            bool     `env:"LDAP_SIGNUP_ENABLED" default:"true"`
+		PasswordEnabled              bool     `env:"PASSWORD_ENABLED" default:"false"`
+		PasswordSignUpEnabled        bool     `env:"PASSWORD_SIGNUP_ENABLED" default:"true"`
+		PasswordMinLength            int      `env:"PASSWORD_MIN_LENGTH" default:"10"`
+		PasswordMaxLength            int      `env:"PASSWORD_MAX_LENGTH" default:"128"`
+		PasswordMinCharacterClasses  int      `env:"PASSWORD_MIN_CHARACTER_CLASSES" default:"2"`
+		PasswordArgon2Time           int      `env:"PASSWORD_ARGON2_TIME" default:"1"`
+		PasswordArgon2Memory         int      `env:"PASSWORD_ARGON2_MEMORY" default:"65536"` // 64 MiB
+		PasswordArgon2Threads        int      `env:"PASSWORD_ARGON2_THREADS" default:"4"`
+		PasswordRequireVerifiedEmail bool     `env:"PASSWORD_REQUIRE_VERIFIED_EMAIL" default:"false"`
+		EmailVerificationLifetime    int      `env:"EMAIL_VERIFICATION_LIFETIME_HOURS" default:"24"`
+		PasswordResetLifetime        int      `env:"PASSWORD_RESET_LIFETIME_MINUTES" default:"60"`
+		Mailer                       string   `env:"MAILER" default:"log"`
+		MailFrom                     string   `env:"MAIL_FROM" default:"no-reply@localhost"`
+		MailDirectory                string   `env:"MAIL_DIRECTORY" default:"."`
+		MailTemplateDirectory        string   `env:"MAIL_TEMPLATE_DIRECTORY" default:""`
+		SMTPHost                     string   `env:"SMTP_HOST" default:""`
+		SMTPPort                     int      `env:"SMTP_PORT" default:"587"`
+		SMTPUsername                 string   `env:"SMTP_USERNAME" default:""`
+		SMTPPassword                 string   `env:"SMTP_PASSWORD" default:""`
+		MagicLinkEnabled             bool     `env:"MAGIC_LINK_ENABLED" default:"false"`
+		MagicLinkSignUpEnabled       bool     `env:"MAGIC_LINK_SIGNUP_ENABLED" default:"true"`
+		MagicLinkSameBrowser         bool     `env:"MAGIC_LINK_SAME_BROWSER" default:"true"`
+		MagicLinkLifetime            int      `env:"MAGIC_LINK_LIFETIME_MINUTES" default:"15"`
+		MagicLinkRateLimit           int      `env:"MAGIC_LINK_RATE_LIMIT" default:"3"`
+		MagicLinkRateLimitWindow     int      `env:"MAGIC_LINK_RATE_LIMIT_WINDOW_MINUTES" default:"15"`
+		WebAuthnEnabled              bool     `env:"WEBAUTHN_ENABLED" default:"false"`
+		WebAuthnRPID                 string   `env:"WEBAUTHN_RP_ID"`
+		WebAuthnRPName               string   `env:"WEBAUTHN_RP_NAME" default:"Single Sign-On"`
+		WebAuthnOrigin               string   `env:"WEBAUTHN_ORIGIN"`
+		WebAuthnAttestation          string   `env:"WEBAUTHN_ATTESTATION" default:"none"`
+		MFAIssuer                    string   `env:"MFA_ISSUER" default:"Single Sign-On"`
+		MicrosoftClientID            string   `env:"MICROSOFT_CLIENT_ID" default:""`
+		MicrosoftClientSecret        string   `env:"MICROSOFT_CLIENT_SECRET" default:""`
+		MicrosoftRedirectURI         string   `env:"MICROSOFT_REDIRECT_URI" default:""`
+		MicrosoftTenant              string   `env:"MICROSOFT_TENANT" default:"common"`
+		MicrosoftAllowedTenants      []string `env:"MICROSOFT_ALLOWED_TENANTS" default:""`
+		MicrosoftSignUpEnabled       bool     `env:"MICROSOFT_SIGNUP_ENABLED" default:"true"`
+		AppleClientID                string   `env:"APPLE_CLIENT_ID" default:""`
+		AppleTeamID                  string   `env:"APPLE_TEAM_ID" default:""`
+		AppleKeyID                   string   `env:"APPLE_KEY_ID" default:""`
+		ApplePrivateKeyFile          string   `env:"APPLE_PRIVATE_KEY_FILE" default:""`
+		AppleRedirectURI             string   `env:"APPLE_REDIRECT_URI" default:""`
+		AppleSignUpEnabled           bool     `env:"APPLE_SIGNUP_ENABLED" default:"true"`
+		ProviderSecretKey            string   `env:"PROVIDER_SECRET_KEY" default:""`
+		APIURL                       string   `env:"API_URL" default:"https://localhost"`
+		HomepageURL                  string   `env:"HOMEPAGE_URL" default:"https://localhost"`
 	}{}
 	err := NewEnv().Load(&config)
 	if err != nil {
@@ -51,37 +146,318 @@ func Start() {
 
 	repository := NewSqlRepository(db)
 	tokenizer := NewJWT([]byte(config.JWTSecret))
-	authenticator := NewAuthenticator(tokenizer, time.Duration(7*24*time.Hour))
-	singleSignOnFactory := NewSingleSignOnFactory(authenticator, repository)
-	googleSingleSignOn := singleSignOnFactory.NewSingleSignOn(
-		NewGoogleIdentityProvider(
-			config.GoogleClientID,
-			config.GoogleClientSecret,
-			config.GoogleRedirectURI,
-		),
+	authenticator := NewAuthenticator(tokenizer, time.Duration(7*24*time.Hour), repository, repository)
+	roleManager := NewRoleManager(repository, config.DefaultRole, config.AdminEmails)
+	if err := roleManager.BootstrapAdmins(repository); err != nil {
+		log.Fatal(err)
+	}
+	signUpPolicy := NewSignUpPolicy(
+		config.SignUpAllowedDomains,
+		config.SignUpAllowedEmails,
+		config.SignUpDeniedEmails,
+		config.SignUpInviteOnly,
 	)
-	facebookSingleSignOn := singleSignOnFactory.NewSingleSignOn(
-		NewFacebookIdentityProvider(
-			config.FacebookClientID,
-			config.FacebookClientSecret,
-			config.FacebookRedirectURI,
-		),
+	invitationManager := NewInvitationManager(repository, time.Duration(config.InvitationLifetime)*time.Hour)
+	organizationManager := NewOrganizationManager(repository, invitationManager)
+	singleSignOnFactory := NewSingleSignOnFactory(
+		authenticator,
+		repository,
+		invitationManager,
+		roleManager,
+		organizationManager,
+		signUpPolicy,
 	)
-	githubSingleSignOn := singleSignOnFactory.NewSingleSignOn(
-		NewGithubIdentityProvider(
-			config.GithubClientID,
-			config.GithubClientSecret,
-			config.GithubRedirectURI,
-		),
+	secretBox, err := NewSecretBox(config.ProviderSecretKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	identityProviderManager := NewIdentityProviderManager(
+		repository,
+		organizationManager,
+		secretBox,
+		reservedProviderNames,
 	)
+	providerRegistry := NewProviderRegistry(identityProviderManager, singleSignOnFactory, NewSAMLStore(), config.APIURL)
+
+	applePrivateKey := ""
+	if len(config.AppleClientID) > 0 {
+		buf, err := ioutil.ReadFile(config.ApplePrivateKeyFile)
+		if err != nil {
+			log.Fatalf("failed to read apple private key: %v", err)
+		}
+		applePrivateKey = string(buf)
+	}
+
+	providerDefinitions := []ProviderDefinition{
+		{
+			Name:        "apple",
+			DisplayName: "Apple",
+			Icon:        "/icons/apple.png",
+			Config: IdentityProviderConfig{
+				Type:         "apple",
+				ClientID:     config.AppleClientID,
+				ClientSecret: applePrivateKey,
+				Options: map[string]string{
+					"team_id": config.AppleTeamID,
+					"key_id":  config.AppleKeyID,
+				},
+			},
+			RedirectURI:   config.AppleRedirectURI,
+			SignUpEnabled: config.AppleSignUpEnabled,
+		},
+		{
+			Name:        "facebook",
+			DisplayName: "Facebook",
+			Icon:        "/icons/facebook.png",
+			Config: IdentityProviderConfig{
+				Type:         "facebook",
+				ClientID:     config.FacebookClientID,
+				ClientSecret: config.FacebookClientSecret,
+			},
+			RedirectURI:   config.FacebookRedirectURI,
+			SignUpEnabled: config.FacebookSignUpEnabled,
+		},
+		{
+			Name:        "github",
+			DisplayName: "GitHub",
+			Icon:        "/icons/github.png",
+			Config: IdentityProviderConfig{
+				Type:         "github",
+				ClientID:     config.GithubClientID,
+				ClientSecret: config.GithubClientSecret,
+				Options: map[string]string{
+					"base_url":              config.GithubBaseURL,
+					"allowed_organizations": strings.Join(config.GithubAllowedOrganizations, ","),
+					"allowed_teams":         strings.Join(config.GithubAllowedTeams, ","),
+				},
+			},
+			RedirectURI:   config.GithubRedirectURI,
+			SignUpEnabled: config.GithubSignUpEnabled,
+		},
+		{
+			Name:        "gitlab",
+			DisplayName: "GitLab",
+			Icon:        "/icons/gitlab.png",
+			Config: IdentityProviderConfig{
+				Type:         "gitlab",
+				ClientID:     config.GitlabClientID,
+				ClientSecret: config.GitlabClientSecret,
+				Options: map[string]string{
+					"base_url": config.GitlabBaseURL,
+				},
+			},
+			RedirectURI:   config.GitlabRedirectURI,
+			SignUpEnabled: config.GitlabSignUpEnabled,
+		},
+		{
+			Name:        "google",
+			DisplayName: "Google",
+			Icon:        "/icons/google.png",
+			Config: IdentityProviderConfig{
+				Type:         "google",
+				ClientID:     config.GoogleClientID,
+				ClientSecret: config.GoogleClientSecret,
+				Options: map[string]string{
+					"hosted_domains": strings.Join(config.GoogleHostedDomains, ","),
+				},
+			},
+			RedirectURI:   config.GoogleRedirectURI,
+			SignUpEnabled: config.GoogleSignUpEnabled,
+		},
+		{
+			Name:        "microsoft",
+			DisplayName: "Microsoft",
+			Icon:        "/icons/microsoft.png",
+			Config: IdentityProviderConfig{
+				Type:         "microsoft",
+				ClientID:     config.MicrosoftClientID,
+				ClientSecret: config.MicrosoftClientSecret,
+				Options: map[string]string{
+					"tenant":          config.MicrosoftTenant,
+					"allowed_tenants": strings.Join(config.MicrosoftAllowedTenants, ","),
+				},
+			},
+			RedirectURI:   config.MicrosoftRedirectURI,
+			SignUpEnabled: config.MicrosoftSignUpEnabled,
+		},
+		{
+			Name:        "bitbucket",
+			DisplayName: "Bitbucket",
+			Icon:        "/icons/bitbucket.png",
+			Config: IdentityProviderConfig{
+				Type:         "bitbucket",
+				ClientID:     config.BitbucketClientID,
+				ClientSecret: config.BitbucketClientSecret,
+			},
+			RedirectURI:   config.BitbucketRedirectURI,
+			SignUpEnabled: config.BitbucketSignUpEnabled,
+		},
+		{
+			Name:        "discord",
+			DisplayName: "Discord",
+			Icon:        "/icons/discord.png",
+			Config: IdentityProviderConfig{
+				Type:         "discord",
+				ClientID:     config.DiscordClientID,
+				ClientSecret: config.DiscordClientSecret,
+			},
+			RedirectURI:   config.DiscordRedirectURI,
+			SignUpEnabled: config.DiscordSignUpEnabled,
+		},
+		{
+			Name:        "linkedin",
+			DisplayName: "LinkedIn",
+			Icon:        "/icons/linkedin.png",
+			Config: IdentityProviderConfig{
+				Type:         "linkedin",
+				ClientID:     config.LinkedinClientID,
+				ClientSecret: config.LinkedinClientSecret,
+			},
+			RedirectURI:   config.LinkedinRedirectURI,
+			SignUpEnabled: config.LinkedinSignUpEnabled,
+		},
+		{
+			Name:        "slack",
+			DisplayName: "Slack",
+			Icon:        "/icons/slack.png",
+			Config: IdentityProviderConfig{
+				Type:         "slack",
+				ClientID:     config.SlackClientID,
+				ClientSecret: config.SlackClientSecret,
+			},
+			RedirectURI:   config.SlackRedirectURI,
+			SignUpEnabled: config.SlackSignUpEnabled,
+		},
+	}
+	for _, definition := range providerDefinitions {
+		ok, err := providerRegistry.Register(definition)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !ok {
+			log.Printf("identity provider %s is disabled: no client id configured", definition.Name)
+		}
+	}
+
+	userManager := NewUserManager(repository)
+	ldapAuthenticator := NewLDAPAuthenticator(
+		LDAPConfig{
+			URL:              config.LDAPURL,
+			StartTLS:         config.LDAPStartTLS,
+			BindDN:           config.LDAPBindDN,
+			BindPassword:     config.LDAPBindPassword,
+			BaseDN:           config.LDAPBaseDN,
+			UserFilter:       config.LDAPUserFilter,
+			EmailAttribute:   config.LDAPEmailAttribute,
+			NameAttribute:    config.LDAPNameAttribute,
+			GroupsAttribute:  config.LDAPGroupsAttribute,
+			SubjectAttribute: config.LDAPSubjectAttribute,
+		},
+		DialLDAP,
+		singleSignOnFactory.NewSingleSignOn("ldap", nil, config.LDAPSignUpEnabled),
+	)
+
+	passwordAuthenticator, err := NewPasswordAuthenticator(
+		config.PasswordEnabled,
+		config.PasswordRequireVerifiedEmail,
+		repository,
+		NewPasswordHasher(Argon2Params{
+			Time:    uint32(config.PasswordArgon2Time),
+			Memory:  uint32(config.PasswordArgon2Memory),
+			Threads: uint8(config.PasswordArgon2Threads),
+		}),
+		NewPasswordPolicy(config.PasswordMinLength, config.PasswordMaxLength, config.PasswordMinCharacterClasses),
+		singleSignOnFactory.NewUnverifiedSingleSignOn("password", config.PasswordSignUpEnabled),
+	)
+	if err != nil {
+		log.Fatalf("failed to create password authenticator: %v", err)
+	}
+
+	var mailer Mailer = NewLogMailer()
+	switch config.Mailer {
+	case "smtp":
+		mailer = NewSMTPMailer(config.SMTPHost, config.SMTPPort, config.SMTPUsername, config.SMTPPassword, config.MailFrom)
+	case "file":
+		mailer = NewFileMailer(config.MailDirectory, config.MailFrom)
+	case "log":
+	default:
+		log.Fatalf("unknown mailer: %s", config.Mailer)
+	}
+	mailTemplates, err := NewMailTemplates(config.MailTemplateDirectory)
+	if err != nil {
+		log.Fatal(err)
+	}
+	accountManager := NewAccountManager(
+		repository,
+		authenticator,
+		roleManager,
+		passwordAuthenticator,
+		NewAccountTokens([]byte(config.JWTSecret)),
+		mailer,
+		mailTemplates,
+		config.HomepageURL,
+		time.Duration(config.EmailVerificationLifetime)*time.Hour,
+		time.Duration(config.PasswordResetLifetime)*time.Minute,
+	)
+
+	magicLinkAuthenticator := NewMagicLinkAuthenticator(
+		config.MagicLinkEnabled,
+		config.MagicLinkSameBrowser,
+		repository,
+		singleSignOnFactory.NewSingleSignOn("magic_link", nil, config.MagicLinkSignUpEnabled),
+		mailer,
+		mailTemplates,
+		config.APIURL+"/api/v1/sign-in/magic-link/callback",
+		time.Duration(config.MagicLinkLifetime)*time.Minute,
+		config.MagicLinkRateLimit,
+		time.Duration(config.MagicLinkRateLimitWindow)*time.Minute,
+	)
+
+	// Passkeys are scoped to the host of the web app unless configured
+	// otherwise, e.g. to a parent domain.
+	homepageURL, err := url.Parse(config.HomepageURL)
+	if err != nil {
+		log.Fatalf("invalid homepage url: %v", err)
+	}
+	webAuthnRPID := config.WebAuthnRPID
+	if len(webAuthnRPID) < 1 {
+		webAuthnRPID = homepageURL.Hostname()
+	}
+	webAuthnOrigin := config.WebAuthnOrigin
+	if len(webAuthnOrigin) < 1 {
+		webAuthnOrigin = fmt.Sprintf("%s://%s", homepageURL.Scheme, homepageURL.Host)
+	}
+	webAuthn, err := NewWebAuthn(
+		config.WebAuthnEnabled,
+		webAuthnRPID,
+		config.WebAuthnRPName,
+		webAuthnOrigin,
+		config.WebAuthnAttestation,
+		repository,
+		authenticator,
+	)
+	if err != nil {
+		log.Fatalf("failed to create webauthn: %v", err)
+	}
 
 	router := NewRouter(
 		config.HomepageURL,
 		NewStatusHandler(),
-		NewUserHandler(authenticator, NewUserManager(repository)),
-		googleSingleSignOn,
-		facebookSingleSignOn,
-		githubSingleSignOn,
+		NewUserHandler(authenticator, userManager),
+		NewAdminHandler(userManager, invitationManager, roleManager),
+		NewOrganizationHandler(
+			authenticator,
+			organizationManager,
+			invitationManager,
+			userManager,
+			NewIdentityProviderHandler(identityProviderManager, providerRegistry),
+		),
+		NewAuthorizer(authenticator, roleManager, userManager, time.Duration(config.StepUpMaxAge)*time.Minute),
+		providerRegistry,
+		NewSignInHandler(config.HomepageURL, ldapAuthenticator, passwordAuthenticator, accountManager, magicLinkAuthenticator),
+		NewAccountHandler(authenticator, userManager, passwordAuthenticator, accountManager),
+		NewMFAHandler(authenticator, userManager, NewMFAManager(repository, authenticator, secretBox, config.MFAIssuer)),
+		NewWebAuthnHandler(authenticator, userManager, webAuthn),
 	)
 
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.APIPort), router))
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	appleIssuer = "https://appleid.apple.com"
+	// applePrivateRelayDomain is the domain of the addresses Apple relays
+	// mail through when users choose to hide their email.
+	applePrivateRelayDomain = "privaterelay.appleid.com"
+)
+
+var _ IdentityProvider = (*AppleIdentityProvider)(nil)
+var _ CallbackUserIdentityProvider = (*AppleIdentityProvider)(nil)
+
+// AppleIdentityProvider signs in with Apple. Instead of a fixed client
+// secret, Apple expects a JWT signed with the private key (.p8) of the team.
+type AppleIdentityProvider struct {
+	clientID    string
+	teamID      string
+	keyID       string
+	privateKey  string
+	redirectURI string
+	scopes      []string
+	keySet      *OIDCKeySet
+}
+
+func NewAppleIdentityProvider(
+	clientID string,
+	teamID string,
+	keyID string,
+	privateKey string,
+	redirectURI string,
+) AppleIdentityProvider {
+	return AppleIdentityProvider{
+		clientID:    clientID,
+		teamID:      teamID,
+		keyID:       keyID,
+		privateKey:  privateKey,
+		redirectURI: redirectURI,
+		scopes:      []string{"name", "email"},
+		keySet:      NewOIDCKeySet("https://appleid.apple.com/auth/keys"),
+	}
+}
+
+// GetAuthorizationURL requests a form_post response, which Apple requires
+// when asking for the name or email of the user. Apple supports none of the
+// options.
+func (a AppleIdentityProvider) GetAuthorizationURL(options AuthorizationOptions) (string, error) {
+	u, err := url.Parse("https://appleid.apple.com/auth/authorize")
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Add("client_id", a.clientID)
+	q.Add("redirect_uri", a.redirectURI)
+	q.Add("response_type", "code")
+	q.Add("response_mode", "form_post")
+	q.Add("scope", strings.Join(a.scopes, " "))
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+func (a AppleIdentityProvider) GetIdentityToken(code string) (string, error) {
+	u, err := url.Parse("https://appleid.apple.com/auth/token")
+	if err != nil {
+		return "", err
+	}
+
+	clientSecret, err := a.clientSecret()
+	if err != nil {
+		return "", err
+	}
+
+	body := url.Values{}
+	body.Add("client_id", a.clientID)
+	body.Add("client_secret", clientSecret)
+	body.Add("code", code)
+	body.Add("grant_type", "authorization_code")
+	body.Add("redirect_uri", a.redirectURI)
+
+	headers := map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	}
+
+	res := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := DefaultHttpClient.HttpRequestJson(http.MethodPost, u.String(), headers, body.Encode(), &res); err != nil {
+		return "", err
+	}
+
+	if len(res.IDToken) < 1 {
+		return "", errors.New("no id token received")
+	}
+
+	return res.IDToken, nil
+}
+
+// GetSingleSignOnUser validates the ID token. It never contains the name of
+// the user, which is only sent along with the first callback.
+func (a AppleIdentityProvider) GetSingleSignOnUser(identityToken string) (SingleSignOnUser, error) {
+	claims, err := a.keySet.VerifyIDToken(identityToken, a.clientID)
+	if err != nil {
+		return SingleSignOnUser{}, err
+	}
+
+	if !claims.VerifyIssuer(appleIssuer, true) {
+		return SingleSignOnUser{}, errors.New("id token has an invalid issuer")
+	}
+
+	subject, _ := claims["sub"].(string)
+	if len(subject) < 1 {
+		return SingleSignOnUser{}, errors.New("id token is missing sub")
+	}
+
+	email, _ := claims["email"].(string)
+	if len(email) > 0 && !appleClaimTrue(claims["email_verified"]) {
+		return SingleSignOnUser{}, errors.New("email is not verified")
+	}
+
+	// Private relay addresses are stable for the app, but unrelated to the
+	// real email of the user, so they are kept as they are and the user is
+	// matched by its subject.
+	if appleClaimTrue(claims["is_private_email"]) && emailDomain(email) != applePrivateRelayDomain {
+		return SingleSignOnUser{}, fmt.Errorf("unexpected private email: %s", email)
+	}
+
+	return SingleSignOnUser{
+		Subject: subject,
+		Email:   strings.ToLower(email),
+	}, nil
+}
+
+// GetCallbackUser reads the user details Apple posts along with the callback
+// on the first sign-in of the user.
+func (a AppleIdentityProvider) GetCallbackUser(callback url.Values) (SingleSignOnUser, error) {
+	if len(callback.Get("user")) < 1 {
+		return SingleSignOnUser{}, nil
+	}
+
+	user := struct {
+		Name struct {
+			FirstName string `json:"firstName"`
+			LastName  string `json:"lastName"`
+		} `json:"name"`
+	}{}
+	if err := json.Unmarshal([]byte(callback.Get("user")), &user); err != nil {
+		return SingleSignOnUser{}, fmt.Errorf("invalid user: %v", err)
+	}
+
+	return SingleSignOnUser{
+		Name: strings.TrimSpace(user.Name.FirstName + " " + user.Name.LastName),
+	}, nil
+}
+
+// clientSecret signs a short-lived client secret with the private key.
+func (a AppleIdentityProvider) clientSecret() (string, error) {
+	privateKey, err := parseApplePrivateKey(a.privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.StandardClaims{
+		Issuer:    a.teamID,
+		Subject:   a.clientID,
+		Audience:  appleIssuer,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(5 * time.Minute).Unix(),
+	})
+	token.Header["kid"] = a.keyID
+
+	return token.SignedString(privateKey)
+}
+
+// parseApplePrivateKey parses the PKCS #8 encoded key of a .p8 file.
+func parseApplePrivateKey(privateKey string) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return nil, errors.New("apple private key must be PEM encoded")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid apple private key: %v", err)
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("apple private key must be an EC key")
+	}
+
+	return ecdsaKey, nil
+}
+
+// appleClaimTrue reads a boolean claim, which Apple sends either as a
+// boolean or as a string.
+func appleClaimTrue(claim interface{}) bool {
+	switch value := claim.(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	default:
+		return false
+	}
+}
@@ -2,49 +2,205 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"time"
 )
 
 type Authenticator struct {
-	tokenizer     Tokenizer
-	tokenLifetime time.Duration
+	tokenizer      Tokenizer
+	tokenLifetime  time.Duration
+	roleRepository RoleRepository
+	repository     Repository
 }
 
 func NewAuthenticator(
 	tokenizer Tokenizer,
 	tokenLifetime time.Duration,
+	roleRepository RoleRepository,
+	repository Repository,
 ) Authenticator {
 	return Authenticator{
-		tokenizer:     tokenizer,
-		tokenLifetime: tokenLifetime,
+		tokenizer:      tokenizer,
+		tokenLifetime:  tokenLifetime,
+		roleRepository: roleRepository,
+		repository:     repository,
 	}
 }
 
-func (a Authenticator) CreateToken(userID int) (string, error) {
+// mfaPendingLifetime is how long a user has to enter the second factor after
+// signing in with the first.
+const mfaPendingLifetime = 5 * time.Minute
+
+// ErrMFARequired is returned instead of a token when the user has to confirm
+// the sign-in with a second factor. Token is the mfa_pending token to do so.
+type ErrMFARequired struct {
+	Token string
+}
+
+func (e ErrMFARequired) Error() string {
+	return "multi-factor authentication required"
+}
+
+// Authentication methods of the amr claim. pwd, otp, hwk, user and mfa are
+// registered by RFC 8176. fed, for sign-ins through an identity provider,
+// and email, for sign-ins with a link mailed to the user, are local values.
+const (
+	AMRPassword    = "pwd"
+	AMROTP         = "otp"
+	AMRHardwareKey = "hwk"
+	AMRUser        = "user"
+	AMRMFA         = "mfa"
+	AMRFederated   = "fed"
+	AMREmail       = "email"
+)
+
+// CreateToken issues a token for a user who just authenticated with the
+// methods of amr, which is recorded as auth_time.
+func (a Authenticator) CreateToken(userID int, groups []string, amr []string) (string, error) {
+	roles, err := a.roleRepository.GetUserRoleNames(userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve roles: %v", err)
+	}
+
+	now := time.Now()
+	payload := NewTokenPayload(userID, now)
+	payload.Groups = groups
+	payload.Roles = roles
+	payload.AuthTime = now
+	payload.AMR = amr
+	return a.tokenizer.Encode(payload)
+}
+
+// CreateMFAPendingToken returns a token that only allows to complete the
+// sign-in with a second factor. It carries the methods of the first one.
+func (a Authenticator) CreateMFAPendingToken(userID int, groups []string, amr []string) (string, error) {
 	payload := NewTokenPayload(userID, time.Now())
+	payload.Groups = groups
+	payload.AMR = amr
+	payload.MFAPending = true
 	return a.tokenizer.Encode(payload)
 }
 
-func (a Authenticator) GetUserID(token string) (int, error) {
+// appendAMR adds the methods that are not in amr yet.
+func appendAMR(amr []string, methods ...string) []string {
+	result := append([]string{}, amr...)
+	for _, method := range methods {
+		if !contains(result, method) {
+			result = append(result, method)
+		}
+	}
+	return result
+}
+
+// GetMFAPendingPayload returns the payload of a token created by
+// CreateMFAPendingToken.
+func (a Authenticator) GetMFAPendingPayload(token string) (TokenPayload, error) {
 	payload, err := a.tokenizer.Decode(token)
+	if err != nil {
+		return TokenPayload{}, err
+	}
+
+	if payload.UserID < 1 || !payload.MFAPending {
+		return TokenPayload{}, errors.New("invalid mfa_pending token")
+	}
+
+	if payload.IssuedAt.Add(mfaPendingLifetime).Before(time.Now()) {
+		return TokenPayload{}, errors.New("token has expired")
+	}
+
+	if err := a.checkNotRevoked(payload); err != nil {
+		return TokenPayload{}, err
+	}
+
+	return payload, nil
+}
+
+// UseMFAPendingToken consumes an mfa_pending token once its sign-in is
+// completed, so it cannot complete another one.
+func (a Authenticator) UseMFAPendingToken(token string, payload TokenPayload) error {
+	return a.repository.UseMFAPendingToken(hashToken(token), payload.IssuedAt.Add(mfaPendingLifetime))
+}
+
+// SwitchOrganization returns a token for the same sign-in as payload, scoped
+// to the given organization.
+func (a Authenticator) SwitchOrganization(
+	payload TokenPayload,
+	organizationID int,
+	organizationRole string,
+) (string, error) {
+	roles, err := a.roleRepository.GetUserRoleNames(payload.UserID)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve roles: %v", err)
+	}
+
+	payload.Roles = roles
+	payload.OrganizationID = organizationID
+	payload.OrganizationRole = organizationRole
+	return a.tokenizer.Encode(payload)
+}
+
+func (a Authenticator) GetUserID(token string) (int, error) {
+	payload, err := a.GetTokenPayload(token)
 	if err != nil {
 		return 0, err
 	}
+	return payload.UserID, nil
+}
+
+func (a Authenticator) GetTokenPayload(token string) (TokenPayload, error) {
+	payload, err := a.tokenizer.Decode(token)
+	if err != nil {
+		return TokenPayload{}, err
+	}
 
 	if payload.UserID < 1 {
-		return 0, errors.New("invalid UserID")
+		return TokenPayload{}, errors.New("invalid UserID")
+	}
+
+	if payload.MFAPending {
+		return TokenPayload{}, errors.New("multi-factor authentication is pending")
 	}
 
 	if payload.IssuedAt.Add(a.tokenLifetime).Before(time.Now()) {
-		return 0, errors.New("token has expired")
+		return TokenPayload{}, errors.New("token has expired")
 	}
 
-	return payload.UserID, nil
+	if err := a.checkNotRevoked(payload); err != nil {
+		return TokenPayload{}, err
+	}
+
+	return payload, nil
+}
+
+// RevokeTokens invalidates the tokens issued to the user so far.
+func (a Authenticator) RevokeTokens(userID int) error {
+	return a.repository.RevokeUserTokens(userID, time.Now())
+}
+
+// checkNotRevoked rejects tokens issued before the tokens of their user were
+// revoked.
+func (a Authenticator) checkNotRevoked(payload TokenPayload) error {
+	validAfter, err := a.repository.GetUserTokensValidAfter(payload.UserID)
+	if err != nil {
+		return err
+	}
+
+	if payload.IssuedAt.Before(validAfter) {
+		return errors.New("token has been revoked")
+	}
+	return nil
 }
 
 type TokenPayload struct {
-	UserID   int
-	IssuedAt time.Time
+	UserID           int
+	IssuedAt         time.Time
+	Groups           []string
+	Roles            []string
+	OrganizationID   int
+	OrganizationRole string
+	MFAPending       bool
+	AuthTime         time.Time
+	AMR              []string
 }
 
 func NewTokenPayload(
@@ -56,3 +212,17 @@ func NewTokenPayload(
 		IssuedAt: issuedAt,
 	}
 }
+
+// ErrInvalidCredentials is returned when a username or password is wrong,
+// without telling which.
+type ErrInvalidCredentials string
+
+func (e ErrInvalidCredentials) Error() string {
+	return string(e)
+}
+
+type ErrMFAPendingTokenUsed string
+
+func (e ErrMFAPendingTokenUsed) Error() string {
+	return string(e)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// cborMaxDepth limits the nesting of decoded CBOR values.
+const cborMaxDepth = 16
+
+// decodeCBOR decodes the first CBOR value of data (RFC 8949) and returns it
+// with the number of bytes it took. It covers what authenticators send in
+// WebAuthn, i.e. definite lengths only. Integers are decoded as int64, byte
+// strings as []byte, text strings as string, arrays as []interface{} and
+// maps as map[interface{}]interface{}.
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	return decodeCBORValue(data, 0)
+}
+
+func decodeCBORValue(data []byte, depth int) (interface{}, int, error) {
+	if depth > cborMaxDepth {
+		return nil, 0, errors.New("cbor value is nested too deeply")
+	}
+	if len(data) < 1 {
+		return nil, 0, errors.New("unexpected end of cbor data")
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+
+	if major == 7 {
+		return decodeCBORSimple(data, info)
+	}
+
+	arg, n, err := decodeCBORArgument(data, info)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, 0, errors.New("cbor integer overflows int64")
+		}
+		return int64(arg), n, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, 0, errors.New("cbor integer overflows int64")
+		}
+		return -1 - int64(arg), n, nil
+	case 2, 3:
+		if arg > uint64(len(data)-n) {
+			return nil, 0, errors.New("unexpected end of cbor data")
+		}
+		end := n + int(arg)
+		if major == 3 {
+			return string(data[n:end]), end, nil
+		}
+		value := make([]byte, arg)
+		copy(value, data[n:end])
+		return value, end, nil
+	case 4:
+		// Each item takes at least one byte.
+		if arg > uint64(len(data)-n) {
+			return nil, 0, errors.New("unexpected end of cbor data")
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			item, m, err := decodeCBORValue(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			n += m
+		}
+		return items, n, nil
+	case 5:
+		if arg > uint64(len(data)-n)/2 {
+			return nil, 0, errors.New("unexpected end of cbor data")
+		}
+		entries := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, m, err := decodeCBORValue(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += m
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, 0, fmt.Errorf("unsupported cbor map key of type %T", key)
+			}
+
+			value, m, err := decodeCBORValue(data[n:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			n += m
+			entries[key] = value
+		}
+		return entries, n, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported cbor major type %d", major)
+	}
+}
+
+func decodeCBORArgument(data []byte, info byte) (uint64, int, error) {
+	switch {
+	case info < 24:
+		return uint64(info), 1, nil
+	case info == 24:
+		if len(data) < 2 {
+			return 0, 0, errors.New("unexpected end of cbor data")
+		}
+		return uint64(data[1]), 2, nil
+	case info == 25:
+		if len(data) < 3 {
+			return 0, 0, errors.New("unexpected end of cbor data")
+		}
+		return uint64(binary.BigEndian.Uint16(data[1:3])), 3, nil
+	case info == 26:
+		if len(data) < 5 {
+			return 0, 0, errors.New("unexpected end of cbor data")
+		}
+		return uint64(binary.BigEndian.Uint32(data[1:5])), 5, nil
+	case info == 27:
+		if len(data) < 9 {
+			return 0, 0, errors.New("unexpected end of cbor data")
+		}
+		return binary.BigEndian.Uint64(data[1:9]), 9, nil
+	default:
+		return 0, 0, errors.New("indefinite length cbor values are not supported")
+	}
+}
+
+func decodeCBORSimple(data []byte, info byte) (interface{}, int, error) {
+	switch info {
+	case 20:
+		return false, 1, nil
+	case 21:
+		return true, 1, nil
+	case 22, 23:
+		return nil, 1, nil
+	case 26:
+		if len(data) < 5 {
+			return nil, 0, errors.New("unexpected end of cbor data")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data[1:5]))), 5, nil
+	case 27:
+		if len(data) < 9 {
+			return nil, 0, errors.New("unexpected end of cbor data")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data[1:9])), 9, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported cbor simple value %d", info)
+	}
+}
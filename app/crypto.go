@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+var ErrNoSecretKey = errors.New("no secret key configured")
+
+// SecretBox encrypts secrets at rest with AES-256-GCM. The nonce is
+// prepended to the ciphertext.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox creates a SecretBox from a base64 encoded 32 byte key. An
+// empty key gives a SecretBox that refuses to encrypt or decrypt.
+func NewSecretBox(encodedKey string) (SecretBox, error) {
+	if len(encodedKey) < 1 {
+		return SecretBox{}, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return SecretBox{}, fmt.Errorf("invalid secret key: %v", err)
+	}
+	if len(key) != 32 {
+		return SecretBox{}, errors.New("secret key must be 32 bytes")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return SecretBox{}, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return SecretBox{}, err
+	}
+
+	return SecretBox{aead: aead}, nil
+}
+
+func (b SecretBox) Seal(plaintext []byte) ([]byte, error) {
+	if b.aead == nil {
+		return nil, ErrNoSecretKey
+	}
+
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return b.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (b SecretBox) Open(ciphertext []byte) ([]byte, error) {
+	if b.aead == nil {
+		return nil, ErrNoSecretKey
+	}
+
+	if len(ciphertext) < b.aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := ciphertext[:b.aead.NonceSize()], ciphertext[b.aead.NonceSize():]
+	return b.aead.Open(nil, nonce, ciphertext, nil)
+}
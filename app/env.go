@@ -6,6 +6,7 @@ import (
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 )
 
 type Env struct{}
@@ -74,6 +75,18 @@ func (e Env) setFieldValue(field reflect.StructField, value reflect.Value, rawVa
 			return err
 		}
 		value.SetBool(boolean)
+	case reflect.Slice:
+		if field.Type.Elem().Kind() != reflect.String {
+			return fmt.Errorf("unexpected slice type: %s", field.Type.Elem().Kind())
+		}
+		strs := []string{}
+		for _, str := range strings.Split(rawValue, ",") {
+			str = strings.TrimSpace(str)
+			if str != "" {
+				strs = append(strs, str)
+			}
+		}
+		value.Set(reflect.ValueOf(strs))
 	default:
 		return fmt.Errorf("unexpected field type: %s", kind)
 	}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const gitlabBaseURL = "https://gitlab.com"
+
+var _ IdentityProvider = (*GitlabIdentityProvider)(nil)
+
+// GitlabIdentityProvider signs in with GitLab.com or a self-hosted GitLab
+// instance. The groups of the user are read from the OpenID Connect userinfo
+// endpoint.
+type GitlabIdentityProvider struct {
+	clientID     string
+	clientSecret string
+	redirectURI  string
+	baseURL      string
+	scopes       []string
+	httpClient   *HttpClient
+}
+
+func NewGitlabIdentityProvider(
+	clientID string,
+	clientSecret string,
+	redirectURI string,
+	baseURL string,
+) GitlabIdentityProvider {
+	if len(baseURL) < 1 {
+		baseURL = gitlabBaseURL
+	}
+
+	return GitlabIdentityProvider{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURI:  redirectURI,
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		scopes:       []string{"read_user", "openid"},
+		httpClient:   DefaultHttpClient,
+	}
+}
+
+// GetAuthorizationURL passes prompt and max_age, which GitLab supports as
+// OpenID Connect provider.
+func (g GitlabIdentityProvider) GetAuthorizationURL(options AuthorizationOptions) (string, error) {
+	u, err := url.Parse(g.baseURL + "/oauth/authorize")
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Add("client_id", g.clientID)
+	q.Add("redirect_uri", g.redirectURI)
+	q.Add("response_type", "code")
+	q.Add("scope", strings.Join(g.scopes, " "))
+	addParams(q, options.openIDConnectParams(), "prompt", "max_age")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+func (g GitlabIdentityProvider) GetIdentityToken(code string) (string, error) {
+	u, err := url.Parse(g.baseURL + "/oauth/token")
+	if err != nil {
+		return "", err
+	}
+
+	body := url.Values{}
+	body.Add("client_id", g.clientID)
+	body.Add("client_secret", g.clientSecret)
+	body.Add("code", code)
+	body.Add("grant_type", "authorization_code")
+	body.Add("redirect_uri", g.redirectURI)
+
+	headers := map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	}
+
+	res := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := g.httpClient.HttpRequestJson(http.MethodPost, u.String(), headers, body.Encode(), &res); err != nil {
+		return "", err
+	}
+
+	return res.AccessToken, nil
+}
+
+func (g GitlabIdentityProvider) GetSingleSignOnUser(identityToken string) (SingleSignOnUser, error) {
+	u, err := url.Parse(g.baseURL + "/oauth/userinfo")
+	if err != nil {
+		return SingleSignOnUser{}, err
+	}
+
+	headers := map[string]string{
+		"Authorization": fmt.Sprintf("Bearer %s", identityToken),
+	}
+
+	res := struct {
+		Subject       string   `json:"sub"`
+		Name          string   `json:"name"`
+		Email         string   `json:"email"`
+		EmailVerified bool     `json:"email_verified"`
+		Picture       string   `json:"picture"`
+		Groups        []string `json:"groups"`
+	}{}
+
+	if err := g.httpClient.HttpRequestJson(http.MethodGet, u.String(), headers, "", &res); err != nil {
+		return SingleSignOnUser{}, err
+	}
+
+	if len(res.Email) > 0 && !res.EmailVerified {
+		return SingleSignOnUser{}, errors.New("email is not verified")
+	}
+
+	return SingleSignOnUser{
+		Subject: res.Subject,
+		Name:    res.Name,
+		Email:   res.Email,
+		Picture: res.Picture,
+		Groups:  res.Groups,
+	}, nil
+}
@@ -3,8 +3,12 @@ module github.com/barj/example-single-sign-on/app
 go 1.15
 
 require (
+	github.com/beevik/etree v1.1.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/go-ldap/ldap/v3 v3.2.4
 	github.com/golang-migrate/migrate/v4 v4.14.1
 	github.com/lib/pq v1.9.0
+	github.com/russellhaering/goxmldsig v1.1.0
 	github.com/spf13/cobra v1.1.1
+	golang.org/x/crypto v0.0.0-20200709230013-948cd5f35899
 )
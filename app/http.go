@@ -2,8 +2,8 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -12,6 +12,89 @@ import (
 
 var DefaultHttpClient = &HttpClient{client: http.Client{Timeout: 10 * time.Second}}
 
+// providerRequestIDHeaders are the headers providers identify their
+// responses with, for their support to look the request up.
+var providerRequestIDHeaders = []string{
+	"X-Request-Id",
+	"X-GitHub-Request-Id",
+	"X-Ms-Request-Id",
+	"X-Fb-Trace-Id",
+	"X-Slack-Req-Id",
+}
+
+// ProviderError is returned by HttpRequestJson when the provider could not
+// be reached or replied with an error. Provider is the host the request was
+// sent to, StatusCode is 0 when no response was received and Code and
+// Description are the OAuth 2.0 error and error_description, or what the
+// provider sends in their place.
+type ProviderError struct {
+	Provider    string
+	StatusCode  int
+	Code        string
+	Description string
+	RequestID   string
+}
+
+func (e ProviderError) Error() string {
+	text := fmt.Sprintf("%s replied %d", e.Provider, e.StatusCode)
+	if e.StatusCode == 0 {
+		text = fmt.Sprintf("%s did not reply", e.Provider)
+	}
+	if len(e.Code) > 0 {
+		text = fmt.Sprintf("%s: %s", text, e.Code)
+	}
+	if len(e.Description) > 0 {
+		text = fmt.Sprintf("%s: %s", text, e.Description)
+	}
+	if len(e.RequestID) > 0 {
+		text = fmt.Sprintf("%s (request id %s)", text, e.RequestID)
+	}
+	return text
+}
+
+// SignInCode categorizes the error like the errors of sign-in callbacks.
+func (e ProviderError) SignInCode() string {
+	switch {
+	case e.StatusCode == 0 || e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests:
+		return SignInProviderUnavailable
+	case e.Code == "invalid_grant" || e.Code == "bad_verification_code":
+		return SignInAuthorizationExpired
+	default:
+		return SignInProviderMisconfigured
+	}
+}
+
+// providerErrorBody is the OAuth 2.0 error response, along with the error
+// object of Facebook and the message of REST APIs like GitHub's.
+type providerErrorBody struct {
+	Error            json.RawMessage `json:"error"`
+	ErrorDescription string          `json:"error_description"`
+	Message          string          `json:"message"`
+}
+
+// parseProviderError reads the error of a response body, if any.
+func parseProviderError(buf []byte) (string, string, bool) {
+	body := providerErrorBody{}
+	if err := json.Unmarshal(buf, &body); err != nil {
+		return "", "", false
+	}
+
+	code := ""
+	if err := json.Unmarshal(body.Error, &code); err == nil && len(code) > 0 {
+		return code, body.ErrorDescription, true
+	}
+
+	object := struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(body.Error, &object); err == nil && len(object.Message) > 0 {
+		return object.Type, object.Message, true
+	}
+
+	return "", body.Message, false
+}
+
 type HttpClient struct {
 	client http.Client
 }
@@ -23,9 +106,24 @@ func (h HttpClient) HttpRequestJson(
 	body string,
 	v interface{},
 ) error {
+	_, err := h.HttpRequestJsonPage(method, url, headers, body, v)
+	return err
+}
+
+// HttpRequestJsonPage is HttpRequestJson for paginated APIs like GitHub's,
+// and also returns the URL of the next page from the Link header, or an
+// empty string on the last page. The next page must be on the same host,
+// as the headers carry the user's token.
+func (h HttpClient) HttpRequestJsonPage(
+	method string,
+	url string,
+	headers map[string]string,
+	body string,
+	v interface{},
+) (string, error) {
 	req, err := http.NewRequest(method, url, strings.NewReader(body))
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	req.Header.Add("Accept", "application/json")
@@ -35,23 +133,94 @@ func (h HttpClient) HttpRequestJson(
 
 	res, err := h.client.Do(req)
 	if err != nil {
-		return err
-	}
-
-	if res.StatusCode >= 400 {
-		return errors.New(res.Status)
+		return "", ProviderError{Provider: req.URL.Host, Description: err.Error()}
 	}
 
 	defer res.Body.Close()
 	buf, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	// Some providers, like GitHub for the token exchange, reply errors
+	// with 200 OK. Redirects only end up here with clients not following
+	// them.
+	code, description, hasError := parseProviderError(buf)
+	if res.StatusCode >= 300 || hasError {
+		providerError := ProviderError{
+			Provider:    req.URL.Host,
+			StatusCode:  res.StatusCode,
+			Code:        code,
+			Description: description,
+		}
+		for _, header := range providerRequestIDHeaders {
+			if requestID := res.Header.Get(header); len(requestID) > 0 {
+				providerError.RequestID = requestID
+				break
+			}
+		}
+		return "", providerError
 	}
 
 	err = json.Unmarshal(buf, v)
+	if err != nil {
+		return "", err
+	}
+
+	next := nextPageURL(res.Header.Values("Link"))
+	if len(next) < 1 {
+		return "", nil
+	}
+	nextURL, err := req.URL.Parse(next)
+	if err != nil {
+		return "", fmt.Errorf("invalid next page %q: %w", next, err)
+	}
+	if nextURL.Scheme != req.URL.Scheme || nextURL.Host != req.URL.Host {
+		return "", fmt.Errorf("next page %s is not on %s", nextURL.Host, req.URL.Host)
+	}
+	return nextURL.String(), nil
+}
+
+// nextPageURL returns the link with rel="next" of Link headers like
+// `<https://api.github.com/user/orgs?page=2>; rel="next", <...>; rel="last"`.
+func nextPageURL(links []string) string {
+	for _, header := range links {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				key, value := param, ""
+				if i := strings.Index(param, "="); i >= 0 {
+					key, value = param[:i], param[i+1:]
+				}
+				if !strings.EqualFold(strings.TrimSpace(key), "rel") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(strings.TrimSpace(value), `"`)) {
+					if strings.EqualFold(rel, "next") {
+						return strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func HttpReadJson(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
 	if err != nil {
 		return err
 	}
+
+	err = json.Unmarshal(buf, v)
+	if err != nil {
+		return fmt.Errorf("invalid json body: %v", err)
+	}
 	return nil
 }
 
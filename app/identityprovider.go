@@ -0,0 +1,622 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// IdentityProviderConfig describes how to connect to an identity provider.
+// Organizations store theirs in the database, where the name is used in the
+// sign-in paths and therefore unique across organizations.
+type IdentityProviderConfig struct {
+	ID                    int               `json:"id"`
+	OrganizationID        int               `json:"organization_id"`
+	Name                  string            `json:"name"`
+	Type                  string            `json:"type"`
+	ClientID              string            `json:"client_id"`
+	ClientSecret          string            `json:"-"`
+	EncryptedClientSecret []byte            `json:"-"`
+	Scopes                []string          `json:"scopes"`
+	Issuer                string            `json:"issuer"`
+	Options               map[string]string `json:"options"`
+	Enabled               bool              `json:"enabled"`
+	CreatedAt             time.Time         `json:"created_at"`
+}
+
+// NewIdentityProvider creates an identity provider of the configured type.
+// Providers of organizations request their endpoints with the
+// OrganizationHttpClient.
+func NewIdentityProvider(config IdentityProviderConfig, redirectURI string) (IdentityProvider, error) {
+	httpClient := DefaultHttpClient
+	if config.OrganizationID > 0 {
+		httpClient = OrganizationHttpClient
+	}
+
+	switch config.Type {
+	case "google":
+		provider := NewGoogleIdentityProvider(
+			config.ClientID,
+			config.ClientSecret,
+			redirectURI,
+			splitOption(config.Options["hosted_domains"]),
+		)
+		if len(config.Scopes) > 0 {
+			provider.scopes = config.Scopes
+		}
+		return provider, nil
+	case "facebook":
+		provider := NewFacebookIdentityProvider(config.ClientID, config.ClientSecret, redirectURI)
+		if len(config.Scopes) > 0 {
+			provider.scopes = config.Scopes
+		}
+		return provider, nil
+	case "github":
+		if err := validateBaseURL(config.Options["base_url"]); err != nil {
+			return nil, err
+		}
+		provider := NewGithubIdentityProvider(
+			config.ClientID,
+			config.ClientSecret,
+			redirectURI,
+			config.Options["base_url"],
+			splitOption(config.Options["allowed_organizations"]),
+			splitOption(config.Options["allowed_teams"]),
+		)
+		provider.httpClient = httpClient
+		if len(config.Scopes) > 0 {
+			provider.scopes = config.Scopes
+		}
+		return provider, nil
+	case "gitlab":
+		if err := validateBaseURL(config.Options["base_url"]); err != nil {
+			return nil, err
+		}
+		provider := NewGitlabIdentityProvider(config.ClientID, config.ClientSecret, redirectURI, config.Options["base_url"])
+		provider.httpClient = httpClient
+		if len(config.Scopes) > 0 {
+			provider.scopes = config.Scopes
+		}
+		return provider, nil
+	case "microsoft":
+		provider := NewMicrosoftIdentityProvider(
+			config.ClientID,
+			config.ClientSecret,
+			redirectURI,
+			config.Options["tenant"],
+			splitOption(config.Options["allowed_tenants"]),
+		)
+		if len(config.Scopes) > 0 {
+			provider.scopes = config.Scopes
+		}
+		return provider, nil
+	case "apple":
+		// The client secret of Apple is the private key to sign client
+		// secrets with.
+		if len(config.Options["team_id"]) < 1 || len(config.Options["key_id"]) < 1 {
+			return nil, errors.New("apple identity provider needs the team_id and key_id options")
+		}
+		provider := NewAppleIdentityProvider(
+			config.ClientID,
+			config.Options["team_id"],
+			config.Options["key_id"],
+			config.ClientSecret,
+			redirectURI,
+		)
+		if len(config.Scopes) > 0 {
+			provider.scopes = config.Scopes
+		}
+		return provider, nil
+	case "oauth2":
+		oauth2Config := NewGenericOAuth2Config(config.Options, config.Scopes)
+		if err := oauth2Config.Validate(); err != nil {
+			return nil, err
+		}
+		provider := NewGenericOAuth2IdentityProvider(config.ClientID, config.ClientSecret, redirectURI, oauth2Config)
+		provider.httpClient = httpClient
+		return provider, nil
+	default:
+		oauth2Config, ok := genericOAuth2Presets[config.Type]
+		if !ok {
+			return nil, fmt.Errorf("unknown identity provider type: %s", config.Type)
+		}
+		if len(config.Scopes) > 0 {
+			oauth2Config.Scopes = config.Scopes
+		}
+		return NewGenericOAuth2IdentityProvider(config.ClientID, config.ClientSecret, redirectURI, oauth2Config), nil
+	}
+}
+
+// splitOption splits a comma-separated option into its trimmed values.
+func splitOption(option string) []string {
+	values := []string{}
+	for _, value := range strings.Split(option, ",") {
+		value = strings.TrimSpace(value)
+		if len(value) > 0 {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// validateBaseURL checks the optional base url of a self-hosted provider.
+func validateBaseURL(baseURL string) error {
+	if len(baseURL) < 1 {
+		return nil
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || len(u.Host) < 1 {
+		return fmt.Errorf("invalid base url: %s", baseURL)
+	}
+	return nil
+}
+
+// nonPublicNetworks are the address ranges the server must not be made to
+// request by identity providers of organizations, besides loopback,
+// link-local and unspecified addresses.
+var nonPublicNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// organizationEndpoints returns the urls the server itself requests for an
+// identity provider, as far as organizations can choose them.
+func organizationEndpoints(config IdentityProviderConfig) []string {
+	switch config.Type {
+	case "github", "gitlab":
+		return []string{config.Options["base_url"]}
+	case "oauth2":
+		return []string{config.Options["token_url"], config.Options["userinfo_url"], config.Options["email_url"]}
+	default:
+		return nil
+	}
+}
+
+// validateOrganizationEndpoints checks that the endpoints of an identity
+// provider of an organization use https and resolve to public addresses
+// only, so organizations cannot point the server at internal services.
+func validateOrganizationEndpoints(config IdentityProviderConfig) error {
+	for _, endpoint := range organizationEndpoints(config) {
+		if len(endpoint) < 1 {
+			continue
+		}
+
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme != "https" || len(u.Hostname()) < 1 {
+			return fmt.Errorf("invalid endpoint, must be an https url: %s", endpoint)
+		}
+
+		ips := []net.IP{net.ParseIP(u.Hostname())}
+		if ips[0] == nil {
+			if ips, err = net.LookupIP(u.Hostname()); err != nil {
+				return fmt.Errorf("failed to resolve endpoint %s: %v", endpoint, err)
+			}
+		}
+		for _, ip := range ips {
+			if !isPublicIP(ip) {
+				return fmt.Errorf("endpoint %s does not resolve to a public address", endpoint)
+			}
+		}
+	}
+	return nil
+}
+
+// OrganizationHttpClient requests the endpoints of identity providers of
+// organizations. It does not follow redirects and only connects to public
+// addresses, checked after resolution, so neither a redirect nor a DNS
+// change since validateOrganizationEndpoints can reach internal services.
+var OrganizationHttpClient = &HttpClient{client: http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: dialPublicOnly,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}}
+
+// dialPublicOnly refuses connections to non-public addresses.
+func dialPublicOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+type IdentityProviderManager struct {
+	repository          IdentityProviderRepository
+	organizationManager OrganizationManager
+	secretBox           SecretBox
+	reservedNames       []string
+}
+
+func NewIdentityProviderManager(
+	repository IdentityProviderRepository,
+	organizationManager OrganizationManager,
+	secretBox SecretBox,
+	reservedNames []string,
+) IdentityProviderManager {
+	return IdentityProviderManager{
+		repository:          repository,
+		organizationManager: organizationManager,
+		secretBox:           secretBox,
+		reservedNames:       reservedNames,
+	}
+}
+
+func (m IdentityProviderManager) GetIdentityProviders(userID int, organizationID int) ([]IdentityProviderConfig, error) {
+	if err := m.authorize(userID, organizationID); err != nil {
+		return nil, err
+	}
+	return m.repository.GetOrganizationIdentityProviders(organizationID)
+}
+
+func (m IdentityProviderManager) GetIdentityProvider(userID int, organizationID int, name string) (IdentityProviderConfig, error) {
+	if err := m.authorize(userID, organizationID); err != nil {
+		return IdentityProviderConfig{}, err
+	}
+	return m.getOrganizationIdentityProvider(organizationID, name)
+}
+
+func (m IdentityProviderManager) CreateIdentityProvider(userID int, config IdentityProviderConfig) (IdentityProviderConfig, error) {
+	if err := m.authorize(userID, config.OrganizationID); err != nil {
+		return IdentityProviderConfig{}, err
+	}
+
+	config.Name = strings.ToLower(strings.TrimSpace(config.Name))
+	if !organizationSlugPattern.MatchString(config.Name) || contains(m.reservedNames, config.Name) {
+		return IdentityProviderConfig{}, fmt.Errorf("invalid identity provider name: %s", config.Name)
+	}
+
+	if err := m.validate(config); err != nil {
+		return IdentityProviderConfig{}, err
+	}
+
+	if len(config.ClientSecret) < 1 && config.Type != samlProviderType {
+		return IdentityProviderConfig{}, errors.New("client secret cannot be empty")
+	}
+
+	encryptedClientSecret, err := m.secretBox.Seal([]byte(config.ClientSecret))
+	if err != nil {
+		return IdentityProviderConfig{}, fmt.Errorf("failed to encrypt client secret: %v", err)
+	}
+	config.EncryptedClientSecret = encryptedClientSecret
+
+	return m.repository.CreateIdentityProvider(config)
+}
+
+// UpdateIdentityProvider replaces the settings of an identity provider. The
+// client secret is only replaced when a new one is given.
+func (m IdentityProviderManager) UpdateIdentityProvider(userID int, config IdentityProviderConfig) (IdentityProviderConfig, error) {
+	if err := m.authorize(userID, config.OrganizationID); err != nil {
+		return IdentityProviderConfig{}, err
+	}
+
+	existing, err := m.getOrganizationIdentityProvider(config.OrganizationID, config.Name)
+	if err != nil {
+		return IdentityProviderConfig{}, err
+	}
+	config.ID = existing.ID
+
+	if err := m.validate(config); err != nil {
+		return IdentityProviderConfig{}, err
+	}
+
+	config.EncryptedClientSecret = existing.EncryptedClientSecret
+	if len(config.ClientSecret) > 0 {
+		config.EncryptedClientSecret, err = m.secretBox.Seal([]byte(config.ClientSecret))
+		if err != nil {
+			return IdentityProviderConfig{}, fmt.Errorf("failed to encrypt client secret: %v", err)
+		}
+	}
+
+	return m.repository.UpdateIdentityProvider(config)
+}
+
+func (m IdentityProviderManager) DeleteIdentityProvider(userID int, organizationID int, name string) error {
+	if err := m.authorize(userID, organizationID); err != nil {
+		return err
+	}
+
+	config, err := m.getOrganizationIdentityProvider(organizationID, name)
+	if err != nil {
+		return err
+	}
+
+	return m.repository.DeleteIdentityProvider(config.ID)
+}
+
+// GetEnabledIdentityProvider returns the configuration of an enabled
+// identity provider with its client secret decrypted.
+func (m IdentityProviderManager) GetEnabledIdentityProvider(name string) (IdentityProviderConfig, error) {
+	config, err := m.repository.GetIdentityProviderByName(name)
+	if err != nil {
+		return IdentityProviderConfig{}, err
+	}
+
+	if !config.Enabled {
+		return IdentityProviderConfig{}, ErrIdentityProviderNotFound(fmt.Sprintf("identity provider %s is disabled", name))
+	}
+
+	clientSecret, err := m.secretBox.Open(config.EncryptedClientSecret)
+	if err != nil {
+		return IdentityProviderConfig{}, fmt.Errorf("failed to decrypt client secret: %v", err)
+	}
+	config.ClientSecret = string(clientSecret)
+
+	return config, nil
+}
+
+func (m IdentityProviderManager) getOrganizationIdentityProvider(organizationID int, name string) (IdentityProviderConfig, error) {
+	config, err := m.repository.GetIdentityProviderByName(name)
+	if err != nil {
+		return IdentityProviderConfig{}, err
+	}
+
+	if config.OrganizationID != organizationID {
+		return IdentityProviderConfig{}, ErrIdentityProviderNotFound(fmt.Sprintf("identity provider %s not found", name))
+	}
+
+	return config, nil
+}
+
+func (m IdentityProviderManager) validate(config IdentityProviderConfig) error {
+	if config.Type == samlProviderType {
+		_, err := NewSAMLServiceProvider(NewSAMLConfig(config.Options, "", ""), nil)
+		return err
+	}
+
+	if len(config.ClientID) < 1 {
+		return errors.New("client id cannot be empty")
+	}
+
+	if _, err := NewIdentityProvider(config, ""); err != nil {
+		return err
+	}
+
+	return validateOrganizationEndpoints(config)
+}
+
+// authorize checks that the user administers the organization.
+func (m IdentityProviderManager) authorize(userID int, organizationID int) error {
+	membership, err := m.organizationManager.GetMembership(organizationID, userID)
+	if err != nil {
+		return err
+	}
+
+	if membership.Role != OrganizationOwner && membership.Role != OrganizationAdmin {
+		return ErrOrganizationForbidden("only owners and admins can manage identity providers")
+	}
+
+	return nil
+}
+
+type ErrIdentityProviderNotFound string
+
+func (e ErrIdentityProviderNotFound) Error() string {
+	return string(e)
+}
+
+// samlProviderType is the type of identity providers signing in with SAML,
+// which are served by the SAML routes instead of the single sign-on routes.
+const samlProviderType = "saml"
+
+// reservedProviderNames cannot be used by identity providers of
+// organizations, as they are taken by providers configured at startup or by
+// the single sign-on routes.
+var reservedProviderNames = []string{
+	"providers",
+	"google", "facebook", "github", "microsoft", "apple", "gitlab",
+	"discord", "slack", "bitbucket", "linkedin", "ldap", "password", "magic_link", "saml",
+}
+
+// ProviderDefinition describes a provider configured at startup.
+type ProviderDefinition struct {
+	Name          string
+	DisplayName   string
+	Icon          string
+	Config        IdentityProviderConfig
+	RedirectURI   string
+	SignUpEnabled bool
+}
+
+type ProviderInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Icon        string `json:"icon"`
+	SignInURL   string `json:"sign_in_url"`
+}
+
+type registeredProvider struct {
+	info         ProviderInfo
+	singleSignOn SingleSignOn
+}
+
+// ProviderRegistry resolves the single sign-on of a provider by the name
+// used in its sign-in paths. Providers configured at startup take
+// precedence over the identity providers of organizations.
+type ProviderRegistry struct {
+	providers               *[]registeredProvider
+	identityProviderManager IdentityProviderManager
+	singleSignOnFactory     SingleSignOnFactory
+	samlStore               *SAMLStore
+	apiURL                  string
+}
+
+func NewProviderRegistry(
+	identityProviderManager IdentityProviderManager,
+	singleSignOnFactory SingleSignOnFactory,
+	samlStore *SAMLStore,
+	apiURL string,
+) ProviderRegistry {
+	return ProviderRegistry{
+		providers:               &[]registeredProvider{},
+		identityProviderManager: identityProviderManager,
+		singleSignOnFactory:     singleSignOnFactory,
+		samlStore:               samlStore,
+		apiURL:                  strings.TrimSuffix(apiURL, "/"),
+	}
+}
+
+// Register adds a provider to the registry. Providers without a client id
+// are disabled and skipped, in which case Register returns false.
+func (r ProviderRegistry) Register(definition ProviderDefinition) (bool, error) {
+	if len(definition.Config.ClientID) < 1 {
+		return false, nil
+	}
+
+	if _, ok := r.lookupRegistered(definition.Name); ok {
+		return false, fmt.Errorf("identity provider %s is already registered", definition.Name)
+	}
+
+	redirectURI := definition.RedirectURI
+	if len(redirectURI) < 1 {
+		redirectURI = r.CallbackURL(definition.Name)
+	}
+
+	identityProvider, err := NewIdentityProvider(definition.Config, redirectURI)
+	if err != nil {
+		return false, fmt.Errorf("invalid identity provider %s: %v", definition.Name, err)
+	}
+
+	*r.providers = append(*r.providers, registeredProvider{
+		info: ProviderInfo{
+			Name:        definition.Name,
+			DisplayName: definition.DisplayName,
+			Icon:        definition.Icon,
+			SignInURL:   r.SignInURL(definition.Name),
+		},
+		singleSignOn: r.singleSignOnFactory.NewSingleSignOn(definition.Name, identityProvider, definition.SignUpEnabled),
+	})
+	return true, nil
+}
+
+// Providers lists the registered providers in order of registration.
+func (r ProviderRegistry) Providers() []ProviderInfo {
+	providers := make([]ProviderInfo, 0, len(*r.providers))
+	for _, provider := range *r.providers {
+		providers = append(providers, provider.info)
+	}
+	return providers
+}
+
+func (r ProviderRegistry) Lookup(name string) (SingleSignOn, error) {
+	if provider, ok := r.lookupRegistered(name); ok {
+		return provider.singleSignOn, nil
+	}
+
+	config, err := r.identityProviderManager.GetEnabledIdentityProvider(name)
+	if err != nil {
+		return SingleSignOn{}, err
+	}
+
+	if config.Type == samlProviderType {
+		return SingleSignOn{}, ErrIdentityProviderNotFound(fmt.Sprintf("identity provider %s uses saml", name))
+	}
+
+	// The addresses are checked again, as DNS may have changed since the
+	// provider was configured.
+	if err := validateOrganizationEndpoints(config); err != nil {
+		return SingleSignOn{}, err
+	}
+
+	identityProvider, err := NewIdentityProvider(config, r.CallbackURL(name))
+	if err != nil {
+		return SingleSignOn{}, err
+	}
+
+	return r.singleSignOnFactory.NewOrganizationSingleSignOn(name, identityProvider, config.OrganizationID), nil
+}
+
+// LookupSAML resolves the SAML service provider of an organization and the
+// single sign-on issuing tokens for its users.
+func (r ProviderRegistry) LookupSAML(name string) (SAMLServiceProvider, SingleSignOn, error) {
+	config, err := r.identityProviderManager.GetEnabledIdentityProvider(name)
+	if err != nil {
+		return SAMLServiceProvider{}, SingleSignOn{}, err
+	}
+
+	if config.Type != samlProviderType {
+		return SAMLServiceProvider{}, SingleSignOn{}, ErrIdentityProviderNotFound(fmt.Sprintf("identity provider %s does not use saml", name))
+	}
+
+	serviceProvider, err := NewSAMLServiceProvider(
+		NewSAMLConfig(config.Options, r.SAMLMetadataURL(name), r.SAMLACSURL(name)),
+		r.samlStore,
+	)
+	if err != nil {
+		return SAMLServiceProvider{}, SingleSignOn{}, err
+	}
+
+	singleSignOn := r.singleSignOnFactory.NewOrganizationSingleSignOn(name, nil, config.OrganizationID)
+	return serviceProvider, singleSignOn, nil
+}
+
+func (r ProviderRegistry) SignInURL(name string) string {
+	return fmt.Sprintf("%s/api/v1/single-sign-on/%s/sign-in", r.apiURL, name)
+}
+
+func (r ProviderRegistry) CallbackURL(name string) string {
+	return fmt.Sprintf("%s/api/v1/single-sign-on/%s/callback", r.apiURL, name)
+}
+
+// SAMLMetadataURL is also used as the entity id of the service provider.
+func (r ProviderRegistry) SAMLMetadataURL(name string) string {
+	return fmt.Sprintf("%s/api/v1/saml/%s/metadata", r.apiURL, name)
+}
+
+func (r ProviderRegistry) SAMLACSURL(name string) string {
+	return fmt.Sprintf("%s/api/v1/saml/%s/acs", r.apiURL, name)
+}
+
+func (r ProviderRegistry) lookupRegistered(name string) (registeredProvider, bool) {
+	for _, provider := range *r.providers {
+		if provider.info.Name == name {
+			return provider, true
+		}
+	}
+	return registeredProvider{}, false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOrganizationHttpClientRefusesNonPublicAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	if err := DefaultHttpClient.HttpRequestJson(http.MethodGet, server.URL, nil, "", &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var providerError ProviderError
+	err := OrganizationHttpClient.HttpRequestJson(http.MethodGet, server.URL, nil, "", &struct{}{})
+	if !errors.As(err, &providerError) || providerError.StatusCode != 0 {
+		t.Errorf("expected the loopback address to be refused, got %v", err)
+	}
+}
+
+func TestOrganizationHttpClientDoesNotFollowRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	// The transport is replaced to reach the loopback test server.
+	client := HttpClient{client: OrganizationHttpClient.client}
+	client.client.Transport = nil
+
+	var providerError ProviderError
+	err := client.HttpRequestJson(http.MethodGet, server.URL+"/redirect", nil, "", &struct{}{})
+	if !errors.As(err, &providerError) || providerError.StatusCode != http.StatusFound {
+		t.Errorf("expected the redirect not to be followed, got %v", err)
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	tests := map[string]string{
+		``: "",
+		`<https://api.github.com/user/orgs?page=2>; rel="next", <https://api.github.com/user/orgs?page=5>; rel="last"`:  "https://api.github.com/user/orgs?page=2",
+		`<https://api.github.com/user/orgs?page=1>; rel="prev", <https://api.github.com/user/orgs?page=1>; rel="first"`: "",
+		`<https://api.github.com/user/orgs?page=3>; rel="last next"`:                                                    "https://api.github.com/user/orgs?page=3",
+	}
+	for header, expected := range tests {
+		if next := nextPageURL([]string{header}); next != expected {
+			t.Errorf("%s: expected %q, got %q", header, expected, next)
+		}
+	}
+}
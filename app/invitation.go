@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Invitation struct {
+	ID               int        `json:"id"`
+	Email            string     `json:"email"`
+	Role             string     `json:"role,omitempty"`
+	OrganizationID   int        `json:"organization_id,omitempty"`
+	OrganizationRole string     `json:"organization_role,omitempty"`
+	CreatedBy        int        `json:"created_by"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	AcceptedAt       *time.Time `json:"accepted_at,omitempty"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+type InvitationManager struct {
+	repository InvitationRepository
+	lifetime   time.Duration
+}
+
+func NewInvitationManager(
+	repository InvitationRepository,
+	lifetime time.Duration,
+) InvitationManager {
+	return InvitationManager{
+		repository: repository,
+		lifetime:   lifetime,
+	}
+}
+
+// CreateInvitation stores the invitation and returns it together with the
+// invite token. Only a hash of the token is stored, so the token cannot be
+// retrieved afterwards.
+func (m InvitationManager) CreateInvitation(invitation Invitation) (Invitation, string, error) {
+	invitation.Email = strings.ToLower(strings.TrimSpace(invitation.Email))
+	if !strings.Contains(invitation.Email, "@") {
+		return Invitation{}, "", errors.New("invalid email")
+	}
+
+	if invitation.ExpiresAt.IsZero() {
+		invitation.ExpiresAt = time.Now().Add(m.lifetime)
+	}
+	if invitation.ExpiresAt.Before(time.Now()) {
+		return Invitation{}, "", errors.New("expiry must be in the future")
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return Invitation{}, "", err
+	}
+
+	invitation, err = m.repository.CreateInvitation(invitation, hashToken(token))
+	if err != nil {
+		return Invitation{}, "", err
+	}
+
+	return invitation, token, nil
+}
+
+// AcceptInvitation redeems the invitation identified by token for email.
+// An invitation can only be accepted once.
+func (m InvitationManager) AcceptInvitation(token string, email string) (Invitation, error) {
+	invitation, err := m.repository.GetInvitationByTokenHash(hashToken(token))
+	var invitationNotFound ErrInvitationNotFound
+	if errors.As(err, &invitationNotFound) {
+		return Invitation{}, errInvitationInvalid("invitation does not exist")
+	}
+	if err != nil {
+		return Invitation{}, err
+	}
+
+	if invitation.AcceptedAt != nil {
+		return Invitation{}, errInvitationInvalid("invitation has already been used")
+	}
+
+	if invitation.ExpiresAt.Before(time.Now()) {
+		return Invitation{}, errInvitationInvalid("invitation has expired")
+	}
+
+	if invitation.Email != strings.ToLower(email) {
+		return Invitation{}, errInvitationInvalid(fmt.Sprintf("invitation is not valid for %s", email))
+	}
+
+	if err := m.repository.AcceptInvitation(invitation.ID); err != nil {
+		if errors.As(err, &invitationNotFound) {
+			return Invitation{}, errInvitationInvalid("invitation has already been used")
+		}
+		return Invitation{}, err
+	}
+
+	return invitation, nil
+}
+
+func errInvitationInvalid(message string) ErrSignUpRejected {
+	return ErrSignUpRejected{Code: SignUpInvitationInvalid, Message: message}
+}
+
+type ErrInvitationNotFound string
+
+func (e ErrInvitationNotFound) Error() string {
+	return string(e)
+}
+
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
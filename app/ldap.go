@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConfig describes how to find and authenticate users in a directory.
+// The user filter contains {username}, which is replaced by the escaped
+// username, e.g. (uid={username}) or (sAMAccountName={username}) for Active
+// Directory. Without a subject attribute, users are identified by their DN.
+type LDAPConfig struct {
+	URL              string
+	StartTLS         bool
+	BindDN           string
+	BindPassword     string
+	BaseDN           string
+	UserFilter       string
+	EmailAttribute   string
+	NameAttribute    string
+	GroupsAttribute  string
+	SubjectAttribute string
+}
+
+// LDAPConn is the part of a directory connection the authenticator uses,
+// which allows an in-process directory to stand in for a real one.
+type LDAPConn interface {
+	StartTLS(config *tls.Config) error
+	Bind(username string, password string) error
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close()
+}
+
+type LDAPDialer func(address string) (LDAPConn, error)
+
+// DialLDAP connects to a directory server, e.g. ldaps://ldap.example.com.
+func DialLDAP(address string) (LDAPConn, error) {
+	conn, err := ldap.DialURL(address)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// LDAPAuthenticator signs users in by binding to a directory with their
+// username and password. Users are provisioned like single sign-on users.
+type LDAPAuthenticator struct {
+	config       LDAPConfig
+	dial         LDAPDialer
+	singleSignOn SingleSignOn
+}
+
+func NewLDAPAuthenticator(
+	config LDAPConfig,
+	dial LDAPDialer,
+	singleSignOn SingleSignOn,
+) LDAPAuthenticator {
+	return LDAPAuthenticator{
+		config:       config,
+		dial:         dial,
+		singleSignOn: singleSignOn,
+	}
+}
+
+func (a LDAPAuthenticator) Enabled() bool {
+	return len(a.config.URL) > 0
+}
+
+// SignIn authenticates the user against the directory and returns a token.
+func (a LDAPAuthenticator) SignIn(username string, password string, invitationToken string) (string, error) {
+	singleSignOnUser, err := a.Authenticate(username, password)
+	if err != nil {
+		return "", err
+	}
+
+	return a.singleSignOn.SignInUser(singleSignOnUser, invitationToken)
+}
+
+// Authenticate looks the user up with the service account, then binds as
+// the user to verify the password.
+func (a LDAPAuthenticator) Authenticate(username string, password string) (SingleSignOnUser, error) {
+	// An empty password would make an unauthenticated bind, which succeeds.
+	if len(username) < 1 || len(password) < 1 {
+		return SingleSignOnUser{}, ErrInvalidCredentials("invalid username or password")
+	}
+
+	conn, err := a.dial(a.config.URL)
+	if err != nil {
+		return SingleSignOnUser{}, fmt.Errorf("failed to connect to ldap: %v", err)
+	}
+	defer conn.Close()
+
+	if a.config.StartTLS {
+		if err := conn.StartTLS(&tls.Config{ServerName: ldapHost(a.config.URL)}); err != nil {
+			return SingleSignOnUser{}, fmt.Errorf("failed to start tls: %v", err)
+		}
+	}
+
+	if len(a.config.BindDN) > 0 {
+		if err := conn.Bind(a.config.BindDN, a.config.BindPassword); err != nil {
+			return SingleSignOnUser{}, fmt.Errorf("failed to bind service account: %v", err)
+		}
+	}
+
+	attributes := []string{"dn", a.config.EmailAttribute, a.config.NameAttribute, a.config.GroupsAttribute}
+	if len(a.config.SubjectAttribute) > 0 {
+		attributes = append(attributes, a.config.SubjectAttribute)
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(
+		a.config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		10,
+		false,
+		strings.Replace(a.config.UserFilter, "{username}", ldap.EscapeFilter(username), -1),
+		attributes,
+		nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return SingleSignOnUser{}, fmt.Errorf("failed to search user: %v", err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		return SingleSignOnUser{}, ErrInvalidCredentials("invalid username or password")
+	}
+	entry := result.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return SingleSignOnUser{}, ErrInvalidCredentials("invalid username or password")
+	}
+	if err != nil {
+		return SingleSignOnUser{}, fmt.Errorf("failed to bind user: %v", err)
+	}
+
+	subject := entry.DN
+	if len(a.config.SubjectAttribute) > 0 {
+		subject = entry.GetAttributeValue(a.config.SubjectAttribute)
+	}
+
+	groups := []string{}
+	for _, group := range entry.GetAttributeValues(a.config.GroupsAttribute) {
+		groups = append(groups, ldapGroupName(group))
+	}
+
+	return SingleSignOnUser{
+		Subject: subject,
+		Email:   entry.GetAttributeValue(a.config.EmailAttribute),
+		Name:    entry.GetAttributeValue(a.config.NameAttribute),
+		Groups:  groups,
+	}, nil
+}
+
+// ldapGroupName returns the common name of a group given by its DN, as
+// memberOf lists groups, or the group unchanged otherwise.
+func ldapGroupName(group string) string {
+	dn, err := ldap.ParseDN(group)
+	if err != nil || len(dn.RDNs) < 1 {
+		return group
+	}
+
+	for _, attribute := range dn.RDNs[0].Attributes {
+		if strings.EqualFold(attribute.Type, "cn") {
+			return attribute.Value
+		}
+	}
+	return group
+}
+
+func ldapHost(address string) string {
+	u, err := url.Parse(address)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
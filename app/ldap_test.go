@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// memoryDirectory is an in-process directory for LDAPAuthenticator. It
+// answers equality filters like (uid=alice) on the entries it holds.
+type memoryDirectory struct {
+	entries   []*ldap.Entry
+	passwords map[string]string
+}
+
+func newMemoryDirectory() *memoryDirectory {
+	return &memoryDirectory{passwords: map[string]string{}}
+}
+
+func (d *memoryDirectory) add(dn string, password string, attributes map[string][]string) {
+	d.entries = append(d.entries, ldap.NewEntry(dn, attributes))
+	d.passwords[dn] = password
+}
+
+func (d *memoryDirectory) dial(address string) (LDAPConn, error) {
+	return d, nil
+}
+
+func (d *memoryDirectory) StartTLS(config *tls.Config) error {
+	return nil
+}
+
+func (d *memoryDirectory) Bind(username string, password string) error {
+	expected, ok := d.passwords[username]
+	if !ok || len(password) < 1 || password != expected {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+func (d *memoryDirectory) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	filter := strings.TrimSuffix(strings.TrimPrefix(searchRequest.Filter, "("), ")")
+	parts := strings.SplitN(filter, "=", 2)
+	if len(parts) != 2 {
+		return nil, ldap.NewError(ldap.LDAPResultFilterError, errors.New("unsupported filter"))
+	}
+
+	result := &ldap.SearchResult{}
+	for _, entry := range d.entries {
+		if !contains(entry.GetAttributeValues(parts[0]), parts[1]) {
+			continue
+		}
+		if searchRequest.SizeLimit > 0 && len(result.Entries) >= searchRequest.SizeLimit {
+			return result, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+	return result, nil
+}
+
+func (d *memoryDirectory) Close() {
+}
+
+func newTestLDAPAuthenticator(directory *memoryDirectory, repository *memoryRepository) LDAPAuthenticator {
+	return NewLDAPAuthenticator(
+		LDAPConfig{
+			URL:             "ldap://ldap.example.com",
+			BindDN:          "cn=service,dc=example,dc=com",
+			BindPassword:    "service",
+			BaseDN:          "dc=example,dc=com",
+			UserFilter:      "(uid={username})",
+			EmailAttribute:  "mail",
+			NameAttribute:   "displayName",
+			GroupsAttribute: "memberOf",
+		},
+		directory.dial,
+		newTestSingleSignOnFactory(repository).NewSingleSignOn("ldap", nil, true),
+	)
+}
+
+func newTestDirectory() *memoryDirectory {
+	directory := newMemoryDirectory()
+	directory.add("cn=service,dc=example,dc=com", "service", map[string][]string{})
+	directory.add("uid=alice,ou=people,dc=example,dc=com", "secret", map[string][]string{
+		"uid":         {"alice"},
+		"mail":        {"alice@example.com"},
+		"displayName": {"Alice"},
+		"memberOf": {
+			"cn=developers,ou=groups,dc=example,dc=com",
+			"cn=admins,ou=groups,dc=example,dc=com",
+		},
+	})
+	return directory
+}
+
+func TestLDAPAuthenticatorAuthenticate(t *testing.T) {
+	authenticator := newTestLDAPAuthenticator(newTestDirectory(), newMemoryRepository())
+
+	user, err := authenticator.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatalf("expected alice to authenticate, got %v", err)
+	}
+
+	if user.Subject != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Errorf("expected the DN as subject, got %q", user.Subject)
+	}
+	if user.Email != "alice@example.com" || user.Name != "Alice" {
+		t.Errorf("unexpected email %q or name %q", user.Email, user.Name)
+	}
+	if strings.Join(user.Groups, ",") != "developers,admins" {
+		t.Errorf("expected memberOf to map to group names, got %v", user.Groups)
+	}
+}
+
+func TestLDAPAuthenticatorInvalidCredentials(t *testing.T) {
+	directory := newTestDirectory()
+	directory.add("uid=bob,ou=people,dc=example,dc=com", "secret", map[string][]string{"uid": {"bob"}})
+	directory.add("uid=bob,ou=contractors,dc=example,dc=com", "secret", map[string][]string{"uid": {"bob"}})
+	authenticator := newTestLDAPAuthenticator(directory, newMemoryRepository())
+
+	tests := map[string][2]string{
+		"wrong password":   {"alice", "wrong"},
+		"empty password":   {"alice", ""},
+		"empty username":   {"", "secret"},
+		"no entry":         {"carol", "secret"},
+		"multiple entries": {"bob", "secret"},
+	}
+	for name, credentials := range tests {
+		_, err := authenticator.Authenticate(credentials[0], credentials[1])
+		var invalidCredentials ErrInvalidCredentials
+		if !errors.As(err, &invalidCredentials) {
+			t.Errorf("%s: expected invalid credentials, got %v", name, err)
+		}
+	}
+}
+
+func TestLDAPAuthenticatorServiceBindFailure(t *testing.T) {
+	directory := newTestDirectory()
+	directory.passwords["cn=service,dc=example,dc=com"] = "rotated"
+	authenticator := newTestLDAPAuthenticator(directory, newMemoryRepository())
+
+	_, err := authenticator.Authenticate("alice", "secret")
+	if err == nil {
+		t.Fatal("expected the service account bind to fail")
+	}
+	var invalidCredentials ErrInvalidCredentials
+	if errors.As(err, &invalidCredentials) {
+		t.Errorf("expected a service account failure not to blame the user, got %v", err)
+	}
+}
+
+func TestLDAPAuthenticatorSignIn(t *testing.T) {
+	directory := newTestDirectory()
+	repository := newMemoryRepository()
+	authenticator := newTestLDAPAuthenticator(directory, repository)
+
+	token, err := authenticator.SignIn("alice", "secret", "")
+	if err != nil {
+		t.Fatalf("expected alice to sign in, got %v", err)
+	}
+
+	payload, err := newTestAuthenticator(repository).GetTokenPayload(token)
+	if err != nil {
+		t.Fatalf("expected a valid token, got %v", err)
+	}
+	user, err := repository.GetUserByIdentity("ldap", "uid=alice,ou=people,dc=example,dc=com")
+	if err != nil {
+		t.Fatalf("expected the DN to be linked, got %v", err)
+	}
+	if payload.UserID != user.ID || user.Email != "alice@example.com" {
+		t.Errorf("expected the token of the provisioned user, got user %d for %+v", payload.UserID, user)
+	}
+	if strings.Join(payload.Groups, ",") != "developers,admins" {
+		t.Errorf("expected the directory groups in the token, got %v", payload.Groups)
+	}
+
+	// The identity, not the email, finds the user on later sign-ins.
+	for _, attribute := range directory.entries[1].Attributes {
+		if attribute.Name == "mail" {
+			attribute.Values = []string{"alice@example.org"}
+		}
+	}
+	token, err = authenticator.SignIn("alice", "secret", "")
+	if err != nil {
+		t.Fatalf("expected alice to sign in again, got %v", err)
+	}
+	payload, err = newTestAuthenticator(repository).GetTokenPayload(token)
+	if err != nil {
+		t.Fatalf("expected a valid token, got %v", err)
+	}
+	if payload.UserID != user.ID || len(repository.users) != 1 {
+		t.Errorf("expected the same user to sign in, got user %d of %d", payload.UserID, len(repository.users))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+type MagicLink struct {
+	ID          int
+	Email       string
+	BrowserHash string
+	ExpiresAt   time.Time
+	UsedAt      *time.Time
+	CreatedAt   time.Time
+}
+
+type ErrMagicLinkNotFound string
+
+func (e ErrMagicLinkNotFound) Error() string {
+	return string(e)
+}
+
+type ErrMagicLinkInvalid string
+
+func (e ErrMagicLinkInvalid) Error() string {
+	return string(e)
+}
+
+type ErrRateLimited string
+
+func (e ErrRateLimited) Error() string {
+	return string(e)
+}
+
+// MagicLinkAuthenticator signs users in with single-use links mailed to
+// them. Each link is bound to the browser that asked for it by a secret kept
+// in a cookie for that link. When the link is opened elsewhere, e.g. on
+// another device, it is only accepted if sameBrowser is not required.
+type MagicLinkAuthenticator struct {
+	enabled         bool
+	sameBrowser     bool
+	repository      MagicLinkRepository
+	singleSignOn    SingleSignOn
+	mailer          Mailer
+	templates       MailTemplates
+	callbackURL     string
+	lifetime        time.Duration
+	rateLimit       int
+	rateLimitWindow time.Duration
+}
+
+func NewMagicLinkAuthenticator(
+	enabled bool,
+	sameBrowser bool,
+	repository MagicLinkRepository,
+	singleSignOn SingleSignOn,
+	mailer Mailer,
+	templates MailTemplates,
+	callbackURL string,
+	lifetime time.Duration,
+	rateLimit int,
+	rateLimitWindow time.Duration,
+) MagicLinkAuthenticator {
+	return MagicLinkAuthenticator{
+		enabled:         enabled,
+		sameBrowser:     sameBrowser,
+		repository:      repository,
+		singleSignOn:    singleSignOn,
+		mailer:          mailer,
+		templates:       templates,
+		callbackURL:     callbackURL,
+		lifetime:        lifetime,
+		rateLimit:       rateLimit,
+		rateLimitWindow: rateLimitWindow,
+	}
+}
+
+func (a MagicLinkAuthenticator) Enabled() bool {
+	return a.enabled
+}
+
+func (a MagicLinkAuthenticator) Lifetime() time.Duration {
+	return a.lifetime
+}
+
+// Send mails a sign-in link to email and returns the link with the secret
+// that binds it to the browser. Only hashes of the link token and the secret
+// are stored.
+func (a MagicLinkAuthenticator) Send(email string, invitationToken string) (MagicLink, string, error) {
+	if err := validateEmail(email); err != nil {
+		return MagicLink{}, "", err
+	}
+
+	count, err := a.repository.CountMagicLinks(email, time.Now().Add(-a.rateLimitWindow))
+	if err != nil {
+		return MagicLink{}, "", err
+	}
+	if count >= a.rateLimit {
+		return MagicLink{}, "", ErrRateLimited("too many sign-in links requested for this email, try again later")
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return MagicLink{}, "", err
+	}
+	browserSecret, err := generateToken()
+	if err != nil {
+		return MagicLink{}, "", err
+	}
+
+	link := MagicLink{
+		Email:       email,
+		BrowserHash: hashToken(browserSecret),
+		ExpiresAt:   time.Now().Add(a.lifetime),
+	}
+	link, err = a.repository.CreateMagicLink(link, hashToken(token))
+	if err != nil {
+		return MagicLink{}, "", err
+	}
+
+	q := url.Values{}
+	q.Add("token", token)
+	if len(invitationToken) > 0 {
+		q.Add("invitation", invitationToken)
+	}
+	data := struct {
+		Name     string
+		Email    string
+		Link     string
+		Lifetime time.Duration
+	}{
+		Email:    email,
+		Link:     fmt.Sprintf("%s?%s", a.callbackURL, q.Encode()),
+		Lifetime: a.lifetime,
+	}
+
+	m, err := a.templates.Render(MailMagicLink, email, data)
+	if err != nil {
+		return MagicLink{}, "", fmt.Errorf("failed to render mail: %v", err)
+	}
+	if err := a.mailer.Send(m); err != nil {
+		return MagicLink{}, "", err
+	}
+
+	return link, browserSecret, nil
+}
+
+// SignIn redeems the link token and returns a token for its user, who is
+// provisioned like a single sign-on user. browserSecrets are the secrets the
+// browser holds by link ID. The link is checked against the browser before
+// it is used, so a mail scanner opening it does not use it up when the same
+// browser is required.
+func (a MagicLinkAuthenticator) SignIn(token string, browserSecrets map[int]string, invitationToken string) (string, error) {
+	link, err := a.repository.GetMagicLinkByTokenHash(hashToken(token))
+	var linkNotFound ErrMagicLinkNotFound
+	if errors.As(err, &linkNotFound) {
+		return "", ErrMagicLinkInvalid("sign-in link is invalid")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if link.UsedAt != nil {
+		return "", ErrMagicLinkInvalid("sign-in link has already been used")
+	}
+	if link.ExpiresAt.Before(time.Now()) {
+		return "", ErrMagicLinkInvalid("sign-in link has expired")
+	}
+
+	browserSecret, ok := browserSecrets[link.ID]
+	if ok || a.sameBrowser {
+		if subtle.ConstantTimeCompare([]byte(hashToken(browserSecret)), []byte(link.BrowserHash)) != 1 {
+			return "", ErrSignInRejected{
+				Code:    SignInBrowserMismatch,
+				Message: "sign-in link must be opened in the browser that requested it",
+			}
+		}
+	}
+
+	err = a.repository.UseMagicLink(link.ID)
+	if errors.As(err, &linkNotFound) {
+		return "", ErrMagicLinkInvalid("sign-in link has already been used")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return a.singleSignOn.SignInUser(SingleSignOnUser{Email: link.Email}, invitationToken)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Mail is a message with a plain text and an HTML body.
+type Mail struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+var _ Mailer = (*SMTPMailer)(nil)
+var _ Mailer = (*FileMailer)(nil)
+var _ Mailer = (*LogMailer)(nil)
+
+// SMTPMailer sends mails through an SMTP server. The connection is upgraded
+// with STARTTLS when the server supports it.
+type SMTPMailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+}
+
+func NewSMTPMailer(
+	host string,
+	port int,
+	username string,
+	password string,
+	from string,
+) SMTPMailer {
+	return SMTPMailer{
+		host:     host,
+		port:     port,
+		username: username,
+		password: password,
+		from:     from,
+	}
+}
+
+func (m SMTPMailer) Send(mail Mail) error {
+	message, err := encodeMail(m.from, mail)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if len(m.username) > 0 {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+
+	address := fmt.Sprintf("%s:%d", m.host, m.port)
+	if err := smtp.SendMail(address, auth, m.from, []string{mail.To}, message); err != nil {
+		return fmt.Errorf("failed to send mail: %v", err)
+	}
+	return nil
+}
+
+// FileMailer writes mails as .eml files into a directory instead of sending
+// them, for development and tests.
+type FileMailer struct {
+	directory string
+	from      string
+}
+
+func NewFileMailer(directory string, from string) FileMailer {
+	return FileMailer{
+		directory: directory,
+		from:      from,
+	}
+}
+
+func (m FileMailer) Send(mail Mail) error {
+	message, err := encodeMail(m.from, mail)
+	if err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(suffix))
+	return ioutil.WriteFile(filepath.Join(m.directory, name), message, 0600)
+}
+
+// LogMailer logs the plain text of mails instead of sending them.
+type LogMailer struct{}
+
+func NewLogMailer() LogMailer {
+	return LogMailer{}
+}
+
+func (LogMailer) Send(mail Mail) error {
+	log.Printf("mail to %s: %s\n%s", mail.To, mail.Subject, mail.Text)
+	return nil
+}
+
+// encodeMail encodes the mail as multipart/alternative message.
+func encodeMail(from string, mail Mail) ([]byte, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", mail.Text},
+		{"text/html; charset=utf-8", mail.HTML},
+	}
+	for _, part := range parts {
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	header := &bytes.Buffer{}
+	fmt.Fprintf(header, "From: %s\r\n", from)
+	fmt.Fprintf(header, "To: %s\r\n", mail.To)
+	fmt.Fprintf(header, "Subject: %s\r\n", mimeEncodeHeader(mail.Subject))
+	fmt.Fprintf(header, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(header, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(header, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", writer.Boundary())
+
+	return append(header.Bytes(), body.Bytes()...), nil
+}
+
+func mimeEncodeHeader(value string) string {
+	value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+	for _, r := range value {
+		if r > 127 {
+			return fmt.Sprintf("=?utf-8?q?%s?=", strings.Replace(qpEncode(value), " ", "_", -1))
+		}
+	}
+	return value
+}
+
+func qpEncode(value string) string {
+	buf := &bytes.Buffer{}
+	w := quotedprintable.NewWriter(buf)
+	w.Write([]byte(value))
+	w.Close()
+	return strings.Replace(buf.String(), "=\r\n", "", -1)
+}
+
+const (
+	MailVerifyEmail   = "verify_email"
+	MailResetPassword = "reset_password"
+	MailMagicLink     = "magic_link"
+)
+
+// defaultMailTemplates hold the subject, text and HTML of each mail. The
+// subject is the first line of the text template.
+var defaultMailTemplates = map[string][2]string{
+	MailVerifyEmail: {
+		`Verify your email
+Hi{{if .Name}} {{.Name}}{{end}},
+
+please verify your email by opening this link:
+
+{{.Link}}
+
+The link expires in {{.Lifetime}}. If you did not sign up, you can ignore this mail.
+`,
+		`<p>Hi{{if .Name}} {{.Name}}{{end}},</p>
+<p>please verify your email by opening this link:</p>
+<p><a href="{{.Link}}">Verify email</a></p>
+<p>The link expires in {{.Lifetime}}. If you did not sign up, you can ignore this mail.</p>
+`,
+	},
+	MailResetPassword: {
+		`Reset your password
+Hi{{if .Name}} {{.Name}}{{end}},
+
+you can choose a new password by opening this link:
+
+{{.Link}}
+
+The link expires in {{.Lifetime}} and can be used once. If you did not ask to reset your password, you can ignore this mail.
+`,
+		`<p>Hi{{if .Name}} {{.Name}}{{end}},</p>
+<p>you can choose a new password by opening this link:</p>
+<p><a href="{{.Link}}">Reset password</a></p>
+<p>The link expires in {{.Lifetime}} and can be used once. If you did not ask to reset your password, you can ignore this mail.</p>
+`,
+	},
+	MailMagicLink: {
+		`Your sign-in link
+Hi,
+
+you can sign in as {{.Email}} by opening this link:
+
+{{.Link}}
+
+The link expires in {{.Lifetime}} and can be used once. If you did not ask to sign in, you can ignore this mail.
+`,
+		`<p>Hi,</p>
+<p>you can sign in as {{.Email}} by opening this link:</p>
+<p><a href="{{.Link}}">Sign in</a></p>
+<p>The link expires in {{.Lifetime}} and can be used once. If you did not ask to sign in, you can ignore this mail.</p>
+`,
+	},
+}
+
+// MailTemplates render mails from a text template, whose first line is the
+// subject, and an HTML template. The defaults can be replaced by placing
+// {name}.txt and {name}.html files into a directory.
+type MailTemplates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+func NewMailTemplates(directory string) (MailTemplates, error) {
+	templates := MailTemplates{
+		text: map[string]*texttemplate.Template{},
+		html: map[string]*htmltemplate.Template{},
+	}
+
+	for name, sources := range defaultMailTemplates {
+		text, html := sources[0], sources[1]
+		if len(directory) > 0 {
+			var err error
+			if text, err = readMailTemplate(directory, name+".txt", text); err != nil {
+				return MailTemplates{}, err
+			}
+			if html, err = readMailTemplate(directory, name+".html", html); err != nil {
+				return MailTemplates{}, err
+			}
+		}
+
+		textTemplate, err := texttemplate.New(name).Parse(text)
+		if err != nil {
+			return MailTemplates{}, fmt.Errorf("invalid text template %s: %v", name, err)
+		}
+		htmlTemplate, err := htmltemplate.New(name).Parse(html)
+		if err != nil {
+			return MailTemplates{}, fmt.Errorf("invalid html template %s: %v", name, err)
+		}
+
+		templates.text[name] = textTemplate
+		templates.html[name] = htmlTemplate
+	}
+
+	return templates, nil
+}
+
+func readMailTemplate(directory string, file string, fallback string) (string, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(directory, file))
+	if os.IsNotExist(err) {
+		return fallback, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read mail template: %v", err)
+	}
+	return string(buf), nil
+}
+
+func (t MailTemplates) Render(name string, to string, data interface{}) (Mail, error) {
+	textTemplate, ok := t.text[name]
+	if !ok {
+		return Mail{}, fmt.Errorf("unknown mail template %s", name)
+	}
+
+	text := &bytes.Buffer{}
+	if err := textTemplate.Execute(text, data); err != nil {
+		return Mail{}, err
+	}
+
+	html := &bytes.Buffer{}
+	if err := t.html[name].Execute(html, data); err != nil {
+		return Mail{}, err
+	}
+
+	lines := strings.SplitN(text.String(), "\n", 2)
+	if len(lines) < 2 {
+		return Mail{}, fmt.Errorf("mail template %s has no body", name)
+	}
+
+	return Mail{
+		To:      to,
+		Subject: strings.TrimSpace(lines[0]),
+		Text:    lines[1],
+		HTML:    html.String(),
+	}, nil
+}
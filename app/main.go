@@ -10,7 +10,7 @@ import (
 var verbose bool
 
 var rootCmd = &cobra.Command{
-	Use:   "single-sign-on",
+	Use:   "sso",
 	Short: "Example of Single Sign-On (SSO)",
 }
 
@@ -22,9 +22,18 @@ var startCmd = &cobra.Command{
 	},
 }
 
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Start authenticating reverse proxy",
+	Run: func(cmd *cobra.Command, args []string) {
+		StartProxy()
+	},
+}
+
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
 	rootCmd.AddCommand(startCmd)
+	rootCmd.AddCommand(proxyCmd)
 }
 
 func main() {
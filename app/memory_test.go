@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var _ Repository = (*memoryRepository)(nil)
+
+// memoryRepository keeps users and their roles in memory for tests. It has
+// the admin and member roles of the migrations.
+type memoryRepository struct {
+	users            map[int]User
+	passwordHashes   map[int]string
+	identities       map[string]int
+	roles            map[int][]string
+	roleDefinitions  []Role
+	tokensValidAfter map[int]time.Time
+	passwordFailures map[int][]time.Time
+	usedTokenHashes  map[string]bool
+}
+
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{
+		users:          map[int]User{},
+		passwordHashes: map[int]string{},
+		identities:     map[string]int{},
+		roles:          map[int][]string{},
+		roleDefinitions: []Role{
+			{ID: 1, Name: adminRole, Permissions: []string{
+				PermissionUsersRead,
+				PermissionUsersWrite,
+				PermissionRolesRead,
+				PermissionRolesWrite,
+				PermissionInvitationsWrite,
+			}},
+			{ID: 2, Name: "member", Permissions: []string{}},
+		},
+		tokensValidAfter: map[int]time.Time{},
+		passwordFailures: map[int][]time.Time{},
+		usedTokenHashes:  map[string]bool{},
+	}
+}
+
+// newTestSingleSignOnFactory creates single sign-ons backed by repository,
+// without invitations, organizations or sign-up restrictions.
+func newTestSingleSignOnFactory(repository *memoryRepository) SingleSignOnFactory {
+	invitationManager := NewInvitationManager(nil, time.Hour)
+	return NewSingleSignOnFactory(
+		newTestAuthenticator(repository),
+		repository,
+		invitationManager,
+		NewRoleManager(repository, "", nil),
+		NewOrganizationManager(nil, invitationManager),
+		NewSignUpPolicy(nil, nil, nil, false),
+	)
+}
+
+func newTestAuthenticator(repository *memoryRepository) Authenticator {
+	return NewAuthenticator(NewJWT([]byte("secret")), time.Hour, repository, repository)
+}
+
+func (r *memoryRepository) GetUserByID(id int) (User, error) {
+	user, ok := r.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound(fmt.Sprintf("user with id %d not found", id))
+	}
+	return user, nil
+}
+
+func (r *memoryRepository) GetUserByEmail(email string) (User, error) {
+	for _, user := range r.users {
+		if strings.EqualFold(user.Email, email) {
+			return user, nil
+		}
+	}
+	return User{}, ErrUserNotFound(fmt.Sprintf("user with email %s not found", email))
+}
+
+func (r *memoryRepository) CreateUser(user User) (User, error) {
+	if _, err := r.GetUserByEmail(user.Email); err == nil {
+		return User{}, ErrUserExists(fmt.Sprintf("user with email %s already exists", user.Email))
+	}
+
+	user.ID = len(r.users) + 1
+	user.Email = strings.ToLower(user.Email)
+	r.users[user.ID] = user
+	return user, nil
+}
+
+func (r *memoryRepository) GetUserByIdentity(provider string, subject string) (User, error) {
+	userID, ok := r.identities[provider+" "+subject]
+	if !ok {
+		return User{}, ErrUserNotFound(fmt.Sprintf("user with %s identity %s not found", provider, subject))
+	}
+	return r.GetUserByID(userID)
+}
+
+func (r *memoryRepository) LinkUserIdentity(userID int, provider string, subject string) error {
+	if _, ok := r.identities[provider+" "+subject]; !ok {
+		r.identities[provider+" "+subject] = userID
+	}
+	return nil
+}
+
+func (r *memoryRepository) GetUserPasswordHash(userID int) (string, error) {
+	if _, err := r.GetUserByID(userID); err != nil {
+		return "", err
+	}
+	return r.passwordHashes[userID], nil
+}
+
+func (r *memoryRepository) SetUserPasswordHash(userID int, passwordHash string) error {
+	r.passwordHashes[userID] = passwordHash
+	return nil
+}
+
+func (r *memoryRepository) SetUserEmailVerified(userID int) error {
+	user := r.users[userID]
+	user.EmailVerified = true
+	r.users[userID] = user
+	return nil
+}
+
+func (r *memoryRepository) ClaimUnverifiedUser(userID int, tokensValidAfter time.Time) error {
+	for key, id := range r.identities {
+		if id == userID {
+			delete(r.identities, key)
+		}
+	}
+
+	user := r.users[userID]
+	user.EmailVerified = true
+	user.MFAEnabled = false
+	r.users[userID] = user
+	r.passwordHashes[userID] = ""
+	delete(r.roles, userID)
+	r.tokensValidAfter[userID] = tokensValidAfter
+	return nil
+}
+
+func (r *memoryRepository) GetUserTokensValidAfter(userID int) (time.Time, error) {
+	if _, err := r.GetUserByID(userID); err != nil {
+		return time.Time{}, err
+	}
+	return r.tokensValidAfter[userID], nil
+}
+
+func (r *memoryRepository) RevokeUserTokens(userID int, validAfter time.Time) error {
+	r.tokensValidAfter[userID] = validAfter
+	return nil
+}
+
+func (r *memoryRepository) CountPasswordFailures(userID int, since time.Time) (int, error) {
+	count := 0
+	for _, failedAt := range r.passwordFailures[userID] {
+		if !failedAt.Before(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *memoryRepository) RecordPasswordFailure(userID int, lockoutStart time.Time) error {
+	r.passwordFailures[userID] = append(r.passwordFailures[userID], time.Now())
+	return nil
+}
+
+func (r *memoryRepository) ResetPasswordFailures(userID int) error {
+	delete(r.passwordFailures, userID)
+	return nil
+}
+
+func (r *memoryRepository) UseMFAPendingToken(tokenHash string, expiresAt time.Time) error {
+	if r.usedTokenHashes[tokenHash] {
+		return ErrMFAPendingTokenUsed("mfa_pending token was used already")
+	}
+	r.usedTokenHashes[tokenHash] = true
+	return nil
+}
+
+func (r *memoryRepository) GetRoles() ([]Role, error) {
+	return r.roleDefinitions, nil
+}
+
+func (r *memoryRepository) GetRoleByName(name string) (Role, error) {
+	for _, role := range r.roleDefinitions {
+		if role.Name == name {
+			return role, nil
+		}
+	}
+	return Role{}, ErrRoleNotFound(fmt.Sprintf("role %s not found", name))
+}
+
+func (r *memoryRepository) CreateRole(role Role) (Role, error) {
+	role.ID = len(r.roleDefinitions) + 1
+	r.roleDefinitions = append(r.roleDefinitions, role)
+	return role, nil
+}
+
+func (r *memoryRepository) GetUserRoleNames(userID int) ([]string, error) {
+	return r.roles[userID], nil
+}
+
+func (r *memoryRepository) AssignRole(userID int, roleID int) error {
+	for _, role := range r.roleDefinitions {
+		if role.ID == roleID && !contains(r.roles[userID], role.Name) {
+			r.roles[userID] = append(r.roles[userID], role.Name)
+		}
+	}
+	return nil
+}
+
+func (r *memoryRepository) UnassignRole(userID int, roleID int) error {
+	roles := []string{}
+	for _, name := range r.roles[userID] {
+		if role, _ := r.GetRoleByName(name); role.ID != roleID {
+			roles = append(roles, name)
+		}
+	}
+	r.roles[userID] = roles
+	return nil
+}
+
+func (r *memoryRepository) GetRolePermissions(roleNames []string) ([]string, error) {
+	permissions := []string{}
+	for _, role := range r.roleDefinitions {
+		if contains(roleNames, role.Name) {
+			permissions = append(permissions, role.Permissions...)
+		}
+	}
+	return permissions, nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters as expected by common authenticator apps (RFC 6238).
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of periods a code may be early or late.
+	totpSkew = 1
+
+	totpMaxFailedAttempts = 5
+	totpLockout           = 15 * time.Minute
+)
+
+// recoveryCodeCount codes of 10 base32 characters, i.e. 50 random bits, are
+// generated per set.
+const recoveryCodeCount = 10
+
+// UserTOTP is the TOTP enrollment of a user. The secret is encrypted and
+// the enrollment only counts once it has been confirmed with a code.
+type UserTOTP struct {
+	UserID         int
+	Secret         []byte
+	ConfirmedAt    *time.Time
+	LastStep       int64
+	FailedAttempts int
+	LastFailedAt   *time.Time
+}
+
+type ErrTOTPNotFound string
+
+func (e ErrTOTPNotFound) Error() string {
+	return string(e)
+}
+
+type ErrMFAAlreadyEnabled string
+
+func (e ErrMFAAlreadyEnabled) Error() string {
+	return string(e)
+}
+
+type ErrMFANotEnabled string
+
+func (e ErrMFANotEnabled) Error() string {
+	return string(e)
+}
+
+type ErrRecoveryCodeNotFound string
+
+func (e ErrRecoveryCodeNotFound) Error() string {
+	return string(e)
+}
+
+// RecoveryCode is a single-use code to pass multi-factor authentication
+// without the second factor. Only its hash is stored, so the code itself is
+// shown once after generating it.
+type RecoveryCode struct {
+	ID        int        `json:"id"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// RecoveryCodeUse records that the user signed in or disabled TOTP with a
+// recovery code. Uses are kept after the codes are replaced or removed, so
+// users can tell whether someone else used their codes.
+type RecoveryCodeUse struct {
+	ID     int       `json:"id"`
+	UsedAt time.Time `json:"used_at"`
+}
+
+// MFAManager enrolls users for TOTP and completes sign-ins that are pending
+// the second factor.
+type MFAManager struct {
+	repository    MFARepository
+	authenticator Authenticator
+	secretBox     SecretBox
+	issuer        string
+}
+
+func NewMFAManager(
+	repository MFARepository,
+	authenticator Authenticator,
+	secretBox SecretBox,
+	issuer string,
+) MFAManager {
+	return MFAManager{
+		repository:    repository,
+		authenticator: authenticator,
+		secretBox:     secretBox,
+		issuer:        issuer,
+	}
+}
+
+// EnrollTOTP generates a new secret for the user and returns it together
+// with its otpauth:// provisioning URI, which authenticator apps scan as QR
+// code. The secret is used once ConfirmTOTP succeeds.
+func (m MFAManager) EnrollTOTP(user User) (string, string, error) {
+	if err := m.checkNotConfirmed(user.ID); err != nil {
+		return "", "", err
+	}
+
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+
+	encryptedSecret, err := m.secretBox.Seal([]byte(secret))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encrypt secret: %v", err)
+	}
+
+	if err := m.repository.SaveUserTOTP(user.ID, encryptedSecret); err != nil {
+		return "", "", err
+	}
+
+	return secret, m.provisioningURI(user, secret), nil
+}
+
+func (m MFAManager) provisioningURI(user User, secret string) string {
+	q := url.Values{}
+	q.Add("secret", secret)
+	q.Add("issuer", m.issuer)
+	q.Add("algorithm", "SHA1")
+	q.Add("digits", fmt.Sprint(totpDigits))
+	q.Add("period", fmt.Sprint(totpPeriod))
+
+	label := url.PathEscape(fmt.Sprintf("%s:%s", m.issuer, user.Email))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, q.Encode())
+}
+
+// ConfirmTOTP enables multi-factor authentication once the user proved to
+// have set up the secret by entering a code.
+func (m MFAManager) ConfirmTOTP(user User, code string) error {
+	if err := m.checkNotConfirmed(user.ID); err != nil {
+		return err
+	}
+
+	if err := m.checkCode(user.ID, code); err != nil {
+		return err
+	}
+
+	return m.repository.ConfirmUserTOTP(user.ID)
+}
+
+// checkNotConfirmed rejects enrolling again while a confirmed TOTP exists.
+// Multi-factor authentication may be enabled by WebAuthn credentials alone.
+func (m MFAManager) checkNotConfirmed(userID int) error {
+	totp, err := m.repository.GetUserTOTP(userID)
+	var totpNotFound ErrTOTPNotFound
+	if errors.As(err, &totpNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if totp.ConfirmedAt != nil {
+		return ErrMFAAlreadyEnabled("totp is already enabled")
+	}
+	return nil
+}
+
+// DisableTOTP removes the TOTP enrollment, which requires a current code or
+// a recovery code. If it was the last factor, the recovery codes are removed
+// as well.
+func (m MFAManager) DisableTOTP(user User, code string, recoveryCode string) error {
+	if err := m.checkFactor(user.ID, code, recoveryCode); err != nil {
+		return err
+	}
+
+	return m.repository.DeleteUserTOTP(user.ID)
+}
+
+// Verify completes a sign-in pending the second factor with a TOTP code or a
+// recovery code and returns the token of the sign-in. Sign-ins completed with
+// a recovery code only get mfa, without otp, so they can be told apart.
+func (m MFAManager) Verify(pendingToken string, code string, recoveryCode string) (string, error) {
+	payload, err := m.authenticator.GetMFAPendingPayload(pendingToken)
+	if err != nil {
+		return "", ErrInvalidCredentials(fmt.Sprintf("invalid mfa_pending token: %v", err))
+	}
+
+	if err := m.checkFactor(payload.UserID, code, recoveryCode); err != nil {
+		return "", err
+	}
+	if err := m.authenticator.UseMFAPendingToken(pendingToken, payload); err != nil {
+		return "", ErrInvalidCredentials(fmt.Sprintf("invalid mfa_pending token: %v", err))
+	}
+
+	amr := appendAMR(payload.AMR, AMROTP, AMRMFA)
+	if len(recoveryCode) > 0 {
+		amr = appendAMR(payload.AMR, AMRMFA)
+	}
+	return m.authenticator.CreateToken(payload.UserID, payload.Groups, amr)
+}
+
+// GenerateRecoveryCodes returns a new set of recovery codes, which replaces
+// the previous one.
+func (m MFAManager) GenerateRecoveryCodes(user User) ([]string, error) {
+	if !user.MFAEnabled {
+		return nil, ErrMFANotEnabled("multi-factor authentication is not enabled")
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	codeHashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 10)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		code := base32.StdEncoding.EncodeToString(buf)[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		codeHashes = append(codeHashes, hashToken(code))
+	}
+
+	if err := m.repository.ReplaceRecoveryCodes(user.ID, codeHashes); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// GetRecoveryCodes lists the current set of recovery codes and when they
+// were used, without the codes.
+func (m MFAManager) GetRecoveryCodes(user User) ([]RecoveryCode, error) {
+	return m.repository.GetRecoveryCodes(user.ID)
+}
+
+// GetRecoveryCodeUses lists when the user used recovery codes, latest
+// first.
+func (m MFAManager) GetRecoveryCodeUses(user User) ([]RecoveryCodeUse, error) {
+	return m.repository.GetRecoveryCodeUses(user.ID)
+}
+
+// checkFactor checks the recovery code if one is given and the TOTP code
+// otherwise.
+func (m MFAManager) checkFactor(userID int, code string, recoveryCode string) error {
+	if len(recoveryCode) > 0 {
+		return m.checkRecoveryCode(userID, recoveryCode)
+	}
+	return m.checkCode(userID, code)
+}
+
+// checkRecoveryCode uses up a recovery code of the user. Spaces, dashes and
+// case are ignored.
+func (m MFAManager) checkRecoveryCode(userID int, recoveryCode string) error {
+	code := strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(recoveryCode))
+
+	err := m.repository.UseRecoveryCode(userID, hashToken(code))
+	var recoveryCodeNotFound ErrRecoveryCodeNotFound
+	if errors.As(err, &recoveryCodeNotFound) {
+		return ErrInvalidCredentials("invalid recovery code")
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("user %d used a recovery code", userID)
+	return nil
+}
+
+// checkCode accepts a code of the user's secret once. Codes are rejected
+// for a while after too many wrong ones.
+func (m MFAManager) checkCode(userID int, code string) error {
+	totp, err := m.repository.GetUserTOTP(userID)
+	var totpNotFound ErrTOTPNotFound
+	if errors.As(err, &totpNotFound) {
+		return ErrTOTPNotFound("no totp enrolled")
+	}
+	if err != nil {
+		return err
+	}
+
+	if totp.FailedAttempts >= totpMaxFailedAttempts &&
+		totp.LastFailedAt != nil && totp.LastFailedAt.Add(totpLockout).After(time.Now()) {
+		return ErrRateLimited("too many wrong codes, try again later")
+	}
+
+	secret, err := m.secretBox.Open(totp.Secret)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt secret: %v", err)
+	}
+
+	step, ok := matchTOTP(string(secret), strings.TrimSpace(code), time.Now())
+	if ok && step > totp.LastStep {
+		err := m.repository.UseTOTPStep(userID, step)
+		if err == nil {
+			return nil
+		}
+		// Another request used the code first.
+		if !errors.As(err, &totpNotFound) {
+			return err
+		}
+	}
+
+	if err := m.repository.RecordTOTPFailure(userID, time.Now().Add(-totpLockout)); err != nil {
+		return err
+	}
+	return ErrInvalidCredentials("invalid code")
+}
+
+// matchTOTP returns the time step whose code matches, allowing for clocks
+// that are off by totpSkew periods.
+func matchTOTP(secret string, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode computes the HOTP value of RFC 4226 for a time step.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+var _ MFARepository = (*memoryMFARepository)(nil)
+
+// memoryMFARepository keeps TOTP enrollments and recovery codes in memory
+// for tests.
+type memoryMFARepository struct {
+	totps            map[int]UserTOTP
+	recoveryCodes    map[int]map[string]*time.Time
+	recoveryCodeUses map[int][]RecoveryCodeUse
+}
+
+func newMemoryMFARepository() *memoryMFARepository {
+	return &memoryMFARepository{
+		totps:            map[int]UserTOTP{},
+		recoveryCodes:    map[int]map[string]*time.Time{},
+		recoveryCodeUses: map[int][]RecoveryCodeUse{},
+	}
+}
+
+func (r *memoryMFARepository) GetUserTOTP(userID int) (UserTOTP, error) {
+	totp, ok := r.totps[userID]
+	if !ok {
+		return UserTOTP{}, ErrTOTPNotFound(fmt.Sprintf("totp of user %d not found", userID))
+	}
+	return totp, nil
+}
+
+func (r *memoryMFARepository) SaveUserTOTP(userID int, secret []byte) error {
+	r.totps[userID] = UserTOTP{UserID: userID, Secret: secret}
+	return nil
+}
+
+func (r *memoryMFARepository) ConfirmUserTOTP(userID int) error {
+	totp := r.totps[userID]
+	now := time.Now()
+	totp.ConfirmedAt = &now
+	r.totps[userID] = totp
+	return nil
+}
+
+func (r *memoryMFARepository) DeleteUserTOTP(userID int) error {
+	delete(r.totps, userID)
+	return nil
+}
+
+func (r *memoryMFARepository) UseTOTPStep(userID int, step int64) error {
+	totp, ok := r.totps[userID]
+	if !ok || totp.LastStep >= step {
+		return ErrTOTPNotFound(fmt.Sprintf("totp of user %d before step %d not found", userID, step))
+	}
+	totp.LastStep = step
+	totp.FailedAttempts = 0
+	r.totps[userID] = totp
+	return nil
+}
+
+func (r *memoryMFARepository) RecordTOTPFailure(userID int, lockoutStart time.Time) error {
+	totp := r.totps[userID]
+	if totp.LastFailedAt == nil || totp.LastFailedAt.Before(lockoutStart) {
+		totp.FailedAttempts = 0
+	}
+	now := time.Now()
+	totp.FailedAttempts++
+	totp.LastFailedAt = &now
+	r.totps[userID] = totp
+	return nil
+}
+
+func (r *memoryMFARepository) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	r.recoveryCodes[userID] = map[string]*time.Time{}
+	for _, codeHash := range codeHashes {
+		r.recoveryCodes[userID][codeHash] = nil
+	}
+	return nil
+}
+
+func (r *memoryMFARepository) GetRecoveryCodes(userID int) ([]RecoveryCode, error) {
+	codes := []RecoveryCode{}
+	for _, usedAt := range r.recoveryCodes[userID] {
+		codes = append(codes, RecoveryCode{UsedAt: usedAt})
+	}
+	return codes, nil
+}
+
+func (r *memoryMFARepository) UseRecoveryCode(userID int, codeHash string) error {
+	usedAt, ok := r.recoveryCodes[userID][codeHash]
+	if !ok || usedAt != nil {
+		return ErrRecoveryCodeNotFound("unused recovery code not found")
+	}
+	now := time.Now()
+	r.recoveryCodes[userID][codeHash] = &now
+	use := RecoveryCodeUse{ID: len(r.recoveryCodeUses[userID]) + 1, UsedAt: now}
+	r.recoveryCodeUses[userID] = append([]RecoveryCodeUse{use}, r.recoveryCodeUses[userID]...)
+	return nil
+}
+
+func (r *memoryMFARepository) GetRecoveryCodeUses(userID int) ([]RecoveryCodeUse, error) {
+	return r.recoveryCodeUses[userID], nil
+}
+
+func newTestMFAManager(t *testing.T, repository *memoryRepository) (MFAManager, *memoryMFARepository) {
+	secretBox, err := NewSecretBox(base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfaRepository := newMemoryMFARepository()
+	return NewMFAManager(mfaRepository, newTestAuthenticator(repository), secretBox, "SSO"), mfaRepository
+}
+
+func TestMFAManagerVerifyUsesPendingTokenOnce(t *testing.T) {
+	repository := newMemoryRepository()
+	user, _ := repository.CreateUser(User{Email: "alice@example.com", EmailVerified: true, MFAEnabled: true})
+	manager, _ := newTestMFAManager(t, repository)
+
+	codes, err := manager.GenerateRecoveryCodes(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pendingToken, err := manager.authenticator.CreateMFAPendingToken(user.ID, nil, []string{AMRPassword})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := manager.Verify(pendingToken, "", "wrong-code"); err == nil {
+		t.Fatal("expected the wrong recovery code to be rejected")
+	}
+	if _, err := manager.Verify(pendingToken, "", codes[0]); err != nil {
+		t.Fatalf("expected the pending token to still be usable after a wrong code, got %v", err)
+	}
+
+	var invalidCredentials ErrInvalidCredentials
+	if _, err := manager.Verify(pendingToken, "", codes[1]); !errors.As(err, &invalidCredentials) {
+		t.Errorf("expected the used pending token to be rejected, got %v", err)
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	now := time.Unix(1600000000, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		step  int64
+		match bool
+	}{
+		{current, true},
+		{current - totpSkew, true},
+		{current + totpSkew, true},
+		{current - totpSkew - 1, false},
+		{current + totpSkew + 1, false},
+	}
+	for _, test := range tests {
+		code, err := totpCode(secret, test.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := matchTOTP(secret, code, now)
+		if ok != test.match || (ok && step != test.step) {
+			t.Errorf("step %d: expected match %v, got step %d, %v", test.step-current, test.match, step-current, ok)
+		}
+	}
+
+	for _, code := range []string{"", "12345", "1234567"} {
+		if _, ok := matchTOTP(secret, code, now); ok {
+			t.Errorf("expected %q to be rejected", code)
+		}
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238, truncated to 6 digits.
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	tests := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range tests {
+		code, err := totpCode(secret, unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != expected {
+			t.Errorf("%d: expected %s, got %s", unix, expected, code)
+		}
+	}
+}
+
+func TestMFAManagerRejectsReplayedCode(t *testing.T) {
+	repository := newMemoryRepository()
+	user, _ := repository.CreateUser(User{Email: "alice@example.com", EmailVerified: true})
+	manager, mfaRepository := newTestMFAManager(t, repository)
+
+	secret, _, err := manager.EnrollTOTP(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totpCode(secret, time.Now().Unix()/totpPeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.ConfirmTOTP(user, code); err != nil {
+		t.Fatal(err)
+	}
+
+	var invalidCredentials ErrInvalidCredentials
+	if err := manager.checkCode(user.ID, code); !errors.As(err, &invalidCredentials) {
+		t.Errorf("expected the used code to be rejected, got %v", err)
+	}
+
+	// Codes of earlier steps are rejected as well once a later one was used.
+	earlier, err := totpCode(secret, time.Now().Unix()/totpPeriod-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.checkCode(user.ID, earlier); !errors.As(err, &invalidCredentials) {
+		t.Errorf("expected the code of an earlier step to be rejected, got %v", err)
+	}
+	if totp, _ := mfaRepository.GetUserTOTP(user.ID); totp.FailedAttempts != 2 {
+		t.Errorf("expected the replays to count as failures, got %d", totp.FailedAttempts)
+	}
+}
+
+func TestMFAManagerKeepsRecoveryCodeUses(t *testing.T) {
+	repository := newMemoryRepository()
+	user, _ := repository.CreateUser(User{Email: "alice@example.com", EmailVerified: true, MFAEnabled: true})
+	manager, _ := newTestMFAManager(t, repository)
+
+	codes, err := manager.GenerateRecoveryCodes(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.checkRecoveryCode(user.ID, codes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.checkRecoveryCode(user.ID, codes[0]); err == nil {
+		t.Fatal("expected the used recovery code to be rejected")
+	}
+	if _, err := manager.GenerateRecoveryCodes(user); err != nil {
+		t.Fatal(err)
+	}
+
+	uses, err := manager.GetRecoveryCodeUses(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uses) != 1 {
+		t.Errorf("expected the use to be kept after generating codes again, got %+v", uses)
+	}
+}
+
+func TestMFAManagerNormalizesRecoveryCodes(t *testing.T) {
+	repository := newMemoryRepository()
+	user, _ := repository.CreateUser(User{Email: "alice@example.com", EmailVerified: true, MFAEnabled: true})
+	manager, _ := newTestMFAManager(t, repository)
+
+	codes, err := manager.GenerateRecoveryCodes(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		code  string
+		valid bool
+	}{
+		{codes[0], true},
+		{strings.ToLower(codes[1]), true},
+		{strings.Replace(codes[2], "-", "", 1), true},
+		{" " + strings.Replace(codes[3], "-", " - ", 1) + " ", true},
+		{strings.Replace(codes[4], "-", "--", 1), true},
+		{codes[5] + "A", false},
+		{codes[6][1:], false},
+		{strings.Replace(codes[7], "-", "_", 1), false},
+	}
+	for _, test := range tests {
+		err := manager.checkRecoveryCode(user.ID, test.code)
+		if test.valid && err != nil {
+			t.Errorf("%q: expected the code to be accepted, got %v", test.code, err)
+		}
+		var invalidCredentials ErrInvalidCredentials
+		if !test.valid && !errors.As(err, &invalidCredentials) {
+			t.Errorf("%q: expected the code to be rejected, got %v", test.code, err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// microsoftPersonalTenantID is the tenant of personal Microsoft accounts.
+const microsoftPersonalTenantID = "9188040d-6c67-4c5b-b112-36a304b66dad"
+
+var _ IdentityProvider = (*MicrosoftIdentityProvider)(nil)
+
+// MicrosoftIdentityProvider signs in with Microsoft Entra ID (Azure AD).
+// The tenant is either "common" (work and personal accounts),
+// "organizations" (work accounts only), "consumers" or a tenant id or domain.
+type MicrosoftIdentityProvider struct {
+	clientID       string
+	clientSecret   string
+	redirectURI    string
+	tenant         string
+	allowedTenants []string
+	scopes         []string
+	keySet         *OIDCKeySet
+}
+
+func NewMicrosoftIdentityProvider(
+	clientID string,
+	clientSecret string,
+	redirectURI string,
+	tenant string,
+	allowedTenants []string,
+) MicrosoftIdentityProvider {
+	if len(tenant) < 1 {
+		tenant = "common"
+	}
+
+	return MicrosoftIdentityProvider{
+		clientID:       clientID,
+		clientSecret:   clientSecret,
+		redirectURI:    redirectURI,
+		tenant:         tenant,
+		allowedTenants: lowerAll(allowedTenants),
+		scopes:         []string{"openid", "profile", "email"},
+		keySet:         NewOIDCKeySet(fmt.Sprintf("https://login.microsoftonline.com/%s/discovery/v2.0/keys", url.PathEscape(tenant))),
+	}
+}
+
+// GetAuthorizationURL passes all options, which Microsoft supports as OpenID
+// Connect provider.
+func (m MicrosoftIdentityProvider) GetAuthorizationURL(options AuthorizationOptions) (string, error) {
+	u, err := url.Parse(m.endpoint("authorize"))
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{}
+	q.Add("client_id", m.clientID)
+	q.Add("redirect_uri", m.redirectURI)
+	q.Add("response_type", "code")
+	q.Add("response_mode", "query")
+	q.Add("scope", strings.Join(m.scopes, " "))
+	addParams(q, options.openIDConnectParams(), "prompt", "login_hint", "max_age", "ui_locales")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// GetIdentityToken exchanges the code for an OpenID Connect ID token.
+func (m MicrosoftIdentityProvider) GetIdentityToken(code string) (string, error) {
+	u, err := url.Parse(m.endpoint("token"))
+	if err != nil {
+		return "", err
+	}
+
+	body := url.Values{}
+	body.Add("client_id", m.clientID)
+	body.Add("client_secret", m.clientSecret)
+	body.Add("code", code)
+	body.Add("grant_type", "authorization_code")
+	body.Add("redirect_uri", m.redirectURI)
+	body.Add("scope", strings.Join(m.scopes, " "))
+
+	headers := map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	}
+
+	res := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := DefaultHttpClient.HttpRequestJson(http.MethodPost, u.String(), headers, body.Encode(), &res); err != nil {
+		return "", err
+	}
+
+	if len(res.IDToken) < 1 {
+		return "", errors.New("no id token received")
+	}
+
+	return res.IDToken, nil
+}
+
+func (m MicrosoftIdentityProvider) GetSingleSignOnUser(identityToken string) (SingleSignOnUser, error) {
+	claims, err := m.keySet.VerifyIDToken(identityToken, m.clientID)
+	if err != nil {
+		return SingleSignOnUser{}, err
+	}
+
+	tenantID, _ := claims["tid"].(string)
+	objectID, _ := claims["oid"].(string)
+	if len(tenantID) < 1 || len(objectID) < 1 {
+		return SingleSignOnUser{}, errors.New("id token is missing tid or oid")
+	}
+
+	issuer, _ := claims["iss"].(string)
+	if issuer != fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0", tenantID) {
+		return SingleSignOnUser{}, fmt.Errorf("unexpected issuer: %s", issuer)
+	}
+
+	if err := m.checkTenant(strings.ToLower(tenantID)); err != nil {
+		return SingleSignOnUser{}, err
+	}
+
+	// Users can set email and preferred_username of work accounts to any
+	// address, so the email is only used when the domain of the email is
+	// verified by its tenant (xms_edov) or Microsoft owns the account.
+	// Otherwise the user can only sign in by tid:oid.
+	email := ""
+	if tenantID == microsoftPersonalTenantID || microsoftEmailDomainVerified(claims["xms_edov"]) {
+		email, _ = claims["email"].(string)
+	}
+	name, _ := claims["name"].(string)
+
+	return SingleSignOnUser{
+		Subject: fmt.Sprintf("%s:%s", tenantID, objectID),
+		Email:   email,
+		Name:    name,
+	}, nil
+}
+
+// microsoftEmailDomainVerified reads the xms_edov optional claim, which is
+// either a boolean or a string.
+func microsoftEmailDomainVerified(claim interface{}) bool {
+	switch value := claim.(type) {
+	case bool:
+		return value
+	case string:
+		return value == "1" || strings.EqualFold(value, "true")
+	default:
+		return false
+	}
+}
+
+func (m MicrosoftIdentityProvider) checkTenant(tenantID string) error {
+	switch m.tenant {
+	case "organizations":
+		if tenantID == microsoftPersonalTenantID {
+			return errors.New("personal microsoft accounts are not allowed")
+		}
+	case "consumers":
+		if tenantID != microsoftPersonalTenantID {
+			return errors.New("work microsoft accounts are not allowed")
+		}
+	}
+
+	if len(m.allowedTenants) > 0 && !contains(m.allowedTenants, tenantID) {
+		return fmt.Errorf("microsoft tenant %s is not allowed", tenantID)
+	}
+
+	return nil
+}
+
+func (m MicrosoftIdentityProvider) endpoint(name string) string {
+	return fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/%s", url.PathEscape(m.tenant), name)
+}
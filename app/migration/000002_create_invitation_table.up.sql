@@ -0,0 +1,11 @@
+CREATE TABLE "invitation"
+(
+   "id" SERIAL PRIMARY KEY,
+   "email" TEXT NOT NULL,
+   "role" TEXT NOT NULL DEFAULT '',
+   "token_hash" TEXT NOT NULL UNIQUE,
+   "created_by" INTEGER NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+   "expires_at" TIMESTAMPTZ NOT NULL,
+   "accepted_at" TIMESTAMPTZ,
+   "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
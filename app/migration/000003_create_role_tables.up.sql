@@ -0,0 +1,43 @@
+CREATE TABLE "role"
+(
+   "id" SERIAL PRIMARY KEY,
+   "name" TEXT NOT NULL UNIQUE,
+   "description" TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE "permission"
+(
+   "id" SERIAL PRIMARY KEY,
+   "name" TEXT NOT NULL UNIQUE,
+   "description" TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE "role_permission"
+(
+   "role_id" INTEGER NOT NULL REFERENCES "role" ("id") ON DELETE CASCADE,
+   "permission_id" INTEGER NOT NULL REFERENCES "permission" ("id") ON DELETE CASCADE,
+   PRIMARY KEY ("role_id", "permission_id")
+);
+
+CREATE TABLE "user_role"
+(
+   "user_id" INTEGER NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+   "role_id" INTEGER NOT NULL REFERENCES "role" ("id") ON DELETE CASCADE,
+   PRIMARY KEY ("user_id", "role_id")
+);
+
+INSERT INTO "permission" ("name", "description") VALUES
+   ('users:read', 'View users'),
+   ('users:write', 'Manage users'),
+   ('roles:read', 'View roles and their permissions'),
+   ('roles:write', 'Manage roles and role assignments'),
+   ('invitations:write', 'Invite users');
+
+INSERT INTO "role" ("name", "description") VALUES
+   ('admin', 'Full access'),
+   ('member', 'Regular user');
+
+INSERT INTO "role_permission" ("role_id", "permission_id")
+SELECT "role"."id", "permission"."id"
+FROM "role" CROSS JOIN "permission"
+WHERE "role"."name" = 'admin';
@@ -0,0 +1,6 @@
+ALTER TABLE "invitation"
+   DROP COLUMN "organization_role",
+   DROP COLUMN "organization_id";
+
+DROP TABLE "organization_member";
+DROP TABLE "organization";
@@ -0,0 +1,20 @@
+CREATE TABLE "organization"
+(
+   "id" SERIAL PRIMARY KEY,
+   "name" TEXT NOT NULL,
+   "slug" TEXT NOT NULL UNIQUE,
+   "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE "organization_member"
+(
+   "organization_id" INTEGER NOT NULL REFERENCES "organization" ("id") ON DELETE CASCADE,
+   "user_id" INTEGER NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+   "role" TEXT NOT NULL CHECK ("role" IN ('owner', 'admin', 'member')),
+   "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+   PRIMARY KEY ("organization_id", "user_id")
+);
+
+ALTER TABLE "invitation"
+   ADD COLUMN "organization_id" INTEGER REFERENCES "organization" ("id") ON DELETE CASCADE,
+   ADD COLUMN "organization_role" TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,13 @@
+CREATE TABLE "identity_provider"
+(
+   "id" SERIAL PRIMARY KEY,
+   "organization_id" INTEGER NOT NULL REFERENCES "organization" ("id") ON DELETE CASCADE,
+   "name" TEXT NOT NULL UNIQUE,
+   "type" TEXT NOT NULL,
+   "client_id" TEXT NOT NULL,
+   "client_secret" BYTEA NOT NULL,
+   "scopes" TEXT[] NOT NULL DEFAULT '{}',
+   "issuer" TEXT NOT NULL DEFAULT '',
+   "enabled" BOOLEAN NOT NULL DEFAULT TRUE,
+   "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
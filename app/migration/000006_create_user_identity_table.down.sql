@@ -0,0 +1,3 @@
+ALTER TABLE "identity_provider" DROP COLUMN "options";
+
+DROP TABLE "user_identity";
@@ -0,0 +1,11 @@
+CREATE TABLE "user_identity"
+(
+   "id" SERIAL PRIMARY KEY,
+   "user_id" INTEGER NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+   "provider" TEXT NOT NULL,
+   "subject" TEXT NOT NULL,
+   "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+   UNIQUE ("provider", "subject")
+);
+
+ALTER TABLE "identity_provider" ADD COLUMN "options" JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1 @@
+ALTER TABLE "user" ADD COLUMN "password_hash" TEXT;
@@ -0,0 +1,3 @@
+-- Users so far signed up through providers, which verify emails.
+ALTER TABLE "user" ADD COLUMN "email_verified" BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE "user" ALTER COLUMN "email_verified" SET DEFAULT FALSE;
@@ -0,0 +1,12 @@
+CREATE TABLE "magic_link"
+(
+   "id" SERIAL PRIMARY KEY,
+   "email" TEXT NOT NULL,
+   "token_hash" TEXT NOT NULL UNIQUE,
+   "browser_hash" TEXT NOT NULL,
+   "expires_at" TIMESTAMPTZ NOT NULL,
+   "used_at" TIMESTAMPTZ,
+   "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX "magic_link_email_idx" ON "magic_link" (LOWER("email"), "created_at");
@@ -0,0 +1,3 @@
+DROP TABLE "user_totp";
+
+ALTER TABLE "user" DROP COLUMN "mfa_enabled";
@@ -0,0 +1,12 @@
+ALTER TABLE "user" ADD COLUMN "mfa_enabled" BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE "user_totp"
+(
+   "user_id" INTEGER PRIMARY KEY REFERENCES "user" ("id") ON DELETE CASCADE,
+   "secret" BYTEA NOT NULL,
+   "confirmed_at" TIMESTAMPTZ,
+   "last_step" BIGINT NOT NULL DEFAULT 0,
+   "failed_attempts" INTEGER NOT NULL DEFAULT 0,
+   "last_failed_at" TIMESTAMPTZ,
+   "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,2 @@
+DROP TABLE "webauthn_session";
+DROP TABLE "webauthn_credential";
@@ -0,0 +1,25 @@
+CREATE TABLE "webauthn_credential"
+(
+   "id" SERIAL PRIMARY KEY,
+   "user_id" INTEGER NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+   "credential_id" BYTEA NOT NULL UNIQUE,
+   "public_key" BYTEA NOT NULL,
+   "sign_count" BIGINT NOT NULL DEFAULT 0,
+   "transports" TEXT[] NOT NULL DEFAULT '{}',
+   "attestation_format" TEXT NOT NULL,
+   "aaguid" BYTEA NOT NULL,
+   "name" TEXT NOT NULL,
+   "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+   "last_used_at" TIMESTAMPTZ
+);
+
+CREATE INDEX "webauthn_credential_user_id_idx" ON "webauthn_credential" ("user_id");
+
+CREATE TABLE "webauthn_session"
+(
+   "challenge_hash" TEXT PRIMARY KEY,
+   "user_id" INTEGER REFERENCES "user" ("id") ON DELETE CASCADE,
+   "purpose" TEXT NOT NULL,
+   "expires_at" TIMESTAMPTZ NOT NULL,
+   "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
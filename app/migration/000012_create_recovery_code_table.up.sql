@@ -0,0 +1,10 @@
+CREATE TABLE "recovery_code"
+(
+   "id" SERIAL PRIMARY KEY,
+   "user_id" INTEGER NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+   "code_hash" TEXT NOT NULL,
+   "used_at" TIMESTAMPTZ,
+   "created_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX "recovery_code_user_id_idx" ON "recovery_code" ("user_id");
@@ -0,0 +1 @@
+ALTER TABLE "user" ADD COLUMN "tokens_valid_after" TIMESTAMPTZ;
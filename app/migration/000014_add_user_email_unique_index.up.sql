@@ -0,0 +1,2 @@
+UPDATE "user" SET "email" = LOWER("email");
+CREATE UNIQUE INDEX "user_email_idx" ON "user" (LOWER("email"));
@@ -0,0 +1,2 @@
+ALTER TABLE "user" DROP COLUMN "password_last_failed_at";
+ALTER TABLE "user" DROP COLUMN "password_failed_attempts";
@@ -0,0 +1,2 @@
+ALTER TABLE "user" ADD COLUMN "password_failed_attempts" INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE "user" ADD COLUMN "password_last_failed_at" TIMESTAMPTZ;
@@ -0,0 +1 @@
+DROP TABLE "used_mfa_pending_token";
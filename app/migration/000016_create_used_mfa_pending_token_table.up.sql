@@ -0,0 +1,5 @@
+CREATE TABLE "used_mfa_pending_token"
+(
+   "token_hash" TEXT PRIMARY KEY,
+   "expires_at" TIMESTAMPTZ NOT NULL
+);
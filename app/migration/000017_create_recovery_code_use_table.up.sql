@@ -0,0 +1,8 @@
+CREATE TABLE "recovery_code_use"
+(
+   "id" SERIAL PRIMARY KEY,
+   "user_id" INTEGER NOT NULL REFERENCES "user" ("id") ON DELETE CASCADE,
+   "used_at" TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX "recovery_code_use_user_id_idx" ON "recovery_code_use" ("user_id");
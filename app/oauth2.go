@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Ways to send the client credentials to the token endpoint.
+const (
+	OAuth2AuthStyleHeader = "header"
+	OAuth2AuthStyleBody   = "body"
+	OAuth2AuthStyleQuery  = "query"
+)
+
+// GenericOAuth2Config describes an OAuth2 provider. The paths map fields of
+// the userinfo response to the user, e.g. "data.email" or
+// "values[is_primary=true].email". When EmailURL is set, the email paths are
+// read from its response instead.
+type GenericOAuth2Config struct {
+	AuthorizationURL  string
+	TokenURL          string
+	UserInfoURL       string
+	EmailURL          string
+	AuthStyle         string
+	Scopes            []string
+	ScopeSeparator    string
+	SubjectPath       string
+	EmailPath         string
+	EmailVerifiedPath string
+	NamePath          string
+	PicturePath       string
+	GroupsPath        string
+	// AuthorizationOptions names the OpenID Connect parameters the provider
+	// understands, like prompt and login_hint, to pass on to it.
+	AuthorizationOptions []string
+}
+
+// NewGenericOAuth2Config reads the configuration of a generic provider from
+// the options of an identity provider.
+func NewGenericOAuth2Config(options map[string]string, scopes []string) GenericOAuth2Config {
+	return GenericOAuth2Config{
+		AuthorizationURL:     options["authorization_url"],
+		TokenURL:             options["token_url"],
+		UserInfoURL:          options["userinfo_url"],
+		EmailURL:             options["email_url"],
+		AuthStyle:            options["auth_style"],
+		Scopes:               scopes,
+		ScopeSeparator:       options["scope_separator"],
+		SubjectPath:          options["subject_path"],
+		EmailPath:            options["email_path"],
+		EmailVerifiedPath:    options["email_verified_path"],
+		NamePath:             options["name_path"],
+		PicturePath:          options["picture_path"],
+		GroupsPath:           options["groups_path"],
+		AuthorizationOptions: splitOption(options["authorization_options"]),
+	}
+}
+
+func (c GenericOAuth2Config) Validate() error {
+	for _, u := range []string{c.AuthorizationURL, c.TokenURL, c.UserInfoURL} {
+		if len(u) < 1 {
+			return errors.New("authorization, token and userinfo urls cannot be empty")
+		}
+		if err := validateBaseURL(u); err != nil {
+			return err
+		}
+	}
+
+	switch c.AuthStyle {
+	case "", OAuth2AuthStyleHeader, OAuth2AuthStyleBody, OAuth2AuthStyleQuery:
+	default:
+		return fmt.Errorf("invalid auth style: %s", c.AuthStyle)
+	}
+
+	if err := validateBaseURL(c.EmailURL); err != nil {
+		return err
+	}
+
+	// Without the subject users could only be found by email, which is only
+	// trusted when the provider says it verified it.
+	if len(c.SubjectPath) < 1 {
+		return errors.New("subject path cannot be empty")
+	}
+	if len(c.EmailPath) < 1 || len(c.EmailVerifiedPath) < 1 {
+		return errors.New("email and email verified paths cannot be empty")
+	}
+
+	return nil
+}
+
+// genericOAuth2Presets configure the generic provider for well-known
+// providers, which are used as identity provider types.
+var genericOAuth2Presets = map[string]GenericOAuth2Config{
+	"discord": {
+		AuthorizationURL:  "https://discord.com/oauth2/authorize",
+		TokenURL:          "https://discord.com/api/oauth2/token",
+		UserInfoURL:       "https://discord.com/api/users/@me",
+		AuthStyle:         OAuth2AuthStyleBody,
+		Scopes:            []string{"identify", "email"},
+		SubjectPath:       "id",
+		EmailPath:         "email",
+		EmailVerifiedPath: "verified",
+		NamePath:          "global_name",
+	},
+	"slack": {
+		AuthorizationURL:  "https://slack.com/openid/connect/authorize",
+		TokenURL:          "https://slack.com/api/openid.connect.token",
+		UserInfoURL:       "https://slack.com/api/openid.connect.userInfo",
+		AuthStyle:         OAuth2AuthStyleBody,
+		Scopes:            []string{"openid", "email", "profile"},
+		SubjectPath:       "sub",
+		EmailPath:         "email",
+		EmailVerifiedPath: "email_verified",
+		NamePath:          "name",
+		PicturePath:       "picture",
+	},
+	"bitbucket": {
+		AuthorizationURL:  "https://bitbucket.org/site/oauth2/authorize",
+		TokenURL:          "https://bitbucket.org/site/oauth2/access_token",
+		UserInfoURL:       "https://api.bitbucket.org/2.0/user",
+		EmailURL:          "https://api.bitbucket.org/2.0/user/emails",
+		AuthStyle:         OAuth2AuthStyleHeader,
+		Scopes:            []string{"account", "email"},
+		SubjectPath:       "uuid",
+		EmailPath:         "values[is_primary=true].email",
+		EmailVerifiedPath: "values[is_primary=true].is_confirmed",
+		NamePath:          "display_name",
+		PicturePath:       "links.avatar.href",
+	},
+	"linkedin": {
+		AuthorizationURL:  "https://www.linkedin.com/oauth/v2/authorization",
+		TokenURL:          "https://www.linkedin.com/oauth/v2/accessToken",
+		UserInfoURL:       "https://api.linkedin.com/v2/userinfo",
+		AuthStyle:         OAuth2AuthStyleBody,
+		Scopes:            []string{"openid", "profile", "email"},
+		SubjectPath:       "sub",
+		EmailPath:         "email",
+		EmailVerifiedPath: "email_verified",
+		NamePath:          "name",
+		PicturePath:       "picture",
+	},
+}
+
+var _ IdentityProvider = (*GenericOAuth2IdentityProvider)(nil)
+
+// GenericOAuth2IdentityProvider signs in with any OAuth2 provider that
+// exposes the user through a JSON userinfo endpoint.
+type GenericOAuth2IdentityProvider struct {
+	clientID     string
+	clientSecret string
+	redirectURI  string
+	config       GenericOAuth2Config
+	httpClient   *HttpClient
+}
+
+func NewGenericOAuth2IdentityProvider(
+	clientID string,
+	clientSecret string,
+	redirectURI string,
+	config GenericOAuth2Config,
+) GenericOAuth2IdentityProvider {
+	if len(config.AuthStyle) < 1 {
+		config.AuthStyle = OAuth2AuthStyleBody
+	}
+	if len(config.ScopeSeparator) < 1 {
+		config.ScopeSeparator = " "
+	}
+
+	return GenericOAuth2IdentityProvider{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		redirectURI:  redirectURI,
+		config:       config,
+		httpClient:   DefaultHttpClient,
+	}
+}
+
+func (g GenericOAuth2IdentityProvider) GetAuthorizationURL(options AuthorizationOptions) (string, error) {
+	u, err := url.Parse(g.config.AuthorizationURL)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Add("client_id", g.clientID)
+	q.Add("redirect_uri", g.redirectURI)
+	q.Add("response_type", "code")
+	q.Add("scope", strings.Join(g.config.Scopes, g.config.ScopeSeparator))
+	addParams(q, options.openIDConnectParams(), g.config.AuthorizationOptions...)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+func (g GenericOAuth2IdentityProvider) GetIdentityToken(code string) (string, error) {
+	u, err := url.Parse(g.config.TokenURL)
+	if err != nil {
+		return "", err
+	}
+
+	body := url.Values{}
+	body.Add("code", code)
+	body.Add("grant_type", "authorization_code")
+	body.Add("redirect_uri", g.redirectURI)
+
+	headers := map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+	}
+
+	switch g.config.AuthStyle {
+	case OAuth2AuthStyleHeader:
+		credentials := fmt.Sprintf("%s:%s", url.QueryEscape(g.clientID), url.QueryEscape(g.clientSecret))
+		headers["Authorization"] = fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString([]byte(credentials)))
+	case OAuth2AuthStyleQuery:
+		q := u.Query()
+		q.Add("client_id", g.clientID)
+		q.Add("client_secret", g.clientSecret)
+		u.RawQuery = q.Encode()
+	default:
+		body.Add("client_id", g.clientID)
+		body.Add("client_secret", g.clientSecret)
+	}
+
+	res := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := g.httpClient.HttpRequestJson(http.MethodPost, u.String(), headers, body.Encode(), &res); err != nil {
+		return "", err
+	}
+
+	if len(res.AccessToken) < 1 {
+		return "", errors.New("no access token received")
+	}
+
+	return res.AccessToken, nil
+}
+
+func (g GenericOAuth2IdentityProvider) GetSingleSignOnUser(identityToken string) (SingleSignOnUser, error) {
+	headers := map[string]string{
+		"Authorization": fmt.Sprintf("Bearer %s", identityToken),
+	}
+
+	var userInfo interface{}
+	if err := g.httpClient.HttpRequestJson(http.MethodGet, g.config.UserInfoURL, headers, "", &userInfo); err != nil {
+		return SingleSignOnUser{}, err
+	}
+
+	emailInfo := userInfo
+	if len(g.config.EmailURL) > 0 {
+		if err := g.httpClient.HttpRequestJson(http.MethodGet, g.config.EmailURL, headers, "", &emailInfo); err != nil {
+			return SingleSignOnUser{}, fmt.Errorf("failed to get email: %w", err)
+		}
+	}
+
+	subject := jsonPathString(userInfo, g.config.SubjectPath)
+	if len(subject) < 1 {
+		return SingleSignOnUser{}, errors.New("userinfo response is missing the subject")
+	}
+
+	email := jsonPathString(emailInfo, g.config.EmailPath)
+	if len(email) > 0 && jsonPathString(emailInfo, g.config.EmailVerifiedPath) != "true" {
+		return SingleSignOnUser{}, ErrSignInRejected{
+			Code:    SignInEmailNotVerified,
+			Message: "the identity provider has not verified the email",
+		}
+	}
+
+	return SingleSignOnUser{
+		Subject: subject,
+		Email:   email,
+		Name:    jsonPathString(userInfo, g.config.NamePath),
+		Picture: jsonPathString(userInfo, g.config.PicturePath),
+		Groups:  jsonPathStrings(userInfo, g.config.GroupsPath),
+	}, nil
+}
+
+// jsonPath looks up a dot separated path in a decoded JSON value. A segment
+// is either a key, an array index, or a key followed by [field=value] to pick
+// the first array element whose field has that value.
+func jsonPath(v interface{}, path string) (interface{}, bool) {
+	if len(path) < 1 {
+		return nil, false
+	}
+
+	for _, segment := range strings.Split(path, ".") {
+		filter := ""
+		if i := strings.Index(segment, "["); i >= 0 && strings.HasSuffix(segment, "]") {
+			filter = segment[i+1 : len(segment)-1]
+			segment = segment[:i]
+		}
+
+		switch value := v.(type) {
+		case map[string]interface{}:
+			v = value[segment]
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(value) {
+				return nil, false
+			}
+			v = value[i]
+		default:
+			return nil, false
+		}
+
+		if len(filter) > 0 {
+			var ok bool
+			if v, ok = jsonFilter(v, filter); !ok {
+				return nil, false
+			}
+		}
+	}
+
+	return v, v != nil
+}
+
+func jsonFilter(v interface{}, filter string) (interface{}, bool) {
+	parts := strings.SplitN(filter, "=", 2)
+	values, ok := v.([]interface{})
+	if len(parts) != 2 || !ok {
+		return nil, false
+	}
+
+	for _, value := range values {
+		if field, ok := jsonPath(value, parts[0]); ok && jsonString(field) == parts[1] {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+func jsonPathString(v interface{}, path string) string {
+	value, ok := jsonPath(v, path)
+	if !ok {
+		return ""
+	}
+	return jsonString(value)
+}
+
+func jsonPathStrings(v interface{}, path string) []string {
+	value, ok := jsonPath(v, path)
+	if !ok {
+		return nil
+	}
+
+	values, ok := value.([]interface{})
+	if !ok {
+		return []string{jsonString(value)}
+	}
+
+	strs := []string{}
+	for _, value := range values {
+		strs = append(strs, jsonString(value))
+	}
+	return strs
+}
+
+func jsonString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		return ""
+	}
+}
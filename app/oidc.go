@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// minKeySetRefreshInterval limits how often an unknown key id triggers a
+// refetch of the key set.
+const minKeySetRefreshInterval = 5 * time.Minute
+
+// OIDCKeySet verifies ID tokens against the JSON Web Key Set of an OpenID
+// Connect provider. Keys are cached and refetched when a token is signed
+// with an unknown key.
+type OIDCKeySet struct {
+	jwksURL   string
+	mu        sync.Mutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+func NewOIDCKeySet(jwksURL string) *OIDCKeySet {
+	return &OIDCKeySet{
+		jwksURL: jwksURL,
+		keys:    map[string]interface{}{},
+	}
+}
+
+// VerifyIDToken checks the signature, expiry and audience of an ID token and
+// returns its claims. Checking the issuer is left to the caller, as it
+// differs per provider.
+func (k *OIDCKeySet) VerifyIDToken(idToken string, audience string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Method.Alg())
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return k.getKey(kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %v", err)
+	}
+
+	if !token.Valid {
+		return nil, errors.New("invalid id token")
+	}
+
+	if !claims.VerifyAudience(audience, true) {
+		return nil, errors.New("id token has an invalid audience")
+	}
+
+	return claims, nil
+}
+
+func (k *OIDCKeySet) getKey(kid string) (interface{}, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(k.fetchedAt) < minKeySetRefreshInterval {
+		return nil, fmt.Errorf("unknown key id: %s", kid)
+	}
+
+	keys, err := fetchJSONWebKeySet(k.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	k.keys = keys
+	k.fetchedAt = time.Now()
+
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id: %s", kid)
+}
+
+func fetchJSONWebKeySet(jwksURL string) (map[string]interface{}, error) {
+	res := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	if err := DefaultHttpClient.HttpRequestJson(http.MethodGet, jwksURL, nil, "", &res); err != nil {
+		return nil, fmt.Errorf("failed to fetch key set: %w", err)
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range res.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		switch jwk.Kty {
+		case "RSA":
+			n, err := decodeBase64URLInt(jwk.N)
+			if err != nil {
+				continue
+			}
+			e, err := decodeBase64URLInt(jwk.E)
+			if err != nil {
+				continue
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			if jwk.Crv != "P-256" {
+				continue
+			}
+			x, err := decodeBase64URLInt(jwk.X)
+			if err != nil {
+				continue
+			}
+			y, err := decodeBase64URLInt(jwk.Y)
+			if err != nil {
+				continue
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		}
+	}
+
+	return keys, nil
+}
+
+func decodeBase64URLInt(s string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	OrganizationOwner  = "owner"
+	OrganizationAdmin  = "admin"
+	OrganizationMember = "member"
+)
+
+var organizationSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}$`)
+
+type Organization struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OrganizationMembership struct {
+	Organization Organization `json:"organization"`
+	Role         string       `json:"role"`
+}
+
+type Member struct {
+	User      User      `json:"user"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OrganizationManager struct {
+	repository        OrganizationRepository
+	invitationManager InvitationManager
+}
+
+func NewOrganizationManager(
+	repository OrganizationRepository,
+	invitationManager InvitationManager,
+) OrganizationManager {
+	return OrganizationManager{
+		repository:        repository,
+		invitationManager: invitationManager,
+	}
+}
+
+func (m OrganizationManager) CreateOrganization(ownerID int, name string, slug string) (Organization, error) {
+	name = strings.TrimSpace(name)
+	if len(name) < 1 {
+		return Organization{}, errors.New("organization name cannot be empty")
+	}
+
+	slug = strings.ToLower(strings.TrimSpace(slug))
+	if !organizationSlugPattern.MatchString(slug) {
+		return Organization{}, fmt.Errorf("invalid organization slug: %s", slug)
+	}
+
+	return m.repository.CreateOrganization(Organization{Name: name, Slug: slug}, ownerID)
+}
+
+func (m OrganizationManager) GetUserOrganizations(userID int) ([]OrganizationMembership, error) {
+	return m.repository.GetUserOrganizations(userID)
+}
+
+func (m OrganizationManager) GetMembership(organizationID int, userID int) (OrganizationMembership, error) {
+	return m.repository.GetOrganizationMembership(organizationID, userID)
+}
+
+// GetMembers lists the members of an organization, visible to its members only.
+func (m OrganizationManager) GetMembers(organizationID int, userID int) ([]Member, error) {
+	if _, err := m.GetMembership(organizationID, userID); err != nil {
+		return nil, err
+	}
+	return m.repository.GetOrganizationMembers(organizationID)
+}
+
+func (m OrganizationManager) AddMember(organizationID int, userID int, role string) error {
+	if !isOrganizationRole(role) {
+		return fmt.Errorf("invalid organization role: %s", role)
+	}
+	return m.repository.AddOrganizationMember(organizationID, userID, role)
+}
+
+// EnsureMember adds the user to the organization as member, unless it
+// already is a member.
+func (m OrganizationManager) EnsureMember(organizationID int, userID int) error {
+	_, err := m.GetMembership(organizationID, userID)
+	var organizationNotFound ErrOrganizationNotFound
+	if errors.As(err, &organizationNotFound) {
+		return m.AddMember(organizationID, userID, OrganizationMember)
+	}
+	return err
+}
+
+// InviteMember creates an invitation to join the organization. Only owners
+// and admins can invite, and only owners can invite other owners.
+func (m OrganizationManager) InviteMember(
+	inviterID int,
+	organizationID int,
+	email string,
+	role string,
+	expiresAt time.Time,
+) (Invitation, string, error) {
+	membership, err := m.GetMembership(organizationID, inviterID)
+	if err != nil {
+		return Invitation{}, "", err
+	}
+
+	if len(role) < 1 {
+		role = OrganizationMember
+	}
+	if !isOrganizationRole(role) {
+		return Invitation{}, "", fmt.Errorf("invalid organization role: %s", role)
+	}
+
+	switch {
+	case membership.Role == OrganizationOwner:
+	case membership.Role == OrganizationAdmin && role != OrganizationOwner:
+	default:
+		return Invitation{}, "", ErrOrganizationForbidden(fmt.Sprintf("%s cannot invite %s", membership.Role, role))
+	}
+
+	return m.invitationManager.CreateInvitation(Invitation{
+		Email:            email,
+		CreatedBy:        inviterID,
+		ExpiresAt:        expiresAt,
+		OrganizationID:   organizationID,
+		OrganizationRole: role,
+	})
+}
+
+// JoinByInvitation adds the user to the organization the invitation is for,
+// if any.
+func (m OrganizationManager) JoinByInvitation(user User, invitation Invitation) error {
+	if invitation.OrganizationID < 1 {
+		return nil
+	}
+	return m.AddMember(invitation.OrganizationID, user.ID, invitation.OrganizationRole)
+}
+
+// LeaveOrganization removes the user from the organization. The last owner
+// cannot leave.
+func (m OrganizationManager) LeaveOrganization(organizationID int, userID int) error {
+	membership, err := m.GetMembership(organizationID, userID)
+	if err != nil {
+		return err
+	}
+
+	if membership.Role == OrganizationOwner {
+		owners, err := m.repository.CountOrganizationOwners(organizationID)
+		if err != nil {
+			return err
+		}
+		if owners < 2 {
+			return ErrOrganizationForbidden("the last owner cannot leave the organization")
+		}
+	}
+
+	return m.repository.RemoveOrganizationMember(organizationID, userID)
+}
+
+func isOrganizationRole(role string) bool {
+	return role == OrganizationOwner || role == OrganizationAdmin || role == OrganizationMember
+}
+
+type ErrOrganizationNotFound string
+
+func (e ErrOrganizationNotFound) Error() string {
+	return string(e)
+}
+
+type ErrOrganizationForbidden string
+
+func (e ErrOrganizationForbidden) Error() string {
+	return string(e)
+}
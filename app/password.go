@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Wrong passwords lock the account for passwordLockout once there have been
+// passwordMaxFailedAttempts of them within passwordLockout.
+const (
+	passwordMaxFailedAttempts = 10
+	passwordLockout           = 15 * time.Minute
+)
+
+// Argon2Params are the cost parameters of Argon2id. Memory is in KiB.
+type Argon2Params struct {
+	Time       uint32
+	Memory     uint32
+	Threads    uint8
+	KeyLength  uint32
+	SaltLength uint32
+}
+
+// PasswordHasher hashes passwords with Argon2id into the PHC string format,
+// e.g. $argon2id$v=19$m=65536,t=1,p=4$salt$hash, which keeps the parameters
+// next to the hash so they can be raised later.
+type PasswordHasher struct {
+	params Argon2Params
+}
+
+func NewPasswordHasher(params Argon2Params) PasswordHasher {
+	if params.KeyLength < 1 {
+		params.KeyLength = 32
+	}
+	if params.SaltLength < 1 {
+		params.SaltLength = 16
+	}
+
+	return PasswordHasher{params: params}
+}
+
+func (h PasswordHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.Time, h.params.Memory, h.params.Threads, h.params.KeyLength)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.params.Memory,
+		h.params.Time,
+		h.params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify checks the password against an encoded hash and reports whether the
+// hash was made with other parameters than the current ones and should be
+// replaced.
+func (h PasswordHasher) Verify(password string, encodedHash string) (bool, bool, error) {
+	params, salt, key, err := decodeArgon2Hash(encodedHash)
+	if err != nil {
+		return false, false, err
+	}
+
+	otherKey := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+		return false, false, nil
+	}
+
+	needsRehash := params.Time != h.params.Time ||
+		params.Memory != h.params.Memory ||
+		params.Threads != h.params.Threads ||
+		params.KeyLength != h.params.KeyLength ||
+		params.SaltLength != h.params.SaltLength
+	return true, needsRehash, nil
+}
+
+func decodeArgon2Hash(encodedHash string) (Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return Argon2Params{}, nil, nil, errors.New("invalid password hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("invalid password hash version: %v", err)
+	}
+	if version != argon2.Version {
+		return Argon2Params{}, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	params := Argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("invalid password hash parameters: %v", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("invalid password hash salt: %v", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2Params{}, nil, nil, fmt.Errorf("invalid password hash key: %v", err)
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+const (
+	PasswordTooShort      = "password_too_short"
+	PasswordTooLong       = "password_too_long"
+	PasswordTooSimple     = "password_too_simple"
+	PasswordContainsEmail = "password_contains_email"
+)
+
+type ErrPasswordRejected struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e ErrPasswordRejected) Error() string {
+	return e.Message
+}
+
+// PasswordPolicy decides whether a password may be set. Character classes
+// are lower case and upper case letters, digits and other characters.
+type PasswordPolicy struct {
+	MinLength           int
+	MaxLength           int
+	MinCharacterClasses int
+}
+
+func NewPasswordPolicy(
+	minLength int,
+	maxLength int,
+	minCharacterClasses int,
+) PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:           minLength,
+		MaxLength:           maxLength,
+		MinCharacterClasses: minCharacterClasses,
+	}
+}
+
+func (p PasswordPolicy) Check(password string, email string) error {
+	length := len([]rune(password))
+	if length < p.MinLength {
+		return ErrPasswordRejected{
+			Code:    PasswordTooShort,
+			Message: fmt.Sprintf("password must have at least %d characters", p.MinLength),
+		}
+	}
+
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return ErrPasswordRejected{
+			Code:    PasswordTooLong,
+			Message: fmt.Sprintf("password must have at most %d characters", p.MaxLength),
+		}
+	}
+
+	if passwordCharacterClasses(password) < p.MinCharacterClasses {
+		return ErrPasswordRejected{
+			Code:    PasswordTooSimple,
+			Message: fmt.Sprintf("password must mix at least %d of lower case, upper case, digits and symbols", p.MinCharacterClasses),
+		}
+	}
+
+	localPart := strings.ToLower(strings.SplitN(email, "@", 2)[0])
+	if len(localPart) > 2 && strings.Contains(strings.ToLower(password), localPart) {
+		return ErrPasswordRejected{
+			Code:    PasswordContainsEmail,
+			Message: "password must not contain the email",
+		}
+	}
+
+	return nil
+}
+
+func passwordCharacterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// PasswordAuthenticator signs users in with an email and a password stored
+// with their account. Accounts are provisioned like single sign-on users, so
+// sign-up restrictions and invitations apply to them as well.
+type PasswordAuthenticator struct {
+	enabled              bool
+	requireVerifiedEmail bool
+	repository           Repository
+	hasher               PasswordHasher
+	policy               PasswordPolicy
+	singleSignOn         SingleSignOn
+	dummyHash            string
+}
+
+func NewPasswordAuthenticator(
+	enabled bool,
+	requireVerifiedEmail bool,
+	repository Repository,
+	hasher PasswordHasher,
+	policy PasswordPolicy,
+	singleSignOn SingleSignOn,
+) (PasswordAuthenticator, error) {
+	// Unknown emails are checked against a dummy hash, so they take as long
+	// as wrong passwords.
+	dummyHash, err := hasher.Hash("")
+	if err != nil {
+		return PasswordAuthenticator{}, err
+	}
+
+	return PasswordAuthenticator{
+		enabled:              enabled,
+		requireVerifiedEmail: requireVerifiedEmail,
+		repository:           repository,
+		hasher:               hasher,
+		policy:               policy,
+		singleSignOn:         singleSignOn,
+		dummyHash:            dummyHash,
+	}, nil
+}
+
+func (a PasswordAuthenticator) Enabled() bool {
+	return a.enabled
+}
+
+// SignUp creates an account with a password and returns it with a token.
+// Emails that already belong to an account are rejected, as they may have
+// been created through a provider that verified the email. When verified
+// emails are required, the account is returned with ErrSignInRejected.
+func (a PasswordAuthenticator) SignUp(email string, password string, name string, invitationToken string) (User, string, error) {
+	if err := validateEmail(email); err != nil {
+		return User{}, "", err
+	}
+
+	if err := a.policy.Check(password, email); err != nil {
+		return User{}, "", err
+	}
+
+	emailTaken := ErrSignUpRejected{
+		Code:    SignUpEmailTaken,
+		Message: "an account with this email already exists",
+	}
+
+	// The check spares invitations for emails that are taken, while
+	// SignUpUser fails for accounts created in the meantime.
+	_, err := a.repository.GetUserByEmail(email)
+	if err == nil {
+		return User{}, "", emailTaken
+	}
+	var userNotFound ErrUserNotFound
+	if !errors.As(err, &userNotFound) {
+		return User{}, "", err
+	}
+
+	passwordHash, err := a.hasher.Hash(password)
+	if err != nil {
+		return User{}, "", fmt.Errorf("failed to hash password: %v", err)
+	}
+
+	user, err := a.singleSignOn.SignUpUser(SingleSignOnUser{Email: email, Name: name}, invitationToken)
+	var userExists ErrUserExists
+	if errors.As(err, &userExists) {
+		return User{}, "", emailTaken
+	}
+	if err != nil {
+		return User{}, "", err
+	}
+
+	if err := a.repository.SetUserPasswordHash(user.ID, passwordHash); err != nil {
+		return User{}, "", fmt.Errorf("failed to set password: %v", err)
+	}
+
+	token, err := a.createToken(user)
+	return user, token, err
+}
+
+// SignIn checks the password of the user and returns a token. Hashes made
+// with outdated parameters are replaced on the way.
+func (a PasswordAuthenticator) SignIn(email string, password string, invitationToken string) (string, error) {
+	user, err := a.Authenticate(email, password)
+	if err != nil {
+		return "", err
+	}
+
+	if len(invitationToken) > 0 {
+		if user, err = a.singleSignOn.GetOrCreateUser(SingleSignOnUser{Email: user.Email}, invitationToken); err != nil {
+			return "", err
+		}
+	}
+
+	return a.createToken(user)
+}
+
+func (a PasswordAuthenticator) createToken(user User) (string, error) {
+	if a.requireVerifiedEmail && !user.EmailVerified {
+		return "", ErrSignInRejected{
+			Code:    SignInEmailNotVerified,
+			Message: "email must be verified before signing in",
+		}
+	}
+
+	return a.singleSignOn.CreateToken(user, nil)
+}
+
+func (a PasswordAuthenticator) Authenticate(email string, password string) (User, error) {
+	user, err := a.repository.GetUserByEmail(email)
+	var userNotFound ErrUserNotFound
+	if err != nil && !errors.As(err, &userNotFound) {
+		return User{}, err
+	}
+
+	passwordHash := ""
+	if err == nil {
+		passwordHash, err = a.repository.GetUserPasswordHash(user.ID)
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	if len(passwordHash) < 1 {
+		a.hasher.Verify(password, a.dummyHash)
+		return User{}, ErrInvalidCredentials("invalid email or password")
+	}
+
+	failures, err := a.repository.CountPasswordFailures(user.ID, time.Now().Add(-passwordLockout))
+	if err != nil {
+		return User{}, err
+	}
+	if failures >= passwordMaxFailedAttempts {
+		return User{}, ErrRateLimited("too many wrong passwords, try again later")
+	}
+
+	ok, needsRehash, err := a.hasher.Verify(password, passwordHash)
+	if err != nil {
+		return User{}, err
+	}
+	if !ok {
+		if err := a.repository.RecordPasswordFailure(user.ID, time.Now().Add(-passwordLockout)); err != nil {
+			return User{}, err
+		}
+		return User{}, ErrInvalidCredentials("invalid email or password")
+	}
+
+	if failures > 0 {
+		if err := a.repository.ResetPasswordFailures(user.ID); err != nil {
+			return User{}, err
+		}
+	}
+
+	if needsRehash {
+		if err := a.setPassword(user.ID, password); err != nil {
+			log.Printf("failed to rehash password of user %d: %v", user.ID, err)
+		}
+	}
+
+	return user, nil
+}
+
+// SetPassword replaces the password of the user, if it meets the policy.
+func (a PasswordAuthenticator) SetPassword(user User, password string) error {
+	if err := a.policy.Check(password, user.Email); err != nil {
+		return err
+	}
+	return a.setPassword(user.ID, password)
+}
+
+func (a PasswordAuthenticator) setPassword(userID int, password string) error {
+	passwordHash, err := a.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	return a.repository.SetUserPasswordHash(userID, passwordHash)
+}
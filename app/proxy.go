@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxySignInPath   = "/oauth2/sign-in"
+	proxyCallbackPath = "/oauth2/callback"
+	proxySignOutPath  = "/oauth2/sign-out"
+	proxyMFAPath      = "/oauth2/mfa"
+)
+
+var proxyIdentityHeaders = []string{
+	"X-Forwarded-User",
+	"X-Forwarded-Email",
+	"X-Forwarded-Preferred-Username",
+	"X-Forwarded-Groups",
+}
+
+func StartProxy() {
+	config := struct {
+		ProxyPort          int      `env:"PROXY_PORT" default:"4180"`
+		ProxyUpstreamURL   string   `env:"PROXY_UPSTREAM_URL"`
+		ProxyProvider      string   `env:"PROXY_PROVIDER" default:"google"`
+		ProxyClientID      string   `env:"PROXY_CLIENT_ID"`
+		ProxyClientSecret  string   `env:"PROXY_CLIENT_SECRET"`
+		ProxyRedirectURI   string   `env:"PROXY_REDIRECT_URI" default:"https://localhost/oauth2/callback"`
+		ProxyHomepageURL   string   `env:"PROXY_HOMEPAGE_URL" default:"/"`
+		ProxyAllowRules    string   `env:"PROXY_ALLOW_RULES" default:""`
+		ProxySignUp        bool     `env:"PROXY_SIGNUP_ENABLED" default:"true"`
+		SignUpDomains      []string `env:"SIGNUP_ALLOWED_DOMAINS" default:""`
+		SignUpEmails       []string `env:"SIGNUP_ALLOWED_EMAILS" default:""`
+		SignUpDenied       []string `env:"SIGNUP_DENIED_EMAILS" default:""`
+		SignUpInviteOnly   bool     `env:"SIGNUP_INVITE_ONLY" default:"false"`
+		InvitationLifetime int      `env:"INVITATION_LIFETIME_HOURS" default:"168"` // 1 week
+		DefaultRole        string   `env:"DEFAULT_ROLE" default:"member"`
+		AdminEmails        []string `env:"ADMIN_EMAILS" default:""`
+		DBHost             string   `env:"DB_HOST" default:"sso-database"`
+		DBPort             int      `env:"DB_PORT" default:"5432"`
+		DBUser             string   `env:"DB_USER" default:"sso"`
+		DBPassword         string   `env:"DB_PASSWORD" default:"sso"`
+		DBName             string   `env:"DB_NAME" default:"sso"`
+		JWTSecret          string   `env:"JWT_SECRET"`
+		ProviderSecretKey  string   `env:"PROVIDER_SECRET_KEY" default:""`
+	}{}
+	err := NewEnv().Load(&config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	upstreamURL, err := url.Parse(config.ProxyUpstreamURL)
+	if err != nil {
+		log.Fatalf("invalid upstream url: %v", err)
+	}
+
+	rules, err := ParseAccessRules(config.ProxyAllowRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	identityProvider, err := NewIdentityProvider(IdentityProviderConfig{
+		Type:         config.ProxyProvider,
+		ClientID:     config.ProxyClientID,
+		ClientSecret: config.ProxyClientSecret,
+	}, config.ProxyRedirectURI)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	database := NewDatabase(DBConfig{
+		Host:     config.DBHost,
+		Port:     config.DBPort,
+		User:     config.DBUser,
+		Password: config.DBPassword,
+		DBName:   config.DBName,
+	})
+	db, err := database.Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := database.MigrateUp(db); err != nil {
+		log.Fatal(err)
+	}
+
+	secretBox, err := NewSecretBox(config.ProviderSecretKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	repository := NewSqlRepository(db)
+	tokenizer := NewJWT([]byte(config.JWTSecret))
+	authenticator := NewAuthenticator(tokenizer, time.Duration(7*24*time.Hour), repository, repository)
+	roleManager := NewRoleManager(repository, config.DefaultRole, config.AdminEmails)
+	signUpPolicy := NewSignUpPolicy(
+		config.SignUpDomains,
+		config.SignUpEmails,
+		config.SignUpDenied,
+		config.SignUpInviteOnly,
+	)
+	invitationManager := NewInvitationManager(repository, time.Duration(config.InvitationLifetime)*time.Hour)
+	organizationManager := NewOrganizationManager(repository, invitationManager)
+	singleSignOn := NewSingleSignOnFactory(
+		authenticator,
+		repository,
+		invitationManager,
+		roleManager,
+		organizationManager,
+		signUpPolicy,
+	).NewSingleSignOn(config.ProxyProvider, identityProvider, config.ProxySignUp)
+
+	proxy := NewProxyHandler(
+		authenticator,
+		NewUserManager(repository),
+		NewMFAManager(repository, authenticator, secretBox, ""),
+		NewProxySingleSignOnHandler(singleSignOn, config.ProxyHomepageURL, strings.HasPrefix(config.ProxyRedirectURI, "https://")),
+		httputil.NewSingleHostReverseProxy(upstreamURL),
+		rules,
+	)
+
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", config.ProxyPort), proxy))
+}
+
+type ProxyHandler struct {
+	authenticator       Authenticator
+	userManager         UserManager
+	mfaManager          MFAManager
+	singleSignOnHandler SingleSignOnHandler
+	upstream            http.Handler
+	rules               []AccessRule
+}
+
+func NewProxyHandler(
+	authenticator Authenticator,
+	userManager UserManager,
+	mfaManager MFAManager,
+	singleSignOnHandler SingleSignOnHandler,
+	upstream http.Handler,
+	rules []AccessRule,
+) ProxyHandler {
+	return ProxyHandler{
+		authenticator:       authenticator,
+		userManager:         userManager,
+		mfaManager:          mfaManager,
+		singleSignOnHandler: singleSignOnHandler,
+		upstream:            upstream,
+		rules:               rules,
+	}
+}
+
+func (h ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Rules are matched against the cleaned path, so the upstream gets it
+	// as well instead of resolving dot segments itself.
+	r.URL.Path = cleanProxyPath(r.URL.Path)
+	r.URL.RawPath = ""
+
+	switch r.URL.Path {
+	case proxySignInPath:
+		h.singleSignOnHandler.SignIn(w, r)
+		return
+	case proxyCallbackPath:
+		h.singleSignOnHandler.Callback(w, r)
+		return
+	case proxySignOutPath:
+		h.signOut(w, r)
+		return
+	case proxyMFAPath:
+		h.mfa(w, r)
+		return
+	}
+
+	payload, err := h.authenticator.GetTokenPayload(getProxyToken(r))
+	if err != nil {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			// Users who signed in with the first factor continue with the
+			// second one.
+			path := proxySignInPath
+			if _, cookieErr := r.Cookie("mfa_token"); cookieErr == nil {
+				path = proxyMFAPath
+			}
+			http.Redirect(w, r, fmt.Sprintf("%s?rd=%s", path, url.QueryEscape(r.URL.RequestURI())), http.StatusSeeOther)
+			return
+		}
+		err = fmt.Errorf("could not authorize user: %v", err)
+		HttpReplyError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	user, err := h.userManager.GetUserByID(payload.UserID)
+	if err != nil {
+		err = fmt.Errorf("could not retrieve authorized user: %v", err)
+		HttpReplyError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	rule, ok := MatchAccessRule(h.rules, r.URL.Path)
+	if ok && !rule.Allows(user, payload.Groups) {
+		HttpReplyError(w, http.StatusForbidden, errors.New("access denied by proxy rules"))
+		return
+	}
+
+	for _, header := range proxyIdentityHeaders {
+		r.Header.Del(header)
+	}
+	r.Header.Set("X-Forwarded-User", strconv.Itoa(user.ID))
+	r.Header.Set("X-Forwarded-Email", user.Email)
+	r.Header.Set("X-Forwarded-Preferred-Username", user.Name)
+	if len(payload.Groups) > 0 {
+		r.Header.Set("X-Forwarded-Groups", strings.Join(payload.Groups, ","))
+	}
+	removeProxyCredentials(r)
+
+	h.upstream.ServeHTTP(w, r)
+}
+
+// removeProxyCredentials keeps the tokens of the user from the upstream,
+// which could otherwise replay them against the API.
+func removeProxyCredentials(r *http.Request) {
+	r.Header.Del("Authorization")
+
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != "token" && cookie.Name != "mfa_token" {
+			r.AddCookie(cookie)
+		}
+	}
+}
+
+var proxyMFAForm = template.Must(template.New("mfa").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Verify sign-in</title></head>
+<body>
+<form method="POST" action="{{.Action}}">
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<input type="hidden" name="rd" value="{{.RD}}">
+<p><label>Code of your authenticator app <input name="code" autocomplete="one-time-code" inputmode="numeric" autofocus></label></p>
+<p><label>Or a recovery code <input name="recovery_code" autocomplete="off"></label></p>
+<button type="submit">Verify</button>
+</form>
+</body>
+</html>
+`))
+
+// mfa lets users who enabled multi-factor authentication complete their
+// sign-in with a code or a recovery code, which exchanges the mfa_token
+// cookie for the token.
+func (h ProxyHandler) mfa(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		HttpReplyError(w, http.StatusBadRequest, err)
+		return
+	}
+	rd := r.Form.Get("rd")
+
+	cookie, err := r.Cookie("mfa_token")
+	if err == nil {
+		_, err = h.authenticator.GetMFAPendingPayload(cookie.Value)
+	}
+	if err != nil {
+		http.SetCookie(w, &http.Cookie{Name: "mfa_token", Value: "", Path: "/", MaxAge: -1})
+		http.Redirect(w, r, fmt.Sprintf("%s?rd=%s", proxySignInPath, url.QueryEscape(rd)), http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		h.replyMFAForm(w, http.StatusOK, rd, "")
+		return
+	case http.MethodPost:
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	token, err := h.mfaManager.Verify(cookie.Value, r.PostForm.Get("code"), r.PostForm.Get("recovery_code"))
+	var invalidCredentials ErrInvalidCredentials
+	var rateLimited ErrRateLimited
+	var totpNotFound ErrTOTPNotFound
+	switch {
+	case errors.As(err, &invalidCredentials):
+		h.replyMFAForm(w, http.StatusUnauthorized, rd, "The code is invalid.")
+		return
+	case errors.As(err, &rateLimited):
+		h.replyMFAForm(w, http.StatusTooManyRequests, rd, "Too many wrong codes, try again later.")
+		return
+	case errors.As(err, &totpNotFound):
+		h.replyMFAForm(w, http.StatusBadRequest, rd, "No authenticator app is set up, enter a recovery code instead.")
+		return
+	case err != nil:
+		err = fmt.Errorf("failed to verify multi-factor authentication: %v", err)
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	redirectURL, ok := returnURL(h.singleSignOnHandler.homepageURL, rd)
+	if !ok {
+		redirectURL = h.singleSignOnHandler.homepageURL
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: "mfa_token", Value: "", Path: "/", MaxAge: -1})
+	http.SetCookie(w, proxyCookie("token", token, 0, h.singleSignOnHandler.secureCookies))
+	http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+}
+
+func (h ProxyHandler) replyMFAForm(w http.ResponseWriter, status int, rd string, message string) {
+	var buf bytes.Buffer
+	err := proxyMFAForm.Execute(&buf, struct {
+		Action string
+		RD     string
+		Error  string
+	}{
+		Action: proxyMFAPath,
+		RD:     rd,
+		Error:  message,
+	})
+	if err != nil {
+		HttpReplyError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+func (h ProxyHandler) signOut(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: "token", Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, h.singleSignOnHandler.homepageURL, http.StatusSeeOther)
+}
+
+// proxyCookie returns a cookie for a token of the proxy. It is HttpOnly, as
+// scripts of the upstream pages share the origin of the proxy, and Secure
+// when the proxy is served over https.
+func proxyCookie(name string, value string, maxAge int, secure bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func getProxyToken(r *http.Request) string {
+	if token := getToken(r); token != "" {
+		return token
+	}
+	cookie, err := r.Cookie("token")
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// AccessRule restricts a path prefix to users matching any of its emails,
+// email domains or groups. Emails and domains only match verified emails. A
+// rule without any conditions allows every signed in user.
+type AccessRule struct {
+	PathPrefix string
+	Emails     []string
+	Domains    []string
+	Groups     []string
+}
+
+func (r AccessRule) Allows(user User, groups []string) bool {
+	if len(r.Emails) == 0 && len(r.Domains) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+
+	email := strings.ToLower(user.Email)
+	if user.EmailVerified && (contains(r.Emails, email) || contains(r.Domains, emailDomain(email))) {
+		return true
+	}
+
+	for _, group := range groups {
+		if contains(r.Groups, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchAccessRule returns the rule with the longest path prefix matching
+// requestPath. Prefixes match whole segments, so /admin matches /admin/users
+// but not /administrator.
+func MatchAccessRule(rules []AccessRule, requestPath string) (AccessRule, bool) {
+	var match AccessRule
+	var ok bool
+	for _, rule := range rules {
+		if !hasPathPrefix(requestPath, rule.PathPrefix) {
+			continue
+		}
+		if !ok || len(rule.PathPrefix) > len(match.PathPrefix) {
+			match = rule
+			ok = true
+		}
+	}
+	return match, ok
+}
+
+func hasPathPrefix(requestPath string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/")
+}
+
+// cleanProxyPath resolves dot segments and repeated slashes of a request
+// path, keeping a trailing slash.
+func cleanProxyPath(requestPath string) string {
+	cleaned := path.Clean("/" + requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// ParseAccessRules parses rules of the form
+// "/admin=group:admins,email:alice@example.com;/=domain:example.com".
+func ParseAccessRules(raw string) ([]AccessRule, error) {
+	rules := []AccessRule{}
+	for _, rawRule := range strings.Split(raw, ";") {
+		rawRule = strings.TrimSpace(rawRule)
+		if rawRule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rawRule, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return nil, fmt.Errorf("invalid access rule: %s", rawRule)
+		}
+
+		rule := AccessRule{PathPrefix: strings.TrimSpace(parts[0])}
+		for _, condition := range strings.Split(parts[1], ",") {
+			condition = strings.TrimSpace(condition)
+			if condition == "" {
+				continue
+			}
+
+			kv := strings.SplitN(condition, ":", 2)
+			if len(kv) != 2 || kv[1] == "" {
+				return nil, fmt.Errorf("invalid access rule condition: %s", condition)
+			}
+
+			switch kv[0] {
+			case "email":
+				rule.Emails = append(rule.Emails, strings.ToLower(kv[1]))
+			case "domain":
+				rule.Domains = append(rule.Domains, strings.ToLower(kv[1]))
+			case "group":
+				rule.Groups = append(rule.Groups, kv[1])
+			default:
+				return nil, fmt.Errorf("unknown access rule condition: %s", kv[0])
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMatchAccessRule(t *testing.T) {
+	rules, err := ParseAccessRules("/=domain:example.com;/public=;/admin=group:admins")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"/":                    "/",
+		"/public":              "/public",
+		"/public/index.html":   "/public",
+		"/publication":         "/",
+		"/admin":               "/admin",
+		"/admin/users":         "/admin",
+		"/administrator":       "/",
+		"/public/../admin":     "/admin",
+		"/public/%2e%2e/admin": "/admin",
+		"//admin":              "/admin",
+	}
+	for requestPath, prefix := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://proxy"+requestPath, nil)
+		rule, ok := MatchAccessRule(rules, cleanProxyPath(r.URL.Path))
+		if !ok || rule.PathPrefix != prefix {
+			t.Errorf("%s: expected rule %s, got %s", requestPath, prefix, rule.PathPrefix)
+		}
+	}
+}
+
+func TestProxyHandlerForwardsCleanedPath(t *testing.T) {
+	repository := newMemoryRepository()
+	user, _ := repository.CreateUser(User{Email: "bob@example.com", EmailVerified: true})
+	authenticator := newTestAuthenticator(repository)
+	token, err := authenticator.CreateToken(user.ID, nil, []string{AMRFederated})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := ParseAccessRules("/public=;/admin=group:admins")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var forwarded string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.URL.EscapedPath()
+	})
+	handler := NewProxyHandler(
+		authenticator,
+		NewUserManager(repository),
+		NewMFAManager(nil, authenticator, SecretBox{}, ""),
+		NewProxySingleSignOnHandler(SingleSignOn{}, "https://proxy/", true),
+		upstream,
+		rules,
+	)
+
+	tests := map[string]int{
+		"/public/page":         http.StatusOK,
+		"/public/../admin":     http.StatusForbidden,
+		"/public/%2e%2e/admin": http.StatusForbidden,
+		"/public/./page":       http.StatusOK,
+	}
+	for requestPath, status := range tests {
+		forwarded = ""
+		r := httptest.NewRequest(http.MethodGet, "https://proxy"+requestPath, nil)
+		r.AddCookie(&http.Cookie{Name: "token", Value: token})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != status {
+			t.Errorf("%s: expected status %d, got %d", requestPath, status, w.Code)
+		}
+		if status == http.StatusOK && forwarded != "/public/page" {
+			t.Errorf("%s: expected /public/page to be forwarded, got %s", requestPath, forwarded)
+		}
+	}
+}
+
+func TestProxyCookie(t *testing.T) {
+	cookie := proxyCookie("token", "value", int(time.Minute.Seconds()), true)
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+		t.Errorf("expected an HttpOnly, Secure and SameSite=Lax cookie, got %+v", cookie)
+	}
+}
+
+func TestAccessRuleAllowsVerifiedEmails(t *testing.T) {
+	rule := AccessRule{PathPrefix: "/", Emails: []string{"bob@other.com"}, Domains: []string{"example.com"}}
+
+	tests := []struct {
+		user    User
+		allowed bool
+	}{
+		{User{Email: "alice@example.com", EmailVerified: true}, true},
+		{User{Email: "alice@example.com"}, false},
+		{User{Email: "bob@other.com", EmailVerified: true}, true},
+		{User{Email: "bob@other.com"}, false},
+	}
+	for _, test := range tests {
+		if allowed := rule.Allows(test.user, nil); allowed != test.allowed {
+			t.Errorf("%+v: expected %v, got %v", test.user, test.allowed, allowed)
+		}
+	}
+}
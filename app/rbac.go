@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	PermissionUsersRead        = "users:read"
+	PermissionUsersWrite       = "users:write"
+	PermissionRolesRead        = "roles:read"
+	PermissionRolesWrite       = "roles:write"
+	PermissionInvitationsWrite = "invitations:write"
+)
+
+const adminRole = "admin"
+
+type Role struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type RoleManager struct {
+	repository  RoleRepository
+	defaultRole string
+	adminEmails []string
+}
+
+func NewRoleManager(
+	repository RoleRepository,
+	defaultRole string,
+	adminEmails []string,
+) RoleManager {
+	return RoleManager{
+		repository:  repository,
+		defaultRole: defaultRole,
+		adminEmails: lowerAll(adminEmails),
+	}
+}
+
+func (m RoleManager) GetRoles() ([]Role, error) {
+	return m.repository.GetRoles()
+}
+
+func (m RoleManager) GetRole(name string) (Role, error) {
+	return m.repository.GetRoleByName(name)
+}
+
+func (m RoleManager) CreateRole(name string, description string, permissions []string) (Role, error) {
+	name = strings.TrimSpace(name)
+	if len(name) < 1 {
+		return Role{}, errors.New("role name cannot be empty")
+	}
+	return m.repository.CreateRole(Role{
+		Name:        name,
+		Description: description,
+		Permissions: permissions,
+	})
+}
+
+func (m RoleManager) GetUserRoles(userID int) ([]string, error) {
+	return m.repository.GetUserRoleNames(userID)
+}
+
+func (m RoleManager) AssignRole(userID int, roleName string) error {
+	role, err := m.repository.GetRoleByName(roleName)
+	if err != nil {
+		return err
+	}
+	return m.repository.AssignRole(userID, role.ID)
+}
+
+func (m RoleManager) UnassignRole(userID int, roleName string) error {
+	role, err := m.repository.GetRoleByName(roleName)
+	if err != nil {
+		return err
+	}
+	return m.repository.UnassignRole(userID, role.ID)
+}
+
+// AssignInitialRoles gives a newly created user the role it was invited
+// with, or the default role otherwise. Users listed as admin also get the
+// admin role, see AssignAdminRole.
+func (m RoleManager) AssignInitialRoles(user User, invitedRole string) error {
+	role := invitedRole
+	if len(role) < 1 {
+		role = m.defaultRole
+	}
+	if len(role) > 0 {
+		if err := m.AssignRole(user.ID, role); err != nil {
+			return fmt.Errorf("failed to assign role %s: %v", role, err)
+		}
+	}
+
+	return m.AssignAdminRole(user)
+}
+
+// AssignAdminRole gives the admin role to a user listed as admin, but only
+// once the email is verified, as anyone can sign up with an unverified
+// email. It is called again when the email gets verified.
+func (m RoleManager) AssignAdminRole(user User) error {
+	if !user.EmailVerified || !contains(m.adminEmails, strings.ToLower(user.Email)) {
+		return nil
+	}
+
+	if err := m.AssignRole(user.ID, adminRole); err != nil {
+		return fmt.Errorf("failed to assign role %s: %v", adminRole, err)
+	}
+	return nil
+}
+
+// BootstrapAdmins gives existing users listed as admin the admin role.
+func (m RoleManager) BootstrapAdmins(repository Repository) error {
+	for _, email := range m.adminEmails {
+		user, err := repository.GetUserByEmail(email)
+		var userNotFound ErrUserNotFound
+		if errors.As(err, &userNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := m.AssignAdminRole(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CanGrantRole reports whether users with roles may grant role to others,
+// e.g. by inviting them with it. Roles other than the default one could
+// escalate privileges, so they require the permission to manage roles.
+func (m RoleManager) CanGrantRole(roles []string, role string) (bool, error) {
+	if len(role) < 1 || role == m.defaultRole {
+		return true, nil
+	}
+	return m.HasPermission(roles, PermissionRolesWrite)
+}
+
+// HasPermission reports whether any of the roles grants permission.
+func (m RoleManager) HasPermission(roles []string, permission string) (bool, error) {
+	if len(roles) < 1 {
+		return false, nil
+	}
+
+	permissions, err := m.repository.GetRolePermissions(roles)
+	if err != nil {
+		return false, err
+	}
+	return contains(permissions, permission), nil
+}
+
+type ErrRoleNotFound string
+
+func (e ErrRoleNotFound) Error() string {
+	return string(e)
+}
+
+type contextKey string
+
+const tokenPayloadContextKey = contextKey("token_payload")
+
+// TokenPayloadFromContext returns the payload of the token that authorized
+// the request, as stored by Authorizer.
+func TokenPayloadFromContext(ctx context.Context) (TokenPayload, bool) {
+	payload, ok := ctx.Value(tokenPayloadContextKey).(TokenPayload)
+	return payload, ok
+}
+
+// StepUpRequired is the error code of requests that need a recent sign-in.
+const StepUpRequired = "step_up_required"
+
+type Authorizer struct {
+	authenticator Authenticator
+	roleManager   RoleManager
+	userManager   UserManager
+	stepUpMaxAge  time.Duration
+}
+
+func NewAuthorizer(
+	authenticator Authenticator,
+	roleManager RoleManager,
+	userManager UserManager,
+	stepUpMaxAge time.Duration,
+) Authorizer {
+	return Authorizer{
+		authenticator: authenticator,
+		roleManager:   roleManager,
+		userManager:   userManager,
+		stepUpMaxAge:  stepUpMaxAge,
+	}
+}
+
+// RequireAuthentication only lets requests through with a valid token.
+func (a Authorizer) RequireAuthentication(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		payload, err := a.authenticator.GetTokenPayload(getToken(r))
+		if err != nil {
+			err = fmt.Errorf("could not authorize user: %v", err)
+			HttpReplyError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), tokenPayloadContextKey, payload)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// RequirePermission only lets requests through of users with a role
+// granting permission. The roles are read for every request rather than
+// taken from the token, so unassigning a role takes effect right away.
+func (a Authorizer) RequirePermission(permission string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			payload, err := a.authenticator.GetTokenPayload(getToken(r))
+			if err != nil {
+				err = fmt.Errorf("could not authorize user: %v", err)
+				HttpReplyError(w, http.StatusUnauthorized, err)
+				return
+			}
+
+			roles, err := a.roleManager.GetUserRoles(payload.UserID)
+			if err != nil {
+				err = fmt.Errorf("could not retrieve roles: %v", err)
+				HttpReplyError(w, http.StatusInternalServerError, err)
+				return
+			}
+			payload.Roles = roles
+
+			ok, err := a.roleManager.HasPermission(roles, permission)
+			if err != nil {
+				err = fmt.Errorf("could not retrieve permissions: %v", err)
+				HttpReplyError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if !ok {
+				HttpReplyError(w, http.StatusForbidden, fmt.Errorf("missing permission %s", permission))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), tokenPayloadContextKey, payload)
+			next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// RequireStepUp only lets requests through whose token comes from a sign-in
+// within stepUpMaxAge, for sensitive operations. Users who enabled
+// multi-factor authentication must have used it for that sign-in. Other
+// requests get a 401 telling the client to sign in again with prompt=login
+// and max_age.
+func (a Authorizer) RequireStepUp(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		payload, err := a.authenticator.GetTokenPayload(getToken(r))
+		if err != nil {
+			err = fmt.Errorf("could not authorize user: %v", err)
+			HttpReplyError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		user, err := a.userManager.GetUserByID(payload.UserID)
+		if err != nil {
+			err = fmt.Errorf("could not retrieve authorized user: %v", err)
+			HttpReplyError(w, http.StatusUnauthorized, err)
+			return
+		}
+
+		recent := payload.AuthTime.After(time.Now().Add(-a.stepUpMaxAge))
+		mfa := !user.MFAEnabled || contains(payload.AMR, AMRMFA)
+		if !recent || !mfa {
+			message := "sign in again to continue"
+			if !mfa {
+				message = "sign in again with multi-factor authentication to continue"
+			}
+			rsp := struct {
+				Error       ErrSignInRejected `json:"error"`
+				Prompt      string            `json:"prompt"`
+				MaxAge      int               `json:"max_age"`
+				MFARequired bool              `json:"mfa_required"`
+			}{
+				Error:       ErrSignInRejected{Code: StepUpRequired, Message: message},
+				Prompt:      "login",
+				MaxAge:      int(a.stepUpMaxAge.Seconds()),
+				MFARequired: user.MFAEnabled,
+			}
+			HttpReplyJson(w, http.StatusUnauthorized, rsp)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), tokenPayloadContextKey, payload)
+		next(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestRoleManagerAssignInitialRoles(t *testing.T) {
+	repository := newMemoryRepository()
+	roleManager := NewRoleManager(repository, "member", []string{"admin@example.com"})
+
+	tests := []struct {
+		user  User
+		roles []string
+	}{
+		{User{ID: 1, Email: "Admin@example.com", EmailVerified: false}, []string{"member"}},
+		{User{ID: 2, Email: "Admin@example.com", EmailVerified: true}, []string{"member", adminRole}},
+		{User{ID: 3, Email: "bob@example.com", EmailVerified: true}, []string{"member"}},
+	}
+	for _, test := range tests {
+		if err := roleManager.AssignInitialRoles(test.user, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		roles := repository.roles[test.user.ID]
+		if len(roles) != len(test.roles) {
+			t.Errorf("user %d: expected roles %v, got %v", test.user.ID, test.roles, roles)
+			continue
+		}
+		for _, role := range test.roles {
+			if !contains(roles, role) {
+				t.Errorf("user %d: expected roles %v, got %v", test.user.ID, test.roles, roles)
+			}
+		}
+	}
+}
+
+func TestRoleManagerCanGrantRole(t *testing.T) {
+	roleManager := NewRoleManager(newMemoryRepository(), "member", nil)
+
+	tests := []struct {
+		roles []string
+		role  string
+		ok    bool
+	}{
+		{[]string{"member"}, "", true},
+		{[]string{"member"}, "member", true},
+		{[]string{"member"}, adminRole, false},
+		{[]string{adminRole}, adminRole, true},
+	}
+	for _, test := range tests {
+		ok, err := roleManager.CanGrantRole(test.roles, test.role)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.ok {
+			t.Errorf("roles %v granting %q: expected %v, got %v", test.roles, test.role, test.ok, ok)
+		}
+	}
+}
@@ -2,16 +2,129 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 type Repository interface {
 	GetUserByID(id int) (User, error)
 	GetUserByEmail(email string) (User, error)
 	CreateUser(user User) (User, error)
+	GetUserByIdentity(provider string, subject string) (User, error)
+	LinkUserIdentity(userID int, provider string, subject string) error
+	GetUserPasswordHash(userID int) (string, error)
+	SetUserPasswordHash(userID int, passwordHash string) error
+	SetUserEmailVerified(userID int) error
+	ClaimUnverifiedUser(userID int, tokensValidAfter time.Time) error
+	GetUserTokensValidAfter(userID int) (time.Time, error)
+	RevokeUserTokens(userID int, validAfter time.Time) error
+	CountPasswordFailures(userID int, since time.Time) (int, error)
+	RecordPasswordFailure(userID int, lockoutStart time.Time) error
+	ResetPasswordFailures(userID int) error
+	UseMFAPendingToken(tokenHash string, expiresAt time.Time) error
+}
+
+type InvitationRepository interface {
+	CreateInvitation(invitation Invitation, tokenHash string) (Invitation, error)
+	GetInvitationByTokenHash(tokenHash string) (Invitation, error)
+	AcceptInvitation(id int) error
+}
+
+type RoleRepository interface {
+	GetRoles() ([]Role, error)
+	GetRoleByName(name string) (Role, error)
+	CreateRole(role Role) (Role, error)
+	GetUserRoleNames(userID int) ([]string, error)
+	AssignRole(userID int, roleID int) error
+	UnassignRole(userID int, roleID int) error
+	GetRolePermissions(roleNames []string) ([]string, error)
+}
+
+type OrganizationRepository interface {
+	CreateOrganization(organization Organization, ownerID int) (Organization, error)
+	GetUserOrganizations(userID int) ([]OrganizationMembership, error)
+	GetOrganizationMembership(organizationID int, userID int) (OrganizationMembership, error)
+	GetOrganizationMembers(organizationID int) ([]Member, error)
+	AddOrganizationMember(organizationID int, userID int, role string) error
+	RemoveOrganizationMember(organizationID int, userID int) error
+	CountOrganizationOwners(organizationID int) (int, error)
+}
+
+type IdentityProviderRepository interface {
+	CreateIdentityProvider(config IdentityProviderConfig) (IdentityProviderConfig, error)
+	GetIdentityProviderByName(name string) (IdentityProviderConfig, error)
+	GetOrganizationIdentityProviders(organizationID int) ([]IdentityProviderConfig, error)
+	UpdateIdentityProvider(config IdentityProviderConfig) (IdentityProviderConfig, error)
+	DeleteIdentityProvider(id int) error
+}
+
+type MagicLinkRepository interface {
+	CreateMagicLink(link MagicLink, tokenHash string) (MagicLink, error)
+	GetMagicLinkByTokenHash(tokenHash string) (MagicLink, error)
+	UseMagicLink(id int) error
+	CountMagicLinks(email string, since time.Time) (int, error)
+}
+
+type MFARepository interface {
+	GetUserTOTP(userID int) (UserTOTP, error)
+	SaveUserTOTP(userID int, secret []byte) error
+	ConfirmUserTOTP(userID int) error
+	DeleteUserTOTP(userID int) error
+	UseTOTPStep(userID int, step int64) error
+	RecordTOTPFailure(userID int, lockoutStart time.Time) error
+	ReplaceRecoveryCodes(userID int, codeHashes []string) error
+	GetRecoveryCodes(userID int) ([]RecoveryCode, error)
+	UseRecoveryCode(userID int, codeHash string) error
+	GetRecoveryCodeUses(userID int) ([]RecoveryCodeUse, error)
+}
+
+type WebAuthnRepository interface {
+	CreateWebAuthnCredential(credential WebAuthnCredential) (WebAuthnCredential, error)
+	GetWebAuthnCredential(credentialID []byte) (WebAuthnCredential, error)
+	GetUserWebAuthnCredentials(userID int) ([]WebAuthnCredential, error)
+	UseWebAuthnCredential(id int, signCount int64) error
+	DeleteWebAuthnCredential(userID int, id int) error
+	CreateWebAuthnSession(session WebAuthnSession, challengeHash string) error
+	UseWebAuthnSession(challengeHash string) (WebAuthnSession, error)
 }
 
 var _ Repository = (*SqlRepository)(nil)
+var _ InvitationRepository = (*SqlRepository)(nil)
+var _ RoleRepository = (*SqlRepository)(nil)
+var _ OrganizationRepository = (*SqlRepository)(nil)
+var _ IdentityProviderRepository = (*SqlRepository)(nil)
+var _ MagicLinkRepository = (*SqlRepository)(nil)
+var _ MFARepository = (*SqlRepository)(nil)
+var _ WebAuthnRepository = (*SqlRepository)(nil)
+
+// updateUserMFAEnabled enables multi-factor authentication for the user as
+// long as a confirmed TOTP or a WebAuthn credential is left. Once it is
+// disabled, the recovery codes are removed, so they do not come back with
+// the next factor.
+func updateUserMFAEnabled(tx *sql.Tx, userID int) error {
+	query := `
+		UPDATE "user" SET "mfa_enabled" =
+			EXISTS (SELECT 1 FROM "user_totp" WHERE "user_id" = $1 AND "confirmed_at" IS NOT NULL)
+			OR EXISTS (SELECT 1 FROM "webauthn_credential" WHERE "user_id" = $1)
+		WHERE "id" = $1
+		RETURNING "mfa_enabled";
+	`
+	var mfaEnabled bool
+	if err := tx.QueryRow(query, userID).Scan(&mfaEnabled); err != nil {
+		return err
+	}
+	if mfaEnabled {
+		return nil
+	}
+
+	query = `DELETE FROM "recovery_code" WHERE "user_id" = $1;`
+	_, err := tx.Exec(query, userID)
+	return err
+}
 
 type SqlRepository struct {
 	db *sql.DB
@@ -22,11 +135,11 @@ func NewSqlRepository(db *sql.DB) SqlRepository {
 }
 
 func (r SqlRepository) GetUserByID(id int) (User, error) {
-	query := `SELECT "id", "email", "name", "picture" FROM "user" WHERE "id" = $1;`
+	query := `SELECT "id", "email", "name", "picture", "email_verified", "mfa_enabled" FROM "user" WHERE "id" = $1;`
 	row := r.db.QueryRow(query, id)
 
 	user := User{}
-	err := row.Scan(&user.ID, &user.Email, &user.Name, &user.Picture)
+	err := row.Scan(&user.ID, &user.Email, &user.Name, &user.Picture, &user.EmailVerified, &user.MFAEnabled)
 	if err == sql.ErrNoRows {
 		return User{}, ErrUserNotFound(fmt.Sprintf("user with id %d not found", id))
 	}
@@ -38,11 +151,11 @@ func (r SqlRepository) GetUserByID(id int) (User, error) {
 }
 
 func (r SqlRepository) GetUserByEmail(email string) (User, error) {
-	query := `SELECT "id", "email", "name", "picture" FROM "user" WHERE "email" = $1;`
+	query := `SELECT "id", "email", "name", "picture", "email_verified", "mfa_enabled" FROM "user" WHERE LOWER("email") = LOWER($1);`
 	row := r.db.QueryRow(query, email)
 
 	user := User{}
-	err := row.Scan(&user.ID, &user.Email, &user.Name, &user.Picture)
+	err := row.Scan(&user.ID, &user.Email, &user.Name, &user.Picture, &user.EmailVerified, &user.MFAEnabled)
 	if err == sql.ErrNoRows {
 		return User{}, ErrUserNotFound(fmt.Sprintf("user with email %s not found", email))
 	}
@@ -53,19 +166,1270 @@ func (r SqlRepository) GetUserByEmail(email string) (User, error) {
 	return user, nil
 }
 
+// CreateUser inserts the user with the email in lower case, failing with
+// ErrUserExists when the email is taken already in any case.
 func (r SqlRepository) CreateUser(user User) (User, error) {
 	query := `
-		INSERT INTO "user" ("email", "name", "picture")
-		VALUES ($1, $2, $3)
-		RETURNING "id", "email", "name", "picture";
+		INSERT INTO "user" ("email", "name", "picture", "email_verified")
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (LOWER("email")) DO NOTHING
+		RETURNING "id", "email", "name", "picture", "email_verified", "mfa_enabled";
 	`
-	row := r.db.QueryRow(query, user.Email, user.Name, user.Picture)
+	row := r.db.QueryRow(query, strings.ToLower(user.Email), user.Name, user.Picture, user.EmailVerified)
 
+	email := user.Email
 	user = User{}
-	err := row.Scan(&user.ID, &user.Email, &user.Name, &user.Picture)
+	err := row.Scan(&user.ID, &user.Email, &user.Name, &user.Picture, &user.EmailVerified, &user.MFAEnabled)
+	if err == sql.ErrNoRows {
+		return User{}, ErrUserExists(fmt.Sprintf("user with email %s already exists", email))
+	}
 	if err != nil {
 		return User{}, err
 	}
 
 	return user, nil
 }
+
+func (r SqlRepository) GetUserByIdentity(provider string, subject string) (User, error) {
+	query := `
+		SELECT "user"."id", "user"."email", "user"."name", "user"."picture", "user"."email_verified", "user"."mfa_enabled"
+		FROM "user_identity"
+		JOIN "user" ON "user"."id" = "user_identity"."user_id"
+		WHERE "user_identity"."provider" = $1 AND "user_identity"."subject" = $2;
+	`
+	row := r.db.QueryRow(query, provider, subject)
+
+	user := User{}
+	err := row.Scan(&user.ID, &user.Email, &user.Name, &user.Picture, &user.EmailVerified, &user.MFAEnabled)
+	if err == sql.ErrNoRows {
+		return User{}, ErrUserNotFound(fmt.Sprintf("user with %s identity %s not found", provider, subject))
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (r SqlRepository) LinkUserIdentity(userID int, provider string, subject string) error {
+	query := `
+		INSERT INTO "user_identity" ("user_id", "provider", "subject")
+		VALUES ($1, $2, $3)
+		ON CONFLICT ("provider", "subject") DO NOTHING;
+	`
+	_, err := r.db.Exec(query, userID, provider, subject)
+	return err
+}
+
+// GetUserPasswordHash returns the password hash of the user, which is empty
+// for users that only sign in with providers.
+func (r SqlRepository) GetUserPasswordHash(userID int) (string, error) {
+	query := `SELECT COALESCE("password_hash", '') FROM "user" WHERE "id" = $1;`
+	row := r.db.QueryRow(query, userID)
+
+	passwordHash := ""
+	err := row.Scan(&passwordHash)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound(fmt.Sprintf("user with id %d not found", userID))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return passwordHash, nil
+}
+
+func (r SqlRepository) SetUserPasswordHash(userID int, passwordHash string) error {
+	query := `UPDATE "user" SET "password_hash" = NULLIF($2, '') WHERE "id" = $1;`
+	_, err := r.db.Exec(query, userID, passwordHash)
+	return err
+}
+
+func (r SqlRepository) SetUserEmailVerified(userID int) error {
+	query := `UPDATE "user" SET "email_verified" = TRUE WHERE "id" = $1;`
+	_, err := r.db.Exec(query, userID)
+	return err
+}
+
+// ClaimUnverifiedUser verifies the email of the user for whoever proved to
+// own it, removing what anyone else may have set up before: the password,
+// the identities of organization providers, the second factors, the roles,
+// the organization memberships and the tokens issued so far.
+func (r SqlRepository) ClaimUnverifiedUser(userID int, tokensValidAfter time.Time) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	queries := []string{
+		`DELETE FROM "user_identity" WHERE "user_id" = $1;`,
+		`DELETE FROM "user_totp" WHERE "user_id" = $1;`,
+		`DELETE FROM "webauthn_credential" WHERE "user_id" = $1;`,
+		`DELETE FROM "recovery_code" WHERE "user_id" = $1;`,
+		`DELETE FROM "user_role" WHERE "user_id" = $1;`,
+		`DELETE FROM "organization_member" WHERE "user_id" = $1;`,
+	}
+	for _, query := range queries {
+		if _, err := tx.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+
+	query := `
+		UPDATE "user"
+		SET "password_hash" = NULL, "email_verified" = TRUE, "mfa_enabled" = FALSE, "tokens_valid_after" = $2
+		WHERE "id" = $1;
+	`
+	if _, err := tx.Exec(query, userID, tokensValidAfter); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetUserTokensValidAfter returns when the tokens of the user were last
+// revoked, which is the zero time if they never were.
+func (r SqlRepository) GetUserTokensValidAfter(userID int) (time.Time, error) {
+	query := `SELECT "tokens_valid_after" FROM "user" WHERE "id" = $1;`
+	row := r.db.QueryRow(query, userID)
+
+	var validAfter sql.NullTime
+	err := row.Scan(&validAfter)
+	if err == sql.ErrNoRows {
+		return time.Time{}, ErrUserNotFound(fmt.Sprintf("user with id %d not found", userID))
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return validAfter.Time, nil
+}
+
+// RevokeUserTokens invalidates the tokens of the user issued before
+// validAfter.
+func (r SqlRepository) RevokeUserTokens(userID int, validAfter time.Time) error {
+	query := `UPDATE "user" SET "tokens_valid_after" = $2 WHERE "id" = $1;`
+	_, err := r.db.Exec(query, userID, validAfter)
+	return err
+}
+
+// UseMFAPendingToken records an mfa_pending token as used until it expires,
+// failing with ErrMFAPendingTokenUsed when it was used before.
+func (r SqlRepository) UseMFAPendingToken(tokenHash string, expiresAt time.Time) error {
+	query := `DELETE FROM "used_mfa_pending_token" WHERE "expires_at" < NOW();`
+	if _, err := r.db.Exec(query); err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO "used_mfa_pending_token" ("token_hash", "expires_at")
+		VALUES ($1, $2)
+		ON CONFLICT ("token_hash") DO NOTHING;
+	`
+	res, err := r.db.Exec(query, tokenHash, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrMFAPendingTokenUsed("mfa_pending token was used already")
+	}
+
+	return nil
+}
+
+// CountPasswordFailures returns the wrong passwords entered for the user
+// since the given time.
+func (r SqlRepository) CountPasswordFailures(userID int, since time.Time) (int, error) {
+	query := `
+		SELECT CASE WHEN "password_last_failed_at" >= $2 THEN "password_failed_attempts" ELSE 0 END
+		FROM "user" WHERE "id" = $1;
+	`
+	row := r.db.QueryRow(query, userID, since)
+
+	count := 0
+	err := row.Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, ErrUserNotFound(fmt.Sprintf("user with id %d not found", userID))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// RecordPasswordFailure counts a wrong password. Failures before
+// lockoutStart no longer count.
+func (r SqlRepository) RecordPasswordFailure(userID int, lockoutStart time.Time) error {
+	query := `
+		UPDATE "user"
+		SET "password_failed_attempts" = CASE
+				WHEN "password_last_failed_at" IS NULL OR "password_last_failed_at" < $2 THEN 1
+				ELSE "password_failed_attempts" + 1
+			END,
+			"password_last_failed_at" = NOW()
+		WHERE "id" = $1;
+	`
+	_, err := r.db.Exec(query, userID, lockoutStart)
+	return err
+}
+
+func (r SqlRepository) ResetPasswordFailures(userID int) error {
+	query := `UPDATE "user" SET "password_failed_attempts" = 0 WHERE "id" = $1;`
+	_, err := r.db.Exec(query, userID)
+	return err
+}
+
+func (r SqlRepository) CreateInvitation(invitation Invitation, tokenHash string) (Invitation, error) {
+	query := `
+		INSERT INTO "invitation" (
+			"email", "role", "organization_id", "organization_role", "token_hash", "created_by", "expires_at"
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING "id", "email", "role", "organization_id", "organization_role",
+			"created_by", "expires_at", "accepted_at", "created_at";
+	`
+	organizationID := sql.NullInt64{
+		Int64: int64(invitation.OrganizationID),
+		Valid: invitation.OrganizationID > 0,
+	}
+	row := r.db.QueryRow(
+		query,
+		invitation.Email,
+		invitation.Role,
+		organizationID,
+		invitation.OrganizationRole,
+		tokenHash,
+		invitation.CreatedBy,
+		invitation.ExpiresAt,
+	)
+
+	invitation, err := scanInvitation(row)
+	if err != nil {
+		return Invitation{}, err
+	}
+
+	return invitation, nil
+}
+
+func (r SqlRepository) GetInvitationByTokenHash(tokenHash string) (Invitation, error) {
+	query := `
+		SELECT "id", "email", "role", "organization_id", "organization_role",
+			"created_by", "expires_at", "accepted_at", "created_at"
+		FROM "invitation" WHERE "token_hash" = $1;
+	`
+	row := r.db.QueryRow(query, tokenHash)
+
+	invitation, err := scanInvitation(row)
+	if err == sql.ErrNoRows {
+		return Invitation{}, ErrInvitationNotFound("invitation not found")
+	}
+	if err != nil {
+		return Invitation{}, err
+	}
+
+	return invitation, nil
+}
+
+func (r SqlRepository) AcceptInvitation(id int) error {
+	query := `UPDATE "invitation" SET "accepted_at" = NOW() WHERE "id" = $1 AND "accepted_at" IS NULL;`
+	res, err := r.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrInvitationNotFound(fmt.Sprintf("open invitation with id %d not found", id))
+	}
+
+	return nil
+}
+
+func scanInvitation(row *sql.Row) (Invitation, error) {
+	invitation := Invitation{}
+	var organizationID sql.NullInt64
+	var acceptedAt sql.NullTime
+	err := row.Scan(
+		&invitation.ID,
+		&invitation.Email,
+		&invitation.Role,
+		&organizationID,
+		&invitation.OrganizationRole,
+		&invitation.CreatedBy,
+		&invitation.ExpiresAt,
+		&acceptedAt,
+		&invitation.CreatedAt,
+	)
+	if err != nil {
+		return Invitation{}, err
+	}
+
+	invitation.OrganizationID = int(organizationID.Int64)
+	if acceptedAt.Valid {
+		invitation.AcceptedAt = &acceptedAt.Time
+	}
+
+	return invitation, nil
+}
+
+func (r SqlRepository) CreateMagicLink(link MagicLink, tokenHash string) (MagicLink, error) {
+	query := `
+		INSERT INTO "magic_link" ("email", "token_hash", "browser_hash", "expires_at")
+		VALUES ($1, $2, $3, $4)
+		RETURNING "id", "email", "browser_hash", "expires_at", "used_at", "created_at";
+	`
+	row := r.db.QueryRow(query, link.Email, tokenHash, link.BrowserHash, link.ExpiresAt)
+
+	return scanMagicLink(row)
+}
+
+func (r SqlRepository) GetMagicLinkByTokenHash(tokenHash string) (MagicLink, error) {
+	query := `
+		SELECT "id", "email", "browser_hash", "expires_at", "used_at", "created_at"
+		FROM "magic_link" WHERE "token_hash" = $1;
+	`
+	row := r.db.QueryRow(query, tokenHash)
+
+	link, err := scanMagicLink(row)
+	if err == sql.ErrNoRows {
+		return MagicLink{}, ErrMagicLinkNotFound("magic link not found")
+	}
+	if err != nil {
+		return MagicLink{}, err
+	}
+
+	return link, nil
+}
+
+func (r SqlRepository) UseMagicLink(id int) error {
+	query := `UPDATE "magic_link" SET "used_at" = NOW() WHERE "id" = $1 AND "used_at" IS NULL;`
+	res, err := r.db.Exec(query, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrMagicLinkNotFound(fmt.Sprintf("unused magic link with id %d not found", id))
+	}
+
+	return nil
+}
+
+// CountMagicLinks counts the links requested for email since the given time,
+// ignoring the case of the email.
+func (r SqlRepository) CountMagicLinks(email string, since time.Time) (int, error) {
+	query := `SELECT COUNT(*) FROM "magic_link" WHERE LOWER("email") = LOWER($1) AND "created_at" > $2;`
+	row := r.db.QueryRow(query, email, since)
+
+	count := 0
+	err := row.Scan(&count)
+	return count, err
+}
+
+func scanMagicLink(row *sql.Row) (MagicLink, error) {
+	link := MagicLink{}
+	var usedAt sql.NullTime
+	err := row.Scan(
+		&link.ID,
+		&link.Email,
+		&link.BrowserHash,
+		&link.ExpiresAt,
+		&usedAt,
+		&link.CreatedAt,
+	)
+	if err != nil {
+		return MagicLink{}, err
+	}
+
+	if usedAt.Valid {
+		link.UsedAt = &usedAt.Time
+	}
+
+	return link, nil
+}
+
+func (r SqlRepository) GetUserTOTP(userID int) (UserTOTP, error) {
+	query := `
+		SELECT "user_id", "secret", "confirmed_at", "last_step", "failed_attempts", "last_failed_at"
+		FROM "user_totp" WHERE "user_id" = $1;
+	`
+	row := r.db.QueryRow(query, userID)
+
+	totp := UserTOTP{}
+	var confirmedAt, lastFailedAt sql.NullTime
+	err := row.Scan(
+		&totp.UserID,
+		&totp.Secret,
+		&confirmedAt,
+		&totp.LastStep,
+		&totp.FailedAttempts,
+		&lastFailedAt,
+	)
+	if err == sql.ErrNoRows {
+		return UserTOTP{}, ErrTOTPNotFound(fmt.Sprintf("totp of user %d not found", userID))
+	}
+	if err != nil {
+		return UserTOTP{}, err
+	}
+
+	if confirmedAt.Valid {
+		totp.ConfirmedAt = &confirmedAt.Time
+	}
+	if lastFailedAt.Valid {
+		totp.LastFailedAt = &lastFailedAt.Time
+	}
+
+	return totp, nil
+}
+
+// SaveUserTOTP stores a new, unconfirmed secret for the user, replacing any
+// previous one.
+func (r SqlRepository) SaveUserTOTP(userID int, secret []byte) error {
+	query := `
+		INSERT INTO "user_totp" ("user_id", "secret") VALUES ($1, $2)
+		ON CONFLICT ("user_id") DO UPDATE
+		SET "secret" = $2, "confirmed_at" = NULL, "last_step" = 0, "failed_attempts" = 0, "last_failed_at" = NULL;
+	`
+	_, err := r.db.Exec(query, userID, secret)
+	return err
+}
+
+func (r SqlRepository) ConfirmUserTOTP(userID int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE "user_totp" SET "confirmed_at" = NOW() WHERE "user_id" = $1;`
+	if _, err := tx.Exec(query, userID); err != nil {
+		return err
+	}
+
+	if err := updateUserMFAEnabled(tx, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r SqlRepository) DeleteUserTOTP(userID int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM "user_totp" WHERE "user_id" = $1;`
+	if _, err := tx.Exec(query, userID); err != nil {
+		return err
+	}
+
+	if err := updateUserMFAEnabled(tx, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records the time step of an accepted code, so the code cannot
+// be used again.
+func (r SqlRepository) UseTOTPStep(userID int, step int64) error {
+	query := `
+		UPDATE "user_totp" SET "last_step" = $2, "failed_attempts" = 0
+		WHERE "user_id" = $1 AND "last_step" < $2;
+	`
+	res, err := r.db.Exec(query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrTOTPNotFound(fmt.Sprintf("totp of user %d before step %d not found", userID, step))
+	}
+
+	return nil
+}
+
+// RecordTOTPFailure counts a wrong code. Failures before lockoutStart no
+// longer count.
+func (r SqlRepository) RecordTOTPFailure(userID int, lockoutStart time.Time) error {
+	query := `
+		UPDATE "user_totp"
+		SET "failed_attempts" = CASE
+				WHEN "last_failed_at" IS NULL OR "last_failed_at" < $2 THEN 1
+				ELSE "failed_attempts" + 1
+			END,
+			"last_failed_at" = NOW()
+		WHERE "user_id" = $1;
+	`
+	_, err := r.db.Exec(query, userID, lockoutStart)
+	return err
+}
+
+// CreateWebAuthnCredential stores the credential and enables multi-factor
+// authentication for its user.
+func (r SqlRepository) CreateWebAuthnCredential(credential WebAuthnCredential) (WebAuthnCredential, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO "webauthn_credential"
+			("user_id", "credential_id", "public_key", "sign_count", "transports", "attestation_format", "aaguid", "name")
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING "id", "user_id", "credential_id", "public_key", "sign_count", "transports",
+			"attestation_format", "aaguid", "name", "created_at", "last_used_at";
+	`
+	row := tx.QueryRow(
+		query,
+		credential.UserID,
+		credential.CredentialID,
+		credential.PublicKey,
+		credential.SignCount,
+		pq.Array(credential.Transports),
+		credential.AttestationFormat,
+		credential.AAGUID,
+		credential.Name,
+	)
+	credential, err = scanWebAuthnCredential(row)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	if err := updateUserMFAEnabled(tx, credential.UserID); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	return credential, tx.Commit()
+}
+
+func (r SqlRepository) GetWebAuthnCredential(credentialID []byte) (WebAuthnCredential, error) {
+	query := `
+		SELECT "id", "user_id", "credential_id", "public_key", "sign_count", "transports",
+			"attestation_format", "aaguid", "name", "created_at", "last_used_at"
+		FROM "webauthn_credential" WHERE "credential_id" = $1;
+	`
+	row := r.db.QueryRow(query, credentialID)
+
+	credential, err := scanWebAuthnCredential(row)
+	if err == sql.ErrNoRows {
+		return WebAuthnCredential{}, ErrWebAuthnCredentialNotFound("webauthn credential not found")
+	}
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	return credential, nil
+}
+
+func (r SqlRepository) GetUserWebAuthnCredentials(userID int) ([]WebAuthnCredential, error) {
+	query := `
+		SELECT "id", "user_id", "credential_id", "public_key", "sign_count", "transports",
+			"attestation_format", "aaguid", "name", "created_at", "last_used_at"
+		FROM "webauthn_credential" WHERE "user_id" = $1
+		ORDER BY "created_at";
+	`
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	credentials := []WebAuthnCredential{}
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, rows.Err()
+}
+
+func (r SqlRepository) UseWebAuthnCredential(id int, signCount int64) error {
+	query := `UPDATE "webauthn_credential" SET "sign_count" = $2, "last_used_at" = NOW() WHERE "id" = $1;`
+	_, err := r.db.Exec(query, id, signCount)
+	return err
+}
+
+// DeleteWebAuthnCredential deletes a credential of the user and disables
+// multi-factor authentication if it was the last factor.
+func (r SqlRepository) DeleteWebAuthnCredential(userID int, id int) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM "webauthn_credential" WHERE "id" = $1 AND "user_id" = $2;`
+	res, err := tx.Exec(query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrWebAuthnCredentialNotFound(fmt.Sprintf("webauthn credential with id %d not found", id))
+	}
+
+	if err := updateUserMFAEnabled(tx, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CreateWebAuthnSession stores the challenge of a ceremony. Expired sessions
+// are removed on the way.
+func (r SqlRepository) CreateWebAuthnSession(session WebAuthnSession, challengeHash string) error {
+	query := `DELETE FROM "webauthn_session" WHERE "expires_at" < NOW();`
+	if _, err := r.db.Exec(query); err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO "webauthn_session" ("challenge_hash", "user_id", "purpose", "expires_at")
+		VALUES ($1, NULLIF($2, 0), $3, $4);
+	`
+	_, err := r.db.Exec(query, challengeHash, session.UserID, session.Purpose, session.ExpiresAt)
+	return err
+}
+
+// UseWebAuthnSession deletes the session of the challenge and returns it, so
+// each challenge is answered once.
+func (r SqlRepository) UseWebAuthnSession(challengeHash string) (WebAuthnSession, error) {
+	query := `
+		DELETE FROM "webauthn_session" WHERE "challenge_hash" = $1
+		RETURNING COALESCE("user_id", 0), "purpose", "expires_at";
+	`
+	row := r.db.QueryRow(query, challengeHash)
+
+	session := WebAuthnSession{}
+	err := row.Scan(&session.UserID, &session.Purpose, &session.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return WebAuthnSession{}, ErrWebAuthnSessionNotFound("webauthn session not found")
+	}
+	if err != nil {
+		return WebAuthnSession{}, err
+	}
+
+	return session, nil
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWebAuthnCredential(row rowScanner) (WebAuthnCredential, error) {
+	credential := WebAuthnCredential{}
+	var lastUsedAt sql.NullTime
+	err := row.Scan(
+		&credential.ID,
+		&credential.UserID,
+		&credential.CredentialID,
+		&credential.PublicKey,
+		&credential.SignCount,
+		pq.Array(&credential.Transports),
+		&credential.AttestationFormat,
+		&credential.AAGUID,
+		&credential.Name,
+		&credential.CreatedAt,
+		&lastUsedAt,
+	)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	if lastUsedAt.Valid {
+		credential.LastUsedAt = &lastUsedAt.Time
+	}
+
+	return credential, nil
+}
+
+// ReplaceRecoveryCodes replaces all recovery codes of the user, used or not.
+func (r SqlRepository) ReplaceRecoveryCodes(userID int, codeHashes []string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `DELETE FROM "recovery_code" WHERE "user_id" = $1;`
+	if _, err := tx.Exec(query, userID); err != nil {
+		return err
+	}
+
+	query = `INSERT INTO "recovery_code" ("user_id", "code_hash") SELECT $1, UNNEST($2::TEXT[]);`
+	if _, err := tx.Exec(query, userID, pq.Array(codeHashes)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r SqlRepository) GetRecoveryCodes(userID int) ([]RecoveryCode, error) {
+	query := `
+		SELECT "id", "used_at", "created_at" FROM "recovery_code"
+		WHERE "user_id" = $1 ORDER BY "id";
+	`
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	codes := []RecoveryCode{}
+	for rows.Next() {
+		code := RecoveryCode{}
+		var usedAt sql.NullTime
+		if err := rows.Scan(&code.ID, &usedAt, &code.CreatedAt); err != nil {
+			return nil, err
+		}
+		if usedAt.Valid {
+			code.UsedAt = &usedAt.Time
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, rows.Err()
+}
+
+// UseRecoveryCode marks the code as used and records the use, which is kept
+// when the codes are replaced or removed.
+func (r SqlRepository) UseRecoveryCode(userID int, codeHash string) error {
+	query := `
+		WITH "used" AS (
+			UPDATE "recovery_code" SET "used_at" = NOW()
+			WHERE "user_id" = $1 AND "code_hash" = $2 AND "used_at" IS NULL
+			RETURNING "user_id", "used_at"
+		)
+		INSERT INTO "recovery_code_use" ("user_id", "used_at")
+		SELECT "user_id", "used_at" FROM "used";
+	`
+	res, err := r.db.Exec(query, userID, codeHash)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrRecoveryCodeNotFound(fmt.Sprintf("unused recovery code of user %d not found", userID))
+	}
+
+	return nil
+}
+
+// GetRecoveryCodeUses lists when the user used recovery codes, latest first.
+func (r SqlRepository) GetRecoveryCodeUses(userID int) ([]RecoveryCodeUse, error) {
+	query := `
+		SELECT "id", "used_at" FROM "recovery_code_use"
+		WHERE "user_id" = $1 ORDER BY "id" DESC;
+	`
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uses := []RecoveryCodeUse{}
+	for rows.Next() {
+		use := RecoveryCodeUse{}
+		if err := rows.Scan(&use.ID, &use.UsedAt); err != nil {
+			return nil, err
+		}
+		uses = append(uses, use)
+	}
+
+	return uses, rows.Err()
+}
+
+func (r SqlRepository) GetRoles() ([]Role, error) {
+	query := `
+		SELECT "role"."id", "role"."name", "role"."description",
+			COALESCE(ARRAY_AGG("permission"."name" ORDER BY "permission"."name") FILTER (WHERE "permission"."name" IS NOT NULL), '{}')
+		FROM "role"
+		LEFT JOIN "role_permission" ON "role_permission"."role_id" = "role"."id"
+		LEFT JOIN "permission" ON "permission"."id" = "role_permission"."permission_id"
+		GROUP BY "role"."id"
+		ORDER BY "role"."name";
+	`
+	rows, err := r.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		role := Role{}
+		err := rows.Scan(&role.ID, &role.Name, &role.Description, pq.Array(&role.Permissions))
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, rows.Err()
+}
+
+func (r SqlRepository) GetRoleByName(name string) (Role, error) {
+	query := `
+		SELECT "role"."id", "role"."name", "role"."description",
+			COALESCE(ARRAY_AGG("permission"."name" ORDER BY "permission"."name") FILTER (WHERE "permission"."name" IS NOT NULL), '{}')
+		FROM "role"
+		LEFT JOIN "role_permission" ON "role_permission"."role_id" = "role"."id"
+		LEFT JOIN "permission" ON "permission"."id" = "role_permission"."permission_id"
+		WHERE "role"."name" = $1
+		GROUP BY "role"."id";
+	`
+	row := r.db.QueryRow(query, name)
+
+	role := Role{}
+	err := row.Scan(&role.ID, &role.Name, &role.Description, pq.Array(&role.Permissions))
+	if err == sql.ErrNoRows {
+		return Role{}, ErrRoleNotFound(fmt.Sprintf("role %s not found", name))
+	}
+	if err != nil {
+		return Role{}, err
+	}
+
+	return role, nil
+}
+
+func (r SqlRepository) CreateRole(role Role) (Role, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return Role{}, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO "role" ("name", "description") VALUES ($1, $2) RETURNING "id";`
+	if err := tx.QueryRow(query, role.Name, role.Description).Scan(&role.ID); err != nil {
+		return Role{}, err
+	}
+
+	query = `
+		INSERT INTO "role_permission" ("role_id", "permission_id")
+		SELECT $1, "id" FROM "permission" WHERE "name" = ANY($2);
+	`
+	res, err := tx.Exec(query, role.ID, pq.Array(role.Permissions))
+	if err != nil {
+		return Role{}, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Role{}, err
+	}
+	if int(n) != len(role.Permissions) {
+		return Role{}, fmt.Errorf("unknown permissions in %v", role.Permissions)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Role{}, err
+	}
+
+	return role, nil
+}
+
+func (r SqlRepository) GetUserRoleNames(userID int) ([]string, error) {
+	query := `
+		SELECT "role"."name"
+		FROM "user_role"
+		JOIN "role" ON "role"."id" = "user_role"."role_id"
+		WHERE "user_role"."user_id" = $1
+		ORDER BY "role"."name";
+	`
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+func (r SqlRepository) AssignRole(userID int, roleID int) error {
+	query := `
+		INSERT INTO "user_role" ("user_id", "role_id") VALUES ($1, $2)
+		ON CONFLICT DO NOTHING;
+	`
+	_, err := r.db.Exec(query, userID, roleID)
+	return err
+}
+
+func (r SqlRepository) UnassignRole(userID int, roleID int) error {
+	query := `DELETE FROM "user_role" WHERE "user_id" = $1 AND "role_id" = $2;`
+	_, err := r.db.Exec(query, userID, roleID)
+	return err
+}
+
+func (r SqlRepository) GetRolePermissions(roleNames []string) ([]string, error) {
+	query := `
+		SELECT DISTINCT "permission"."name"
+		FROM "role"
+		JOIN "role_permission" ON "role_permission"."role_id" = "role"."id"
+		JOIN "permission" ON "permission"."id" = "role_permission"."permission_id"
+		WHERE "role"."name" = ANY($1);
+	`
+	rows, err := r.db.Query(query, pq.Array(roleNames))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []string{}
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+
+	return permissions, rows.Err()
+}
+
+func (r SqlRepository) CreateOrganization(organization Organization, ownerID int) (Organization, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return Organization{}, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO "organization" ("name", "slug") VALUES ($1, $2)
+		RETURNING "id", "name", "slug", "created_at";
+	`
+	row := tx.QueryRow(query, organization.Name, organization.Slug)
+
+	organization = Organization{}
+	err = row.Scan(&organization.ID, &organization.Name, &organization.Slug, &organization.CreatedAt)
+	if err != nil {
+		return Organization{}, err
+	}
+
+	query = `INSERT INTO "organization_member" ("organization_id", "user_id", "role") VALUES ($1, $2, $3);`
+	if _, err := tx.Exec(query, organization.ID, ownerID, OrganizationOwner); err != nil {
+		return Organization{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Organization{}, err
+	}
+
+	return organization, nil
+}
+
+func (r SqlRepository) GetUserOrganizations(userID int) ([]OrganizationMembership, error) {
+	query := `
+		SELECT "organization"."id", "organization"."name", "organization"."slug", "organization"."created_at",
+			"organization_member"."role"
+		FROM "organization_member"
+		JOIN "organization" ON "organization"."id" = "organization_member"."organization_id"
+		WHERE "organization_member"."user_id" = $1
+		ORDER BY "organization"."name";
+	`
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []OrganizationMembership{}
+	for rows.Next() {
+		membership := OrganizationMembership{}
+		err := rows.Scan(
+			&membership.Organization.ID,
+			&membership.Organization.Name,
+			&membership.Organization.Slug,
+			&membership.Organization.CreatedAt,
+			&membership.Role,
+		)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, membership)
+	}
+
+	return memberships, rows.Err()
+}
+
+func (r SqlRepository) GetOrganizationMembership(organizationID int, userID int) (OrganizationMembership, error) {
+	query := `
+		SELECT "organization"."id", "organization"."name", "organization"."slug", "organization"."created_at",
+			"organization_member"."role"
+		FROM "organization_member"
+		JOIN "organization" ON "organization"."id" = "organization_member"."organization_id"
+		WHERE "organization_member"."organization_id" = $1 AND "organization_member"."user_id" = $2;
+	`
+	row := r.db.QueryRow(query, organizationID, userID)
+
+	membership := OrganizationMembership{}
+	err := row.Scan(
+		&membership.Organization.ID,
+		&membership.Organization.Name,
+		&membership.Organization.Slug,
+		&membership.Organization.CreatedAt,
+		&membership.Role,
+	)
+	if err == sql.ErrNoRows {
+		return OrganizationMembership{}, ErrOrganizationNotFound(
+			fmt.Sprintf("organization with id %d not found for user %d", organizationID, userID),
+		)
+	}
+	if err != nil {
+		return OrganizationMembership{}, err
+	}
+
+	return membership, nil
+}
+
+func (r SqlRepository) GetOrganizationMembers(organizationID int) ([]Member, error) {
+	query := `
+		SELECT "user"."id", "user"."email", "user"."name", "user"."picture",
+			"organization_member"."role", "organization_member"."created_at"
+		FROM "organization_member"
+		JOIN "user" ON "user"."id" = "organization_member"."user_id"
+		WHERE "organization_member"."organization_id" = $1
+		ORDER BY "user"."name";
+	`
+	rows, err := r.db.Query(query, organizationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		member := Member{}
+		err := rows.Scan(
+			&member.User.ID,
+			&member.User.Email,
+			&member.User.Name,
+			&member.User.Picture,
+			&member.Role,
+			&member.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+func (r SqlRepository) AddOrganizationMember(organizationID int, userID int, role string) error {
+	query := `
+		INSERT INTO "organization_member" ("organization_id", "user_id", "role") VALUES ($1, $2, $3)
+		ON CONFLICT ("organization_id", "user_id") DO UPDATE SET "role" = EXCLUDED."role";
+	`
+	_, err := r.db.Exec(query, organizationID, userID, role)
+	return err
+}
+
+func (r SqlRepository) RemoveOrganizationMember(organizationID int, userID int) error {
+	query := `DELETE FROM "organization_member" WHERE "organization_id" = $1 AND "user_id" = $2;`
+	_, err := r.db.Exec(query, organizationID, userID)
+	return err
+}
+
+func (r SqlRepository) CountOrganizationOwners(organizationID int) (int, error) {
+	query := `SELECT COUNT(*) FROM "organization_member" WHERE "organization_id" = $1 AND "role" = $2;`
+	row := r.db.QueryRow(query, organizationID, OrganizationOwner)
+
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (r SqlRepository) CreateIdentityProvider(config IdentityProviderConfig) (IdentityProviderConfig, error) {
+	query := `
+		INSERT INTO "identity_provider" (
+			"organization_id", "name", "type", "client_id", "client_secret", "scopes", "issuer", "options", "enabled"
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING "id", "organization_id", "name", "type", "client_id", "client_secret",
+			"scopes", "issuer", "options", "enabled", "created_at";
+	`
+	options, err := json.Marshal(config.Options)
+	if err != nil {
+		return IdentityProviderConfig{}, err
+	}
+
+	row := r.db.QueryRow(
+		query,
+		config.OrganizationID,
+		config.Name,
+		config.Type,
+		config.ClientID,
+		config.EncryptedClientSecret,
+		pq.Array(config.Scopes),
+		config.Issuer,
+		options,
+		config.Enabled,
+	)
+
+	return scanIdentityProvider(row)
+}
+
+func (r SqlRepository) GetIdentityProviderByName(name string) (IdentityProviderConfig, error) {
+	query := `
+		SELECT "id", "organization_id", "name", "type", "client_id", "client_secret",
+			"scopes", "issuer", "options", "enabled", "created_at"
+		FROM "identity_provider" WHERE "name" = $1;
+	`
+	row := r.db.QueryRow(query, name)
+
+	config, err := scanIdentityProvider(row)
+	if err == sql.ErrNoRows {
+		return IdentityProviderConfig{}, ErrIdentityProviderNotFound(fmt.Sprintf("identity provider %s not found", name))
+	}
+	if err != nil {
+		return IdentityProviderConfig{}, err
+	}
+
+	return config, nil
+}
+
+func (r SqlRepository) GetOrganizationIdentityProviders(organizationID int) ([]IdentityProviderConfig, error) {
+	query := `
+		SELECT "id", "organization_id", "name", "type", "client_id", "client_secret",
+			"scopes", "issuer", "options", "enabled", "created_at"
+		FROM "identity_provider" WHERE "organization_id" = $1
+		ORDER BY "name";
+	`
+	rows, err := r.db.Query(query, organizationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	configs := []IdentityProviderConfig{}
+	for rows.Next() {
+		config, err := scanIdentityProvider(rows)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+
+	return configs, rows.Err()
+}
+
+func (r SqlRepository) UpdateIdentityProvider(config IdentityProviderConfig) (IdentityProviderConfig, error) {
+	query := `
+		UPDATE "identity_provider"
+		SET "type" = $2, "client_id" = $3, "client_secret" = $4, "scopes" = $5, "issuer" = $6,
+			"options" = $7, "enabled" = $8
+		WHERE "id" = $1
+		RETURNING "id", "organization_id", "name", "type", "client_id", "client_secret",
+			"scopes", "issuer", "options", "enabled", "created_at";
+	`
+	options, err := json.Marshal(config.Options)
+	if err != nil {
+		return IdentityProviderConfig{}, err
+	}
+
+	row := r.db.QueryRow(
+		query,
+		config.ID,
+		config.Type,
+		config.ClientID,
+		config.EncryptedClientSecret,
+		pq.Array(config.Scopes),
+		config.Issuer,
+		options,
+		config.Enabled,
+	)
+
+	updated, err := scanIdentityProvider(row)
+	if err == sql.ErrNoRows {
+		return IdentityProviderConfig{}, ErrIdentityProviderNotFound(fmt.Sprintf("identity provider %s not found", config.Name))
+	}
+	if err != nil {
+		return IdentityProviderConfig{}, err
+	}
+
+	return updated, nil
+}
+
+func (r SqlRepository) DeleteIdentityProvider(id int) error {
+	query := `DELETE FROM "identity_provider" WHERE "id" = $1;`
+	_, err := r.db.Exec(query, id)
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanIdentityProvider(row scanner) (IdentityProviderConfig, error) {
+	config := IdentityProviderConfig{}
+	options := []byte{}
+	err := row.Scan(
+		&config.ID,
+		&config.OrganizationID,
+		&config.Name,
+		&config.Type,
+		&config.ClientID,
+		&config.EncryptedClientSecret,
+		pq.Array(&config.Scopes),
+		&config.Issuer,
+		&options,
+		&config.Enabled,
+		&config.CreatedAt,
+	)
+	if err != nil {
+		return IdentityProviderConfig{}, err
+	}
+
+	if err := json.Unmarshal(options, &config.Options); err != nil {
+		return IdentityProviderConfig{}, fmt.Errorf("invalid identity provider options: %v", err)
+	}
+
+	return config, nil
+}
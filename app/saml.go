@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	samlBindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlBindingPost     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlStatusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer          = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlNameIDTransient = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+	samlNameIDEmail     = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+
+	// samlRequestLifetime is how long a user has to sign in at the IdP.
+	samlRequestLifetime = 10 * time.Minute
+	// samlClockSkew is tolerated between the clocks of the IdP and the SP.
+	samlClockSkew = 3 * time.Minute
+)
+
+// Attributes the email, name and groups of users are commonly released in,
+// used when no attribute is configured.
+var (
+	samlEmailAttributes = []string{
+		"email",
+		"mail",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+		"urn:oid:0.9.2342.19200300.100.1.3",
+	}
+	samlNameAttributes = []string{
+		"name",
+		"displayName",
+		"http://schemas.microsoft.com/identity/claims/displayname",
+		"urn:oid:2.16.840.1.113730.3.1.241",
+	}
+	samlGroupsAttributes = []string{
+		"groups",
+		"http://schemas.microsoft.com/ws/2008/06/identity/claims/groups",
+	}
+)
+
+// SAMLConfig describes a SAML service provider and the IdP it trusts.
+type SAMLConfig struct {
+	EntityID        string
+	ACSURL          string
+	IdPMetadata     string
+	Binding         string
+	EmailAttribute  string
+	NameAttribute   string
+	GroupsAttribute string
+}
+
+// samlStatusError categorizes the status of an unsuccessful response like
+// the error of an OAuth 2.0 callback.
+func samlStatusError(response *etree.Element) error {
+	reason := response.FindElement("./Status/StatusCode").SelectAttrValue("Value", "")
+	if subStatus := response.FindElement("./Status/StatusCode/StatusCode"); subStatus != nil {
+		reason = subStatus.SelectAttrValue("Value", reason)
+	}
+	reason = strings.TrimPrefix(reason, "urn:oasis:names:tc:SAML:2.0:status:")
+
+	code := SignInProviderMisconfigured
+	switch reason {
+	case "AuthnFailed", "RequestDenied":
+		code = SignInCancelled
+	case "NoPassive":
+		code = SignInInteractionRequired
+	case "Responder", "ProxyCountExceeded":
+		code = SignInProviderUnavailable
+	}
+
+	description := ""
+	if message := response.FindElement("./Status/StatusMessage"); message != nil {
+		description = message.Text()
+	}
+
+	return ErrAuthorizationFailed{
+		Provider:    "saml",
+		Code:        code,
+		Reason:      reason,
+		Description: description,
+	}
+}
+
+// NewSAMLConfig reads the configuration of a SAML service provider from the
+// options of an identity provider.
+func NewSAMLConfig(options map[string]string, entityID string, acsURL string) SAMLConfig {
+	return SAMLConfig{
+		EntityID:        entityID,
+		ACSURL:          acsURL,
+		IdPMetadata:     options["idp_metadata"],
+		Binding:         options["binding"],
+		EmailAttribute:  options["email_attribute"],
+		NameAttribute:   options["name_attribute"],
+		GroupsAttribute: options["groups_attribute"],
+	}
+}
+
+// SAMLIdentityProvider is what the SP knows about the IdP from its metadata.
+type SAMLIdentityProvider struct {
+	EntityID     string
+	SSOURLs      map[string]string
+	Certificates []*x509.Certificate
+}
+
+// ParseSAMLMetadata reads the entity id, single sign-on urls and signing
+// certificates from the metadata of an IdP.
+func ParseSAMLMetadata(metadata string) (SAMLIdentityProvider, error) {
+	descriptor := struct {
+		EntityID         string `xml:"entityID,attr"`
+		IDPSSODescriptor struct {
+			KeyDescriptors []struct {
+				Use          string   `xml:"use,attr"`
+				Certificates []string `xml:"KeyInfo>X509Data>X509Certificate"`
+			} `xml:"KeyDescriptor"`
+			SingleSignOnServices []struct {
+				Binding  string `xml:"Binding,attr"`
+				Location string `xml:"Location,attr"`
+			} `xml:"SingleSignOnService"`
+		} `xml:"IDPSSODescriptor"`
+	}{}
+	if err := xml.Unmarshal([]byte(metadata), &descriptor); err != nil {
+		return SAMLIdentityProvider{}, fmt.Errorf("invalid idp metadata: %v", err)
+	}
+
+	if len(descriptor.EntityID) < 1 {
+		return SAMLIdentityProvider{}, errors.New("idp metadata has no entity id")
+	}
+
+	identityProvider := SAMLIdentityProvider{
+		EntityID: descriptor.EntityID,
+		SSOURLs:  map[string]string{},
+	}
+
+	for _, service := range descriptor.IDPSSODescriptor.SingleSignOnServices {
+		if _, ok := identityProvider.SSOURLs[service.Binding]; !ok {
+			identityProvider.SSOURLs[service.Binding] = service.Location
+		}
+	}
+
+	for _, key := range descriptor.IDPSSODescriptor.KeyDescriptors {
+		if key.Use != "" && key.Use != "signing" {
+			continue
+		}
+		for _, data := range key.Certificates {
+			buf, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+			if err != nil {
+				return SAMLIdentityProvider{}, fmt.Errorf("invalid idp certificate: %v", err)
+			}
+			certificate, err := x509.ParseCertificate(buf)
+			if err != nil {
+				return SAMLIdentityProvider{}, fmt.Errorf("invalid idp certificate: %v", err)
+			}
+			identityProvider.Certificates = append(identityProvider.Certificates, certificate)
+		}
+	}
+
+	if len(identityProvider.Certificates) < 1 {
+		return SAMLIdentityProvider{}, errors.New("idp metadata has no signing certificate")
+	}
+
+	return identityProvider, nil
+}
+
+// SAMLStore remembers the AuthnRequests awaiting a response and the
+// assertions already consumed, so a response cannot be replayed. It is kept
+// in memory and therefore only works with a single instance of the app.
+type SAMLStore struct {
+	mu         sync.Mutex
+	requests   map[string]time.Time
+	assertions map[string]time.Time
+}
+
+func NewSAMLStore() *SAMLStore {
+	return &SAMLStore{
+		requests:   map[string]time.Time{},
+		assertions: map[string]time.Time{},
+	}
+}
+
+func (s *SAMLStore) AddRequest(id string, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(time.Now())
+	s.requests[id] = expiresAt
+}
+
+// TakeRequest removes the request and reports whether it was pending.
+func (s *SAMLStore) TakeRequest(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiresAt, ok := s.requests[id]
+	delete(s.requests, id)
+	return ok && time.Now().Before(expiresAt)
+}
+
+// AddAssertion records an assertion until it expires and reports false when
+// it was seen before.
+func (s *SAMLStore) AddAssertion(id string, expiresAt time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.expire(now)
+	if _, ok := s.assertions[id]; ok {
+		return false
+	}
+	s.assertions[id] = expiresAt.Add(samlClockSkew)
+	return true
+}
+
+func (s *SAMLStore) expire(now time.Time) {
+	for id, expiresAt := range s.requests {
+		if now.After(expiresAt) {
+			delete(s.requests, id)
+		}
+	}
+	for id, expiresAt := range s.assertions {
+		if now.After(expiresAt) {
+			delete(s.assertions, id)
+		}
+	}
+}
+
+// SAMLServiceProvider signs users in with a SAML 2.0 IdP. AuthnRequests are
+// sent with the redirect or POST binding, responses are received with the
+// POST binding and must be signed by the IdP.
+type SAMLServiceProvider struct {
+	config           SAMLConfig
+	identityProvider SAMLIdentityProvider
+	store            *SAMLStore
+}
+
+func NewSAMLServiceProvider(config SAMLConfig, store *SAMLStore) (SAMLServiceProvider, error) {
+	identityProvider, err := ParseSAMLMetadata(config.IdPMetadata)
+	if err != nil {
+		return SAMLServiceProvider{}, err
+	}
+
+	switch config.Binding {
+	case "", "redirect":
+		config.Binding = samlBindingRedirect
+	case "post":
+		config.Binding = samlBindingPost
+	default:
+		return SAMLServiceProvider{}, fmt.Errorf("invalid saml binding: %s", config.Binding)
+	}
+
+	if _, ok := identityProvider.SSOURLs[config.Binding]; !ok {
+		return SAMLServiceProvider{}, fmt.Errorf("idp does not support the %s binding", config.Binding)
+	}
+
+	return SAMLServiceProvider{
+		config:           config,
+		identityProvider: identityProvider,
+		store:            store,
+	}, nil
+}
+
+// UsesPostBinding reports whether AuthnRequests are sent with a form post
+// instead of a redirect.
+func (s SAMLServiceProvider) UsesPostBinding() bool {
+	return s.config.Binding == samlBindingPost
+}
+
+// Metadata describes the SP to the IdP.
+func (s SAMLServiceProvider) Metadata() ([]byte, error) {
+	doc := etree.NewDocument()
+	descriptor := doc.CreateElement("md:EntityDescriptor")
+	descriptor.CreateAttr("xmlns:md", "urn:oasis:names:tc:SAML:2.0:metadata")
+	descriptor.CreateAttr("entityID", s.config.EntityID)
+
+	sp := descriptor.CreateElement("md:SPSSODescriptor")
+	sp.CreateAttr("AuthnRequestsSigned", "false")
+	sp.CreateAttr("WantAssertionsSigned", "true")
+	sp.CreateAttr("protocolSupportEnumeration", "urn:oasis:names:tc:SAML:2.0:protocol")
+	sp.CreateElement("md:NameIDFormat").SetText("urn:oasis:names:tc:SAML:2.0:nameid-format:persistent")
+	sp.CreateElement("md:NameIDFormat").SetText(samlNameIDEmail)
+
+	acs := sp.CreateElement("md:AssertionConsumerService")
+	acs.CreateAttr("Binding", samlBindingPost)
+	acs.CreateAttr("Location", s.config.ACSURL)
+	acs.CreateAttr("index", "0")
+	acs.CreateAttr("isDefault", "true")
+
+	doc.Indent(2)
+	return doc.WriteToBytes()
+}
+
+// AuthnRequestURL returns the url redirecting the user to the IdP with an
+// AuthnRequest, for the redirect binding.
+func (s SAMLServiceProvider) AuthnRequestURL(options AuthorizationOptions) (string, error) {
+	request, err := s.newAuthnRequest(options)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := writer.Write(request); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(s.identityProvider.SSOURLs[samlBindingRedirect])
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Add("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+var samlPostForm = template.Must(template.New("saml").Parse(`<!DOCTYPE html>
+<html>
+<body onload="document.forms[0].submit()">
+<form method="POST" action="{{.URL}}">
+<input type="hidden" name="SAMLRequest" value="{{.SAMLRequest}}">
+<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body>
+</html>
+`))
+
+// AuthnRequestForm returns a page posting an AuthnRequest to the IdP, for
+// the POST binding.
+func (s SAMLServiceProvider) AuthnRequestForm(options AuthorizationOptions) ([]byte, error) {
+	request, err := s.newAuthnRequest(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = samlPostForm.Execute(&buf, struct {
+		URL         string
+		SAMLRequest string
+	}{
+		URL:         s.identityProvider.SSOURLs[samlBindingPost],
+		SAMLRequest: base64.StdEncoding.EncodeToString(request),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// newAuthnRequest translates forcing authentication to ForceAuthn and
+// prompt=none to IsPassive. SAML has no equivalent of the other options.
+func (s SAMLServiceProvider) newAuthnRequest(options AuthorizationOptions) ([]byte, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	id := "_" + hex.EncodeToString(buf)
+	now := time.Now().UTC()
+
+	doc := etree.NewDocument()
+	request := doc.CreateElement("samlp:AuthnRequest")
+	request.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	request.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	request.CreateAttr("ID", id)
+	request.CreateAttr("Version", "2.0")
+	request.CreateAttr("IssueInstant", now.Format(time.RFC3339))
+	request.CreateAttr("Destination", s.identityProvider.SSOURLs[s.config.Binding])
+	request.CreateAttr("AssertionConsumerServiceURL", s.config.ACSURL)
+	request.CreateAttr("ProtocolBinding", samlBindingPost)
+	if options.ForceAuthentication() {
+		request.CreateAttr("ForceAuthn", "true")
+	}
+	if options.HasPrompt("none") {
+		request.CreateAttr("IsPassive", "true")
+	}
+	request.CreateElement("saml:Issuer").SetText(s.config.EntityID)
+	request.CreateElement("samlp:NameIDPolicy").CreateAttr("AllowCreate", "true")
+
+	xmlRequest, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	s.store.AddRequest(id, now.Add(samlRequestLifetime))
+	return xmlRequest, nil
+}
+
+// ParseResponse validates a base64 encoded SAML response and maps its
+// assertion to a user. Either the response or the assertion must be signed
+// by the IdP, and only the signed elements are read.
+func (s SAMLServiceProvider) ParseResponse(samlResponse string) (SingleSignOnUser, error) {
+	buf, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return SingleSignOnUser{}, fmt.Errorf("invalid saml response: %v", err)
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf); err != nil {
+		return SingleSignOnUser{}, fmt.Errorf("invalid saml response: %v", err)
+	}
+
+	response := doc.Root()
+	if response == nil || response.Tag != "Response" {
+		return SingleSignOnUser{}, errors.New("invalid saml response")
+	}
+
+	responseSigned := response.FindElement("./Signature") != nil
+	if responseSigned {
+		if response, err = s.validateSignature(response); err != nil {
+			return SingleSignOnUser{}, err
+		}
+	}
+
+	status := response.FindElement("./Status/StatusCode")
+	if status == nil {
+		return SingleSignOnUser{}, errors.New("saml sign-in was not successful")
+	}
+	if status.SelectAttrValue("Value", "") != samlStatusSuccess {
+		return SingleSignOnUser{}, samlStatusError(response)
+	}
+
+	if destination := response.SelectAttrValue("Destination", ""); len(destination) > 0 && destination != s.config.ACSURL {
+		return SingleSignOnUser{}, fmt.Errorf("unexpected saml destination: %s", destination)
+	}
+
+	if len(response.FindElements("./EncryptedAssertion")) > 0 {
+		return SingleSignOnUser{}, errors.New("encrypted saml assertions are not supported")
+	}
+
+	assertions := response.FindElements("./Assertion")
+	if len(assertions) != 1 {
+		return SingleSignOnUser{}, errors.New("saml response must contain exactly one assertion")
+	}
+	assertion := assertions[0]
+
+	if !responseSigned || assertion.FindElement("./Signature") != nil {
+		if assertion, err = s.validateSignature(assertion); err != nil {
+			return SingleSignOnUser{}, err
+		}
+	}
+
+	return s.parseAssertion(assertion)
+}
+
+// parseAssertion checks the assertion before consuming the request it
+// responds to, so an invalid assertion cannot cancel a pending sign-in.
+func (s SAMLServiceProvider) parseAssertion(assertion *etree.Element) (SingleSignOnUser, error) {
+	now := time.Now()
+
+	id := assertion.SelectAttrValue("ID", "")
+	if len(id) < 1 {
+		return SingleSignOnUser{}, errors.New("saml assertion has no id")
+	}
+
+	if issuer := assertion.FindElement("./Issuer"); issuer == nil || samlText(issuer) != s.identityProvider.EntityID {
+		return SingleSignOnUser{}, errors.New("unexpected saml issuer")
+	}
+
+	confirmation := assertion.FindElement("./Subject/SubjectConfirmation")
+	if confirmation == nil || confirmation.SelectAttrValue("Method", "") != samlBearer {
+		return SingleSignOnUser{}, errors.New("saml assertion has no bearer subject confirmation")
+	}
+
+	confirmationData := confirmation.FindElement("./SubjectConfirmationData")
+	if confirmationData == nil {
+		return SingleSignOnUser{}, errors.New("saml assertion has no subject confirmation data")
+	}
+	if confirmationData.SelectAttrValue("Recipient", "") != s.config.ACSURL {
+		return SingleSignOnUser{}, errors.New("unexpected saml recipient")
+	}
+	if !samlTimeAfter(confirmationData.SelectAttrValue("NotOnOrAfter", ""), now.Add(-samlClockSkew)) {
+		return SingleSignOnUser{}, errors.New("saml subject confirmation has expired")
+	}
+	conditions := assertion.FindElement("./Conditions")
+	if conditions == nil {
+		return SingleSignOnUser{}, errors.New("saml assertion has no conditions")
+	}
+	if notBefore := conditions.SelectAttrValue("NotBefore", ""); len(notBefore) > 0 && samlTimeAfter(notBefore, now.Add(samlClockSkew)) {
+		return SingleSignOnUser{}, errors.New("saml assertion is not valid yet")
+	}
+	notOnOrAfter := conditions.SelectAttrValue("NotOnOrAfter", "")
+	if !samlTimeAfter(notOnOrAfter, now.Add(-samlClockSkew)) {
+		return SingleSignOnUser{}, errors.New("saml assertion has expired")
+	}
+
+	audiences := []string{}
+	for _, audience := range conditions.FindElements("./AudienceRestriction/Audience") {
+		audiences = append(audiences, samlText(audience))
+	}
+	if !contains(audiences, s.config.EntityID) {
+		return SingleSignOnUser{}, errors.New("saml assertion is not meant for this service provider")
+	}
+
+	if !s.store.TakeRequest(confirmationData.SelectAttrValue("InResponseTo", "")) {
+		return SingleSignOnUser{}, errors.New("saml assertion is not a response to a pending request")
+	}
+	expiresAt, _ := time.Parse(time.RFC3339, notOnOrAfter)
+	if !s.store.AddAssertion(id, expiresAt) {
+		return SingleSignOnUser{}, errors.New("saml assertion was already used")
+	}
+
+	attributes := map[string][]string{}
+	for _, attribute := range assertion.FindElements("./AttributeStatement/Attribute") {
+		name := attribute.SelectAttrValue("Name", "")
+		for _, value := range attribute.FindElements("./AttributeValue") {
+			attributes[name] = append(attributes[name], strings.TrimSpace(samlText(value)))
+		}
+	}
+
+	user := SingleSignOnUser{
+		Email:  samlAttribute(attributes, s.config.EmailAttribute, samlEmailAttributes),
+		Name:   samlAttribute(attributes, s.config.NameAttribute, samlNameAttributes),
+		Groups: samlAttributes(attributes, s.config.GroupsAttribute, samlGroupsAttributes),
+	}
+
+	if nameID := assertion.FindElement("./Subject/NameID"); nameID != nil {
+		format := nameID.SelectAttrValue("Format", "")
+		if len(user.Email) < 1 && format == samlNameIDEmail {
+			user.Email = strings.TrimSpace(samlText(nameID))
+		}
+		if format != samlNameIDTransient {
+			user.Subject = strings.TrimSpace(samlText(nameID))
+		}
+	}
+
+	return user, nil
+}
+
+// validateSignature checks the enveloped signature of the element and
+// returns the signed element. Namespaces declared by its ancestors are
+// copied onto it, as the signature is validated on a detached copy.
+func (s SAMLServiceProvider) validateSignature(el *etree.Element) (*etree.Element, error) {
+	detached := el.Copy()
+	for parent := el.Parent(); parent != nil; parent = parent.Parent() {
+		for _, attr := range parent.Attr {
+			if (attr.Space == "xmlns" || (attr.Space == "" && attr.Key == "xmlns")) && detached.SelectAttr(attr.FullKey()) == nil {
+				detached.CreateAttr(attr.FullKey(), attr.Value)
+			}
+		}
+	}
+
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: s.identityProvider.Certificates,
+	})
+	validated, err := ctx.Validate(detached)
+	if err != nil {
+		return nil, fmt.Errorf("invalid saml signature: %v", err)
+	}
+
+	return validated, nil
+}
+
+// samlText returns all the character data of the element. Unlike Text, it
+// does not stop at a comment, which the signature does not cover: otherwise
+// alice@example.com<!---->.evil.com would be read as alice@example.com.
+func samlText(el *etree.Element) string {
+	text := ""
+	for _, token := range el.Child {
+		if charData, ok := token.(*etree.CharData); ok {
+			text += charData.Data
+		}
+	}
+	return text
+}
+
+// samlTimeAfter reports whether the SAML timestamp is after t.
+func samlTimeAfter(timestamp string, t time.Time) bool {
+	parsed, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return false
+	}
+	return parsed.After(t)
+}
+
+func samlAttribute(attributes map[string][]string, name string, defaults []string) string {
+	values := samlAttributes(attributes, name, defaults)
+	if len(values) < 1 {
+		return ""
+	}
+	return values[0]
+}
+
+func samlAttributes(attributes map[string][]string, name string, defaults []string) []string {
+	if len(name) > 0 {
+		return attributes[name]
+	}
+	for _, name := range defaults {
+		if values, ok := attributes[name]; ok {
+			return values
+		}
+	}
+	return nil
+}
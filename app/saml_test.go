@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+const (
+	testSAMLIdP = "https://idp.example.com"
+	testSAMLSP  = "https://sso.example.com/saml"
+	testSAMLACS = "https://sso.example.com/saml/acs"
+)
+
+// newTestSAMLServiceProvider returns a service provider trusting the key
+// store, with a pending request _request.
+func newTestSAMLServiceProvider(t *testing.T) (SAMLServiceProvider, dsig.X509KeyStore) {
+	keyStore := dsig.RandomKeyStoreForTest()
+	_, certificate, err := keyStore.GetKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := fmt.Sprintf(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="%s">
+  <IDPSSODescriptor>
+    <KeyDescriptor use="signing">
+      <KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#">
+        <X509Data><X509Certificate>%s</X509Certificate></X509Data>
+      </KeyInfo>
+    </KeyDescriptor>
+    <SingleSignOnService Binding="%s" Location="https://idp.example.com/sso"/>
+  </IDPSSODescriptor>
+</EntityDescriptor>`, testSAMLIdP, base64.StdEncoding.EncodeToString(certificate), samlBindingRedirect)
+
+	serviceProvider, err := NewSAMLServiceProvider(SAMLConfig{
+		EntityID:    testSAMLSP,
+		ACSURL:      testSAMLACS,
+		IdPMetadata: metadata,
+	}, NewSAMLStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceProvider.store.AddRequest("_request", time.Now().Add(time.Minute))
+
+	return serviceProvider, keyStore
+}
+
+func newTestSAMLAssertion(id string, audience string, email string) *etree.Element {
+	notOnOrAfter := time.Now().Add(5 * time.Minute).UTC().Format(time.RFC3339)
+
+	assertion := etree.NewElement("saml:Assertion")
+	assertion.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	assertion.CreateAttr("ID", id)
+	assertion.CreateAttr("Version", "2.0")
+	assertion.CreateElement("saml:Issuer").SetText(testSAMLIdP)
+
+	subject := assertion.CreateElement("saml:Subject")
+	nameID := subject.CreateElement("saml:NameID")
+	nameID.CreateAttr("Format", samlNameIDEmail)
+	nameID.SetText(email)
+	confirmation := subject.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", samlBearer)
+	confirmationData := confirmation.CreateElement("saml:SubjectConfirmationData")
+	confirmationData.CreateAttr("InResponseTo", "_request")
+	confirmationData.CreateAttr("Recipient", testSAMLACS)
+	confirmationData.CreateAttr("NotOnOrAfter", notOnOrAfter)
+
+	conditions := assertion.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotOnOrAfter", notOnOrAfter)
+	conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(audience)
+
+	return assertion
+}
+
+func signTestSAMLAssertion(t *testing.T, keyStore dsig.X509KeyStore, assertion *etree.Element) *etree.Element {
+	ctx := dsig.NewDefaultSigningContext(keyStore)
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	signed, err := ctx.SignEnveloped(assertion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func newTestSAMLResponse(t *testing.T, assertion *etree.Element) string {
+	doc := etree.NewDocument()
+	response := doc.CreateElement("samlp:Response")
+	response.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	response.CreateAttr("Destination", testSAMLACS)
+	response.CreateElement("samlp:Status").CreateElement("samlp:StatusCode").CreateAttr("Value", samlStatusSuccess)
+	response.AddChild(assertion)
+
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func TestSAMLServiceProviderParseResponse(t *testing.T) {
+	serviceProvider, keyStore := newTestSAMLServiceProvider(t)
+	assertion := signTestSAMLAssertion(t, keyStore, newTestSAMLAssertion("_assertion", testSAMLSP, "alice@example.com"))
+
+	user, err := serviceProvider.ParseResponse(newTestSAMLResponse(t, assertion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "alice@example.com" {
+		t.Errorf("expected alice@example.com, got %s", user.Email)
+	}
+}
+
+func TestSAMLServiceProviderRejectsSignatureWrapping(t *testing.T) {
+	serviceProvider, keyStore := newTestSAMLServiceProvider(t)
+	signed := signTestSAMLAssertion(t, keyStore, newTestSAMLAssertion("_assertion", testSAMLSP, "mallory@example.com"))
+
+	tests := map[string]string{
+		"copied signature":  "_forged",
+		"same id as signed": "_assertion",
+	}
+	for name, id := range tests {
+		forged := newTestSAMLAssertion(id, testSAMLSP, "alice@example.com")
+		forged.AddChild(signed.FindElement("./Signature").Copy())
+		forged.FindElement("./Subject").AddChild(signed.Copy())
+
+		if user, err := serviceProvider.ParseResponse(newTestSAMLResponse(t, forged)); err == nil {
+			t.Errorf("%s: expected the wrapped assertion to be rejected, got %+v", name, user)
+		}
+	}
+}
+
+func TestSAMLServiceProviderReadsTextAroundComments(t *testing.T) {
+	serviceProvider, keyStore := newTestSAMLServiceProvider(t)
+	assertion := newTestSAMLAssertion("_assertion", testSAMLSP, "alice@example.com")
+
+	// Canonicalizations without comments leave the comment out of the
+	// signature, so it could also have been added after signing.
+	nameID := assertion.FindElement("./Subject/NameID")
+	nameID.CreateComment("")
+	nameID.CreateCharData(".evil.com")
+
+	user, err := serviceProvider.ParseResponse(newTestSAMLResponse(t, signTestSAMLAssertion(t, keyStore, assertion)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "alice@example.com.evil.com" {
+		t.Errorf("expected alice@example.com.evil.com, got %s", user.Email)
+	}
+}
+
+func TestSAMLServiceProviderRejectsReplay(t *testing.T) {
+	serviceProvider, keyStore := newTestSAMLServiceProvider(t)
+	response := newTestSAMLResponse(t, signTestSAMLAssertion(t, keyStore, newTestSAMLAssertion("_assertion", testSAMLSP, "alice@example.com")))
+
+	if _, err := serviceProvider.ParseResponse(response); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serviceProvider.ParseResponse(response); err == nil {
+		t.Error("expected the response to a consumed request to be rejected")
+	}
+
+	serviceProvider.store.AddRequest("_request", time.Now().Add(time.Minute))
+	if _, err := serviceProvider.ParseResponse(response); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("expected the used assertion to be rejected, got %v", err)
+	}
+}
+
+func TestSAMLServiceProviderRejectsOtherAudience(t *testing.T) {
+	serviceProvider, keyStore := newTestSAMLServiceProvider(t)
+	other := signTestSAMLAssertion(t, keyStore, newTestSAMLAssertion("_other", "https://other.example.com", "alice@example.com"))
+
+	if _, err := serviceProvider.ParseResponse(newTestSAMLResponse(t, other)); err == nil {
+		t.Error("expected the assertion for another audience to be rejected")
+	}
+
+	// The rejected assertion must not have consumed the pending request.
+	assertion := signTestSAMLAssertion(t, keyStore, newTestSAMLAssertion("_assertion", testSAMLSP, "alice@example.com"))
+	if _, err := serviceProvider.ParseResponse(newTestSAMLResponse(t, assertion)); err != nil {
+		t.Errorf("expected the request to still be pending, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+const (
+	SignUpDisabled          = "signup_disabled"
+	SignUpEmailDenied       = "email_denied"
+	SignUpDomainNotAllowed  = "email_domain_not_allowed"
+	SignUpInvitationNeeded  = "invitation_required"
+	SignUpInvitationInvalid = "invitation_invalid"
+	SignUpEmailTaken        = "email_taken"
+)
+
+type ErrSignUpRejected struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e ErrSignUpRejected) Error() string {
+	return e.Message
+}
+
+// SignUpPolicy decides whether a new account may be created for an email.
+// Existing users are not affected by it.
+type SignUpPolicy struct {
+	AllowedDomains []string
+	AllowedEmails  []string
+	DeniedEmails   []string
+	InviteOnly     bool
+}
+
+func NewSignUpPolicy(
+	allowedDomains []string,
+	allowedEmails []string,
+	deniedEmails []string,
+	inviteOnly bool,
+) SignUpPolicy {
+	return SignUpPolicy{
+		AllowedDomains: lowerAll(allowedDomains),
+		AllowedEmails:  lowerAll(allowedEmails),
+		DeniedEmails:   lowerAll(deniedEmails),
+		InviteOnly:     inviteOnly,
+	}
+}
+
+// Check decides on an email, which only matches the allowed emails and
+// domains once verified, as anyone can sign up with an email they do not
+// own. Denied emails are rejected either way.
+func (p SignUpPolicy) Check(email string, emailVerified bool) error {
+	email = strings.ToLower(email)
+
+	if contains(p.DeniedEmails, email) {
+		return ErrSignUpRejected{
+			Code:    SignUpEmailDenied,
+			Message: fmt.Sprintf("sign up is not allowed for %s", email),
+		}
+	}
+
+	if emailVerified && contains(p.AllowedEmails, email) {
+		return nil
+	}
+
+	if p.InviteOnly {
+		return ErrSignUpRejected{
+			Code:    SignUpInvitationNeeded,
+			Message: "sign up requires an invitation",
+		}
+	}
+
+	if len(p.AllowedDomains) > 0 && !emailVerified {
+		return ErrSignUpRejected{
+			Code:    SignUpDomainNotAllowed,
+			Message: "sign up with an unverified email is not allowed",
+		}
+	}
+	if len(p.AllowedDomains) > 0 && !contains(p.AllowedDomains, emailDomain(email)) {
+		return ErrSignUpRejected{
+			Code:    SignUpDomainNotAllowed,
+			Message: fmt.Sprintf("sign up is not allowed for domain %s", emailDomain(email)),
+		}
+	}
+
+	return nil
+}
+
+type ErrInvalidEmail string
+
+func (e ErrInvalidEmail) Error() string {
+	return string(e)
+}
+
+// validateEmail accepts a plain address like alice@example.com, without a
+// display name.
+func validateEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return ErrInvalidEmail(fmt.Sprintf("invalid email: %s", email))
+	}
+	return nil
+}
+
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
+
+func lowerAll(strs []string) []string {
+	lowered := make([]string, 0, len(strs))
+	for _, str := range strs {
+		lowered = append(lowered, strings.ToLower(str))
+	}
+	return lowered
+}
+
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
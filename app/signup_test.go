@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSignUpPolicyCheck(t *testing.T) {
+	policy := NewSignUpPolicy([]string{"example.com"}, []string{"bob@other.com"}, []string{"mallory@example.com"}, false)
+
+	tests := []struct {
+		email    string
+		verified bool
+		code     string
+	}{
+		{"alice@example.com", true, ""},
+		{"Alice@Example.com", true, ""},
+		{"alice@example.com", false, SignUpDomainNotAllowed},
+		{"bob@other.com", true, ""},
+		{"bob@other.com", false, SignUpDomainNotAllowed},
+		{"carol@other.com", true, SignUpDomainNotAllowed},
+		{"mallory@example.com", true, SignUpEmailDenied},
+		{"mallory@example.com", false, SignUpEmailDenied},
+	}
+	for _, test := range tests {
+		code := ""
+		var rejected ErrSignUpRejected
+		if err := policy.Check(test.email, test.verified); errors.As(err, &rejected) {
+			code = rejected.Code
+		}
+		if code != test.code {
+			t.Errorf("%s (verified %v): expected %q, got %q", test.email, test.verified, test.code, code)
+		}
+	}
+}
+
+func TestSignUpPolicyInviteOnly(t *testing.T) {
+	policy := NewSignUpPolicy(nil, []string{"bob@example.com"}, nil, true)
+
+	if err := policy.Check("bob@example.com", true); err != nil {
+		t.Errorf("expected the verified allowed email to sign up, got %v", err)
+	}
+	if err := policy.Check("bob@example.com", false); err == nil {
+		t.Error("expected the unverified allowed email to need an invitation")
+	}
+}
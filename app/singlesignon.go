@@ -5,40 +5,273 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// SingleSignOnUser is a user as reported by an identity provider. Subject,
+// when set, identifies the user at the provider even if the email changes.
 type SingleSignOnUser struct {
+	Subject string
 	Email   string
 	Name    string
 	Picture string
+	Groups  []string
 }
 
 type IdentityProvider interface {
-	GetAuthorizationURL() (string, error)
+	GetAuthorizationURL(options AuthorizationOptions) (string, error)
 	GetIdentityToken(code string) (string, error)
 	GetSingleSignOnUser(identityToken string) (SingleSignOnUser, error)
 }
 
+// AuthorizationOptions are sign-in options of the client for the identity
+// provider, named as in OpenID Connect. Providers translate what they
+// support to their own parameters and ignore the rest.
+type AuthorizationOptions struct {
+	// Prompt is a space separated list of login, consent and select_account,
+	// or none.
+	Prompt    string
+	LoginHint string
+	// MaxAge is the time in seconds since the user last authenticated at the
+	// provider after which the user has to authenticate again, or -1.
+	MaxAge int
+	// UILocales is a space separated list of BCP 47 language tags.
+	UILocales string
+	// State is sent to the provider as state, which it passes back to the
+	// callback.
+	State string
+}
+
+var uiLocalePattern = regexp.MustCompile(`^[A-Za-z0-9]{1,8}(-[A-Za-z0-9]{1,8})*$`)
+
+// ParseAuthorizationOptions reads the prompt, login_hint, max_age and
+// ui_locales parameters of a sign-in request.
+func ParseAuthorizationOptions(q url.Values) (AuthorizationOptions, error) {
+	options := AuthorizationOptions{
+		Prompt:    strings.Join(strings.Fields(q.Get("prompt")), " "),
+		LoginHint: strings.TrimSpace(q.Get("login_hint")),
+		MaxAge:    -1,
+		UILocales: strings.Join(strings.Fields(q.Get("ui_locales")), " "),
+	}
+
+	prompts := strings.Fields(options.Prompt)
+	for _, prompt := range prompts {
+		switch prompt {
+		case "login", "consent", "select_account":
+		case "none":
+			if len(prompts) > 1 {
+				return AuthorizationOptions{}, errors.New("prompt none cannot be combined with other values")
+			}
+		default:
+			return AuthorizationOptions{}, fmt.Errorf("invalid prompt: %s", prompt)
+		}
+	}
+
+	if len(options.LoginHint) > 256 {
+		return AuthorizationOptions{}, errors.New("login_hint is too long")
+	}
+
+	if maxAge := q.Get("max_age"); len(maxAge) > 0 {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil || seconds < 0 {
+			return AuthorizationOptions{}, fmt.Errorf("invalid max_age: %s", maxAge)
+		}
+		options.MaxAge = seconds
+	}
+
+	locales := strings.Fields(options.UILocales)
+	if len(locales) > 10 {
+		return AuthorizationOptions{}, errors.New("too many ui_locales")
+	}
+	for _, locale := range locales {
+		if !uiLocalePattern.MatchString(locale) {
+			return AuthorizationOptions{}, fmt.Errorf("invalid ui_locales: %s", locale)
+		}
+	}
+
+	return options, nil
+}
+
+func (o AuthorizationOptions) HasPrompt(prompt string) bool {
+	return contains(strings.Fields(o.Prompt), prompt)
+}
+
+// ForceAuthentication reports whether the user has to authenticate again at
+// the provider, even with a session there.
+func (o AuthorizationOptions) ForceAuthentication() bool {
+	return o.HasPrompt("login") || o.MaxAge == 0
+}
+
+// openIDConnectParams returns the options given as OpenID Connect
+// authorization request parameters.
+func (o AuthorizationOptions) openIDConnectParams() url.Values {
+	params := url.Values{}
+	if len(o.Prompt) > 0 {
+		params.Set("prompt", o.Prompt)
+	}
+	if len(o.LoginHint) > 0 {
+		params.Set("login_hint", o.LoginHint)
+	}
+	if o.MaxAge >= 0 {
+		params.Set("max_age", strconv.Itoa(o.MaxAge))
+	}
+	if len(o.UILocales) > 0 {
+		params.Set("ui_locales", o.UILocales)
+	}
+	return params
+}
+
+// addParams copies the named params to q, if given.
+func addParams(q url.Values, params url.Values, names ...string) {
+	for _, name := range names {
+		if value := params.Get(name); len(value) > 0 {
+			q.Set(name, value)
+		}
+	}
+}
+
+const (
+	SignInMembershipRequired     = "membership_required"
+	SignInHostedDomainRequired   = "hosted_domain_required"
+	SignInHostedDomainNotAllowed = "hosted_domain_not_allowed"
+	SignInEmailNotVerified       = "email_not_verified"
+	SignInBrowserMismatch        = "browser_mismatch"
+	SignInMFARequired            = "mfa_required"
+	SignInCancelled              = "sign_in_cancelled"
+	SignInInteractionRequired    = "interaction_required"
+	SignInProviderMisconfigured  = "provider_misconfigured"
+	SignInProviderUnavailable    = "provider_unavailable"
+	SignInAuthorizationExpired   = "authorization_expired"
+	SignInAccountExists          = "account_exists"
+)
+
+// ErrSignInRejected is returned when an identity provider authenticated the
+// user, but the user does not meet the requirements to sign in with it.
+type ErrSignInRejected struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e ErrSignInRejected) Error() string {
+	return e.Message
+}
+
+// ErrAuthorizationFailed is returned when the identity provider redirects
+// back with an error instead of an authorization code, e.g. when the user
+// cancelled the consent. Code is one of the SignIn codes the web app can
+// display, Reason, Description and URI are the error details of the
+// provider.
+type ErrAuthorizationFailed struct {
+	Provider    string
+	Code        string
+	Reason      string
+	Description string
+	URI         string
+}
+
+func (e ErrAuthorizationFailed) Error() string {
+	if len(e.Description) > 0 {
+		return fmt.Sprintf("%s authorization failed: %s: %s", e.Provider, e.Reason, e.Description)
+	}
+	return fmt.Sprintf("%s authorization failed: %s", e.Provider, e.Reason)
+}
+
+// authorizationError returns the error of a callback, or nil if the provider
+// did not send one.
+func authorizationError(provider string, callback url.Values) error {
+	reason := callback.Get("error")
+	if len(reason) < 1 {
+		return nil
+	}
+
+	return ErrAuthorizationFailed{
+		Provider:    provider,
+		Code:        authorizationErrorCode(reason),
+		Reason:      reason,
+		Description: callback.Get("error_description"),
+		URI:         callback.Get("error_uri"),
+	}
+}
+
+// authorizationErrorCode categorizes the OAuth 2.0 and OpenID Connect error
+// codes, and the ones of providers that do not stick to them. Unknown codes
+// are taken for a misconfiguration, like invalid_request or invalid_scope.
+func authorizationErrorCode(reason string) string {
+	switch reason {
+	case "access_denied", "user_cancelled_authorize", "user_denied":
+		return SignInCancelled
+	case "login_required", "consent_required", "interaction_required", "account_selection_required":
+		return SignInInteractionRequired
+	case "server_error", "temporarily_unavailable":
+		return SignInProviderUnavailable
+	default:
+		return SignInProviderMisconfigured
+	}
+}
+
+// CallbackUserIdentityProvider is implemented by identity providers that send
+// details of the user along with the callback rather than in the identity
+// token.
+type CallbackUserIdentityProvider interface {
+	GetCallbackUser(callback url.Values) (SingleSignOnUser, error)
+}
+
 type SingleSignOn struct {
-	identityProvider IdentityProvider
-	authenticator    Authenticator
-	repository       Repository
+	name                string
+	identityProvider    IdentityProvider
+	authenticator       Authenticator
+	repository          Repository
+	invitationManager   InvitationManager
+	roleManager         RoleManager
+	organizationManager OrganizationManager
+	signUpPolicy        SignUpPolicy
+	signUpEnabled       bool
+	organizationID      int
+	unverifiedEmails    bool
 }
 
 func NewSingleSignOn(
+	name string,
 	identityProvider IdentityProvider,
 	authenticator Authenticator,
 	repository Repository,
+	invitationManager InvitationManager,
+	roleManager RoleManager,
+	organizationManager OrganizationManager,
+	signUpPolicy SignUpPolicy,
+	signUpEnabled bool,
 ) SingleSignOn {
 	return SingleSignOn{
-		identityProvider: identityProvider,
-		authenticator:    authenticator,
-		repository:       repository,
+		name:                name,
+		identityProvider:    identityProvider,
+		authenticator:       authenticator,
+		repository:          repository,
+		invitationManager:   invitationManager,
+		roleManager:         roleManager,
+		organizationManager: organizationManager,
+		signUpPolicy:        signUpPolicy,
+		signUpEnabled:       signUpEnabled,
 	}
 }
 
-func (s SingleSignOn) GetAuthorizationURL() (string, error) {
-	return s.identityProvider.GetAuthorizationURL()
+func (s SingleSignOn) GetAuthorizationURL(options AuthorizationOptions) (string, error) {
+	authorizationURL, err := s.identityProvider.GetAuthorizationURL(options)
+	if err != nil || len(options.State) < 1 {
+		return authorizationURL, err
+	}
+
+	u, err := url.Parse(authorizationURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("state", options.State)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
 }
 
 func (s SingleSignOn) IsSignedIn(token string) bool {
@@ -46,7 +279,22 @@ func (s SingleSignOn) IsSignedIn(token string) bool {
 	return err == nil
 }
 
-func (s SingleSignOn) SignIn(code string) (string, error) {
+// IsAuthenticatedSince reports whether the token was issued by a sign-in at
+// or after the given time.
+func (s SingleSignOn) IsAuthenticatedSince(token string, since time.Time) bool {
+	payload, err := s.authenticator.GetTokenPayload(token)
+	return err == nil && !payload.AuthTime.Before(since)
+}
+
+// SignIn exchanges the authorization code of the callback for a token. When
+// the user does not exist yet and an invitation token is given, the
+// invitation is redeemed to provision the account.
+func (s SingleSignOn) SignIn(callback url.Values, invitationToken string) (string, error) {
+	if err := authorizationError(s.name, callback); err != nil {
+		return "", err
+	}
+
+	code := callback.Get("code")
 	if len(code) < 1 {
 		return "", errors.New("authorization code cannot be empty")
 	}
@@ -61,21 +309,119 @@ func (s SingleSignOn) SignIn(code string) (string, error) {
 		return "", err
 	}
 
-	user, err := s.getOrCreateUser(singleSignOnUser)
+	if identityProvider, ok := s.identityProvider.(CallbackUserIdentityProvider); ok {
+		callbackUser, err := identityProvider.GetCallbackUser(callback)
+		if err != nil {
+			return "", err
+		}
+		if len(singleSignOnUser.Name) < 1 {
+			singleSignOnUser.Name = callbackUser.Name
+		}
+	}
+
+	return s.SignInUser(singleSignOnUser, invitationToken)
+}
+
+// SignInUser issues a token for a user the identity provider has already
+// authenticated, such as the subject of a validated SAML assertion.
+func (s SingleSignOn) SignInUser(singleSignOnUser SingleSignOnUser, invitationToken string) (string, error) {
+	user, err := s.getOrCreateUser(singleSignOnUser, invitationToken)
 	if err != nil {
 		return "", err
 	}
 
-	return s.authenticator.CreateToken(user.ID)
+	return s.CreateToken(user, singleSignOnUser.Groups)
+}
+
+// GetOrCreateUser provisions the user like a sign-in would, without issuing
+// a token, for sign-ins that store more than the identity, like passwords.
+func (s SingleSignOn) GetOrCreateUser(singleSignOnUser SingleSignOnUser, invitationToken string) (User, error) {
+	return s.getOrCreateUser(singleSignOnUser, invitationToken)
+}
+
+// CreateToken issues a token for a user provisioned by GetOrCreateUser.
+func (s SingleSignOn) CreateToken(user User, groups []string) (string, error) {
+	if s.organizationID > 0 {
+		if err := s.organizationManager.EnsureMember(s.organizationID, user.ID); err != nil {
+			return "", err
+		}
+	}
+
+	if user.MFAEnabled {
+		token, err := s.authenticator.CreateMFAPendingToken(user.ID, groups, s.amr())
+		if err != nil {
+			return "", err
+		}
+		return "", ErrMFARequired{Token: token}
+	}
+
+	return s.authenticator.CreateToken(user.ID, groups, s.amr())
+}
+
+// amr returns the authentication methods of sign-ins through s.
+func (s SingleSignOn) amr() []string {
+	switch s.name {
+	case "password", "ldap":
+		return []string{AMRPassword}
+	case "magic_link":
+		return []string{AMREmail}
+	default:
+		return []string{AMRFederated}
+	}
+}
+
+// getOrCreateUser finds the user by its identity at the provider, falling
+// back to its email, and links the identity to the user found or created.
+func (s SingleSignOn) getOrCreateUser(singleSignOnUser SingleSignOnUser, invitationToken string) (User, error) {
+	if len(singleSignOnUser.Subject) > 0 {
+		user, err := s.repository.GetUserByIdentity(s.name, singleSignOnUser.Subject)
+		if err == nil {
+			if len(invitationToken) > 0 {
+				return user, s.acceptInvitation(user, invitationToken)
+			}
+			return user, nil
+		}
+		var userNotFound ErrUserNotFound
+		if !errors.As(err, &userNotFound) {
+			return User{}, err
+		}
+	}
+
+	if s.organizationID > 0 {
+		return s.createOrganizationUser(singleSignOnUser, invitationToken)
+	}
+
+	user, err := s.getOrCreateUserByEmail(singleSignOnUser, invitationToken)
+	if err != nil {
+		return User{}, err
+	}
+
+	if len(singleSignOnUser.Subject) > 0 {
+		if err := s.repository.LinkUserIdentity(user.ID, s.name, singleSignOnUser.Subject); err != nil {
+			return User{}, err
+		}
+	}
+
+	return user, nil
 }
 
-func (s SingleSignOn) getOrCreateUser(singleSignOnUser SingleSignOnUser) (User, error) {
+func (s SingleSignOn) getOrCreateUserByEmail(singleSignOnUser SingleSignOnUser, invitationToken string) (User, error) {
+	// Providers leave out emails they cannot vouch for.
 	if len(singleSignOnUser.Email) < 1 {
-		return User{}, errors.New("email cannot be empty")
+		return User{}, ErrSignInRejected{
+			Code:    SignInEmailNotVerified,
+			Message: "the identity provider did not confirm an email for this account",
+		}
 	}
 
 	user, err := s.repository.GetUserByEmail(singleSignOnUser.Email)
+	if err == nil && !user.EmailVerified && !s.unverifiedEmails {
+		user, err = s.claimUnverifiedUser(user)
+	}
 	if err == nil {
+		if len(invitationToken) > 0 {
+			return user, s.acceptInvitation(user, invitationToken)
+		}
 		return user, nil
 	}
 	var userNotFound ErrUserNotFound
@@ -83,34 +429,160 @@ func (s SingleSignOn) getOrCreateUser(singleSignOnUser SingleSignOnUser) (User,
 		return User{}, err
 	}
 
-	return s.repository.CreateUser(User{
-		Email:   singleSignOnUser.Email,
-		Name:    singleSignOnUser.Name,
-		Picture: singleSignOnUser.Picture,
+	return s.SignUpUser(singleSignOnUser, invitationToken)
+}
+
+// SignUpUser provisions a new user like a sign-in with an unknown email
+// would. It fails with ErrUserExists when the email is taken, even by a
+// user created concurrently.
+func (s SingleSignOn) SignUpUser(singleSignOnUser SingleSignOnUser, invitationToken string) (User, error) {
+	if len(invitationToken) > 0 {
+		invitation, err := s.invitationManager.AcceptInvitation(invitationToken, singleSignOnUser.Email)
+		if err != nil {
+			return User{}, err
+		}
+
+		user, err := s.createUser(singleSignOnUser, invitation.Role)
+		if err != nil {
+			return User{}, err
+		}
+		return user, s.organizationManager.JoinByInvitation(user, invitation)
+	}
+
+	if !s.signUpEnabled {
+		return User{}, ErrSignUpRejected{
+			Code:    SignUpDisabled,
+			Message: "sign up is disabled for this identity provider",
+		}
+	}
+
+	if err := s.signUpPolicy.Check(singleSignOnUser.Email, !s.unverifiedEmails); err != nil {
+		return User{}, err
+	}
+
+	return s.createUser(singleSignOnUser, "")
+}
+
+// createOrganizationUser provisions a user of an identity provider of an
+// organization. Organizations configure these providers themselves, so they
+// may assert any email: existing users are never signed in by email, and the
+// email of users created stays unverified, so the owner of the email can
+// still claim it.
+func (s SingleSignOn) createOrganizationUser(singleSignOnUser SingleSignOnUser, invitationToken string) (User, error) {
+	if len(singleSignOnUser.Subject) < 1 {
+		return User{}, errors.New("subject cannot be empty")
+	}
+	if len(singleSignOnUser.Email) < 1 {
+		return User{}, errors.New("email cannot be empty")
+	}
+
+	accountExists := ErrSignInRejected{
+		Code:    SignInAccountExists,
+		Message: "an account with this email already exists, sign in with it instead",
+	}
+
+	_, err := s.repository.GetUserByEmail(singleSignOnUser.Email)
+	if err == nil {
+		return User{}, accountExists
+	}
+	var userNotFound ErrUserNotFound
+	if !errors.As(err, &userNotFound) {
+		return User{}, err
+	}
+
+	user, err := s.SignUpUser(singleSignOnUser, invitationToken)
+	var userExists ErrUserExists
+	if errors.As(err, &userExists) {
+		return User{}, accountExists
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if err := s.repository.LinkUserIdentity(user.ID, s.name, singleSignOnUser.Subject); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// acceptInvitation redeems an invitation for an existing user, which only
+// has an effect for invitations to an organization.
+func (s SingleSignOn) acceptInvitation(user User, invitationToken string) error {
+	invitation, err := s.invitationManager.AcceptInvitation(invitationToken, user.Email)
+	if err != nil {
+		return err
+	}
+	return s.organizationManager.JoinByInvitation(user, invitation)
+}
+
+// claimUnverifiedUser verifies the email of a user who signed up with a
+// password but never verified it, once a provider vouches for the email. The
+// password, second factors, roles, organization memberships and tokens are
+// removed, as they may have been set up by someone else to take over the
+// account, and the user starts over with the initial roles.
+func (s SingleSignOn) claimUnverifiedUser(user User) (User, error) {
+	if err := s.repository.ClaimUnverifiedUser(user.ID, time.Now()); err != nil {
+		return User{}, err
+	}
+
+	user.EmailVerified = true
+	user.MFAEnabled = false
+	if err := s.roleManager.AssignInitialRoles(user, ""); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s SingleSignOn) createUser(singleSignOnUser SingleSignOnUser, role string) (User, error) {
+	user, err := s.repository.CreateUser(User{
+		Email:         singleSignOnUser.Email,
+		Name:          singleSignOnUser.Name,
+		Picture:       singleSignOnUser.Picture,
+		EmailVerified: !s.unverifiedEmails,
 	})
+	if err != nil {
+		return User{}, err
+	}
+
+	if err := s.roleManager.AssignInitialRoles(user, role); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
 }
 
 var _ IdentityProvider = (*GoogleIdentityProvider)(nil)
 
+// GoogleIdentityProvider signs in with Google. When hosted domains are given,
+// only Google Workspace accounts of these domains can sign in.
 type GoogleIdentityProvider struct {
-	clientID     string
-	clientSecret string
-	redirectURI  string
+	clientID      string
+	clientSecret  string
+	redirectURI   string
+	hostedDomains []string
+	scopes        []string
 }
 
 func NewGoogleIdentityProvider(
 	clientID string,
 	clientSecret string,
 	redirectURI string,
+	hostedDomains []string,
 ) GoogleIdentityProvider {
 	return GoogleIdentityProvider{
-		clientID:     clientID,
-		clientSecret: clientSecret,
-		redirectURI:  redirectURI,
+		clientID:      clientID,
+		clientSecret:  clientSecret,
+		redirectURI:   redirectURI,
+		hostedDomains: lowerAll(hostedDomains),
+		scopes:        []string{"email", "profile"},
 	}
 }
 
-func (g GoogleIdentityProvider) GetAuthorizationURL() (string, error) {
+// GetAuthorizationURL passes the options as OpenID Connect parameters,
+// except ui_locales, which Google reads from hl. Google has no login prompt,
+// so forcing authentication is asked for with max_age=0.
+func (g GoogleIdentityProvider) GetAuthorizationURL(options AuthorizationOptions) (string, error) {
 	u, err := url.Parse("https://accounts.google.com/o/oauth2/v2/auth")
 	if err != nil {
 		return "", err
@@ -120,8 +592,34 @@ func (g GoogleIdentityProvider) GetAuthorizationURL() (string, error) {
 	q.Add("client_id", g.clientID)
 	q.Add("redirect_uri", g.redirectURI)
 	q.Add("response_type", "code")
-	q.Add("scope", "email profile")
+	q.Add("scope", strings.Join(g.scopes, " "))
 	q.Add("access_type", "online")
+	// hd only preselects accounts on the consent screen, the domain is
+	// verified in GetSingleSignOnUser. "*" hints at any Workspace account.
+	switch len(g.hostedDomains) {
+	case 0:
+	case 1:
+		q.Add("hd", g.hostedDomains[0])
+	default:
+		q.Add("hd", "*")
+	}
+
+	prompts := []string{}
+	for _, prompt := range strings.Fields(options.Prompt) {
+		if prompt != "login" {
+			prompts = append(prompts, prompt)
+		}
+	}
+	if len(prompts) > 0 {
+		q.Add("prompt", strings.Join(prompts, " "))
+	}
+	if options.HasPrompt("login") {
+		options.MaxAge = 0
+	}
+	addParams(q, options.openIDConnectParams(), "login_hint", "max_age")
+	if locales := strings.Fields(options.UILocales); len(locales) > 0 {
+		q.Add("hl", locales[0])
+	}
 	u.RawQuery = q.Encode()
 
 	return u.String(), nil
@@ -165,16 +663,42 @@ func (g GoogleIdentityProvider) GetSingleSignOnUser(identityToken string) (Singl
 	}
 
 	res := struct {
-		Name    string `json:"name"`
-		Email   string `json:"email"`
-		Picture string `json:"picture"`
+		Subject       string `json:"sub"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Picture       string `json:"picture"`
+		HostedDomain  string `json:"hd"`
 	}{}
 
 	if err := DefaultHttpClient.HttpRequestJson(http.MethodGet, u.String(), headers, "", &res); err != nil {
 		return SingleSignOnUser{}, err
 	}
 
+	if len(g.hostedDomains) > 0 {
+		if len(res.HostedDomain) < 1 {
+			return SingleSignOnUser{}, ErrSignInRejected{
+				Code:    SignInHostedDomainRequired,
+				Message: "only google workspace accounts can sign in",
+			}
+		}
+		if !contains(g.hostedDomains, strings.ToLower(res.HostedDomain)) {
+			return SingleSignOnUser{}, ErrSignInRejected{
+				Code:    SignInHostedDomainNotAllowed,
+				Message: fmt.Sprintf("google workspace domain %s is not allowed", res.HostedDomain),
+			}
+		}
+	}
+
+	if !res.EmailVerified {
+		return SingleSignOnUser{}, ErrSignInRejected{
+			Code:    SignInEmailNotVerified,
+			Message: "the email of the google account is not verified",
+		}
+	}
+
 	return SingleSignOnUser{
+		Subject: res.Subject,
 		Name:    res.Name,
 		Email:   res.Email,
 		Picture: res.Picture,
@@ -187,6 +711,7 @@ type FacebookIdentityProvider struct {
 	clientID     string
 	clientSecret string
 	redirectURI  string
+	scopes       []string
 }
 
 func NewFacebookIdentityProvider(
@@ -198,10 +723,13 @@ func NewFacebookIdentityProvider(
 		clientID:     clientID,
 		clientSecret: clientSecret,
 		redirectURI:  redirectURI,
+		scopes:       []string{"public_profile", "email"},
 	}
 }
 
-func (f FacebookIdentityProvider) GetAuthorizationURL() (string, error) {
+// GetAuthorizationURL translates forcing authentication and asking for
+// consent again to the auth_type of Facebook. Other options are ignored.
+func (f FacebookIdentityProvider) GetAuthorizationURL(options AuthorizationOptions) (string, error) {
 	u, err := url.Parse("https://www.facebook.com/v9.0/dialog/oauth")
 	if err != nil {
 		return "", err
@@ -209,8 +737,14 @@ func (f FacebookIdentityProvider) GetAuthorizationURL() (string, error) {
 
 	q := url.Values{}
 	q.Add("client_id", f.clientID)
-	q.Add("scope", "public_profile,email")
+	q.Add("scope", strings.Join(f.scopes, ","))
 	q.Add("redirect_uri", f.redirectURI)
+	switch {
+	case options.ForceAuthentication():
+		q.Add("auth_type", "reauthenticate")
+	case options.HasPrompt("consent"):
+		q.Add("auth_type", "rerequest")
+	}
 	u.RawQuery = q.Encode()
 
 	return u.String(), nil
@@ -273,26 +807,59 @@ func (f FacebookIdentityProvider) GetSingleSignOnUser(identityToken string) (Sin
 
 var _ IdentityProvider = (*GithubIdentityProvider)(nil)
 
+// GithubIdentityProvider signs in with github.com or a GitHub Enterprise
+// Server. When organizations or teams are required, only their members can
+// sign in, and the teams of the user become its groups.
 type GithubIdentityProvider struct {
-	clientID     string
-	clientSecret string
-	redirectURI  string
+	clientID             string
+	clientSecret         string
+	redirectURI          string
+	baseURL              string
+	apiURL               string
+	allowedOrganizations []string
+	allowedTeams         []string
+	scopes               []string
+	httpClient           *HttpClient
 }
 
 func NewGithubIdentityProvider(
 	clientID string,
 	clientSecret string,
 	redirectURI string,
+	baseURL string,
+	allowedOrganizations []string,
+	allowedTeams []string,
 ) GithubIdentityProvider {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	apiURL := fmt.Sprintf("%s/api/v3", baseURL)
+	if len(baseURL) < 1 || baseURL == "https://github.com" {
+		baseURL = "https://github.com"
+		apiURL = "https://api.github.com"
+	}
+
+	scopes := []string{"read:user"}
+	if len(allowedOrganizations) > 0 || len(allowedTeams) > 0 {
+		scopes = append(scopes, "read:org")
+	}
+
 	return GithubIdentityProvider{
-		clientID:     clientID,
-		clientSecret: clientSecret,
-		redirectURI:  redirectURI,
+		clientID:             clientID,
+		clientSecret:         clientSecret,
+		redirectURI:          redirectURI,
+		baseURL:              baseURL,
+		apiURL:               apiURL,
+		allowedOrganizations: lowerAll(allowedOrganizations),
+		allowedTeams:         lowerAll(allowedTeams),
+		scopes:               scopes,
+		httpClient:           DefaultHttpClient,
 	}
 }
 
-func (g GithubIdentityProvider) GetAuthorizationURL() (string, error) {
-	u, err := url.Parse("https://github.com/login/oauth/authorize")
+// GetAuthorizationURL passes login_hint as login, which GitHub suggests as
+// the account to sign in with, and prompt=select_account. GitHub cannot be
+// asked to authenticate again.
+func (g GithubIdentityProvider) GetAuthorizationURL(options AuthorizationOptions) (string, error) {
+	u, err := url.Parse(g.baseURL + "/login/oauth/authorize")
 	if err != nil {
 		return "", err
 	}
@@ -300,14 +867,20 @@ func (g GithubIdentityProvider) GetAuthorizationURL() (string, error) {
 	q := url.Values{}
 	q.Add("client_id", g.clientID)
 	q.Add("redirect_uri", g.redirectURI)
-	q.Add("scope", "read:user")
+	q.Add("scope", strings.Join(g.scopes, " "))
+	if len(options.LoginHint) > 0 {
+		q.Add("login", options.LoginHint)
+	}
+	if options.HasPrompt("select_account") {
+		q.Add("prompt", "select_account")
+	}
 	u.RawQuery = q.Encode()
 
 	return u.String(), nil
 }
 
 func (g GithubIdentityProvider) GetIdentityToken(code string) (string, error) {
-	u, err := url.Parse("https://github.com/login/oauth/access_token")
+	u, err := url.Parse(g.baseURL + "/login/oauth/access_token")
 	if err != nil {
 		return "", err
 	}
@@ -325,7 +898,7 @@ func (g GithubIdentityProvider) GetIdentityToken(code string) (string, error) {
 	res := struct {
 		AccessToken string `json:"access_token"`
 	}{}
-	if err := DefaultHttpClient.HttpRequestJson(http.MethodPost, u.String(), headers, body.Encode(), &res); err != nil {
+	if err := g.httpClient.HttpRequestJson(http.MethodPost, u.String(), headers, body.Encode(), &res); err != nil {
 		return "", err
 	}
 
@@ -333,7 +906,7 @@ func (g GithubIdentityProvider) GetIdentityToken(code string) (string, error) {
 }
 
 func (g GithubIdentityProvider) GetSingleSignOnUser(identityToken string) (SingleSignOnUser, error) {
-	u, err := url.Parse("https://api.github.com/user")
+	u, err := url.Parse(g.apiURL + "/user")
 	if err != nil {
 		return SingleSignOnUser{}, err
 	}
@@ -343,41 +916,159 @@ func (g GithubIdentityProvider) GetSingleSignOnUser(identityToken string) (Singl
 	}
 
 	res := struct {
+		ID      int    `json:"id"`
 		Name    string `json:"name"`
 		Email   string `json:"email"`
 		Picture string `json:"avatar_url"`
 	}{}
 
-	if err := DefaultHttpClient.HttpRequestJson(http.MethodGet, u.String(), headers, "", &res); err != nil {
+	if err := g.httpClient.HttpRequestJson(http.MethodGet, u.String(), headers, "", &res); err != nil {
 		return SingleSignOnUser{}, err
 	}
 
+	groups := []string{}
+	if len(g.allowedOrganizations) > 0 || len(g.allowedTeams) > 0 {
+		groups, err = g.getMembership(headers)
+		if err != nil {
+			return SingleSignOnUser{}, err
+		}
+	}
+
 	return SingleSignOnUser{
+		Subject: strconv.Itoa(res.ID),
 		Name:    res.Name,
 		Email:   res.Email,
 		Picture: res.Picture,
+		Groups:  groups,
 	}, nil
 }
 
+// githubMaxPages bounds the pages of organizations and teams read per
+// sign-in, 100 each.
+const githubMaxPages = 10
+
+type githubOrganization struct {
+	Login string `json:"login"`
+}
+
+type githubTeam struct {
+	Slug         string             `json:"slug"`
+	Organization githubOrganization `json:"organization"`
+}
+
+// getMembership checks that the user is a member of one of the allowed
+// organizations or teams, and returns its teams as "organization/team".
+func (g GithubIdentityProvider) getMembership(headers map[string]string) ([]string, error) {
+	organizations := []githubOrganization{}
+	next := g.apiURL + "/user/orgs?per_page=100"
+	for page := 0; len(next) > 0; page++ {
+		if page >= githubMaxPages {
+			return nil, fmt.Errorf("failed to get organizations: more than %d pages", githubMaxPages)
+		}
+		res := []githubOrganization{}
+		var err error
+		if next, err = g.httpClient.HttpRequestJsonPage(http.MethodGet, next, headers, "", &res); err != nil {
+			return nil, fmt.Errorf("failed to get organizations: %w", err)
+		}
+		organizations = append(organizations, res...)
+	}
+
+	teams := []githubTeam{}
+	next = g.apiURL + "/user/teams?per_page=100"
+	for page := 0; len(next) > 0; page++ {
+		if page >= githubMaxPages {
+			return nil, fmt.Errorf("failed to get teams: more than %d pages", githubMaxPages)
+		}
+		res := []githubTeam{}
+		var err error
+		if next, err = g.httpClient.HttpRequestJsonPage(http.MethodGet, next, headers, "", &res); err != nil {
+			return nil, fmt.Errorf("failed to get teams: %w", err)
+		}
+		teams = append(teams, res...)
+	}
+
+	allowed := len(g.allowedOrganizations) < 1 && len(g.allowedTeams) < 1
+	for _, organization := range organizations {
+		if contains(g.allowedOrganizations, strings.ToLower(organization.Login)) {
+			allowed = true
+		}
+	}
+
+	groups := []string{}
+	for _, team := range teams {
+		group := fmt.Sprintf("%s/%s", team.Organization.Login, team.Slug)
+		if contains(g.allowedTeams, strings.ToLower(group)) {
+			allowed = true
+		}
+		groups = append(groups, group)
+	}
+
+	if !allowed {
+		return nil, ErrSignInRejected{
+			Code:    SignInMembershipRequired,
+			Message: "membership of an allowed github organization or team is required",
+		}
+	}
+
+	return groups, nil
+}
+
 type SingleSignOnFactory struct {
-	authenticator Authenticator
-	repository    Repository
+	authenticator       Authenticator
+	repository          Repository
+	invitationManager   InvitationManager
+	roleManager         RoleManager
+	organizationManager OrganizationManager
+	signUpPolicy        SignUpPolicy
 }
 
 func NewSingleSignOnFactory(
 	authenticator Authenticator,
 	repository Repository,
+	invitationManager InvitationManager,
+	roleManager RoleManager,
+	organizationManager OrganizationManager,
+	signUpPolicy SignUpPolicy,
 ) SingleSignOnFactory {
 	return SingleSignOnFactory{
-		authenticator: authenticator,
-		repository:    repository,
+		authenticator:       authenticator,
+		repository:          repository,
+		invitationManager:   invitationManager,
+		roleManager:         roleManager,
+		organizationManager: organizationManager,
+		signUpPolicy:        signUpPolicy,
 	}
 }
 
-func (f SingleSignOnFactory) NewSingleSignOn(identityProvider IdentityProvider) SingleSignOn {
+func (f SingleSignOnFactory) NewSingleSignOn(name string, identityProvider IdentityProvider, signUpEnabled bool) SingleSignOn {
 	return NewSingleSignOn(
+		name,
 		identityProvider,
 		f.authenticator,
 		f.repository,
+		f.invitationManager,
+		f.roleManager,
+		f.organizationManager,
+		f.signUpPolicy,
+		signUpEnabled,
 	)
 }
+
+// NewOrganizationSingleSignOn creates a single sign-on for an identity
+// provider of an organization. Users signing in with it become members of
+// the organization. The emails it asserts are not trusted, see
+// createOrganizationUser.
+func (f SingleSignOnFactory) NewOrganizationSingleSignOn(name string, identityProvider IdentityProvider, organizationID int) SingleSignOn {
+	singleSignOn := f.NewSingleSignOn(name, identityProvider, true)
+	singleSignOn.organizationID = organizationID
+	singleSignOn.unverifiedEmails = true
+	return singleSignOn
+}
+
+// NewUnverifiedSingleSignOn creates a single sign-on for sign-ins that do not
+// verify the email of the user, like sign-ups with a password.
+func (f SingleSignOnFactory) NewUnverifiedSingleSignOn(name string, signUpEnabled bool) SingleSignOn {
+	singleSignOn := f.NewSingleSignOn(name, nil, signUpEnabled)
+	singleSignOn.unverifiedEmails = true
+	return singleSignOn
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSingleSignOnClaimsUnverifiedUser(t *testing.T) {
+	repository := newMemoryRepository()
+	user, _ := repository.CreateUser(User{Email: "Alice@Example.com"})
+	repository.SetUserPasswordHash(user.ID, "hash")
+	repository.AssignRole(user.ID, 1)
+
+	singleSignOn := newTestSingleSignOnFactory(repository).NewSingleSignOn("google", nil, true)
+	claimed, err := singleSignOn.GetOrCreateUser(SingleSignOnUser{Subject: "1", Email: "alice@example.COM"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claimed.ID != user.ID || !claimed.EmailVerified {
+		t.Errorf("expected the unverified user to be claimed, got %+v", claimed)
+	}
+	if claimed.Email != "alice@example.com" {
+		t.Errorf("expected the email to be stored in lower case, got %s", claimed.Email)
+	}
+	if hash, _ := repository.GetUserPasswordHash(user.ID); hash != "" {
+		t.Error("expected the password to be removed")
+	}
+	if roles, _ := repository.GetUserRoleNames(user.ID); len(roles) > 0 {
+		t.Errorf("expected the roles to be removed, got %v", roles)
+	}
+}
+
+func TestGithubIdentityProviderFollowsPages(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.RequestURI() {
+		case "/api/v3/user":
+			w.Write([]byte(`{"id": 1, "email": "alice@example.com"}`))
+		case "/api/v3/user/orgs?per_page=100":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/v3/user/orgs?per_page=100&page=2>; rel="next", <%s/api/v3/user/orgs?per_page=100&page=2>; rel="last"`, server.URL, server.URL))
+			w.Write([]byte(`[{"login": "other"}]`))
+		case "/api/v3/user/orgs?per_page=100&page=2":
+			w.Write([]byte(`[{"login": "Acme"}]`))
+		case "/api/v3/user/teams?per_page=100":
+			w.Header().Set("Link", `</api/v3/user/teams?per_page=100&page=2>; rel="next"`)
+			w.Write([]byte(`[{"slug": "ops", "organization": {"login": "other"}}]`))
+		case "/api/v3/user/teams?per_page=100&page=2":
+			w.Write([]byte(`[{"slug": "dev", "organization": {"login": "Acme"}}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	provider := NewGithubIdentityProvider("id", "secret", "", server.URL, []string{"acme"}, nil)
+	user, err := provider.GetSingleSignOnUser("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"other/ops", "Acme/dev"}; !reflect.DeepEqual(user.Groups, expected) {
+		t.Errorf("expected %v, got %v", expected, user.Groups)
+	}
+}
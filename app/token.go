@@ -43,7 +43,7 @@ func (j JWT) Decode(tokenString string) (TokenPayload, error) {
 	})
 
 	if err != nil {
-		return TokenPayload{}, nil
+		return TokenPayload{}, err
 	}
 
 	if !token.Valid {
@@ -54,10 +54,21 @@ func (j JWT) Decode(tokenString string) (TokenPayload, error) {
 }
 
 func (JWT) tokenPayloadToClaims(payload TokenPayload) jwt.Claims {
-	return jwt.MapClaims{
-		"user_id":   payload.UserID,
-		"issued_at": payload.IssuedAt,
+	claims := jwt.MapClaims{
+		"user_id":     payload.UserID,
+		"issued_at":   payload.IssuedAt,
+		"groups":      payload.Groups,
+		"roles":       payload.Roles,
+		"org_id":      payload.OrganizationID,
+		"org_role":    payload.OrganizationRole,
+		"mfa_pending": payload.MFAPending,
+		"amr":         payload.AMR,
 	}
+	// auth_time is in seconds since the epoch, as in OpenID Connect.
+	if !payload.AuthTime.IsZero() {
+		claims["auth_time"] = payload.AuthTime.Unix()
+	}
+	return claims
 }
 
 func (JWT) claimsToTokenPayload(claims jwt.Claims) (TokenPayload, error) {
@@ -80,5 +91,67 @@ func (JWT) claimsToTokenPayload(claims jwt.Claims) (TokenPayload, error) {
 		return TokenPayload{}, errors.New("invalid issued_at")
 	}
 
-	return NewTokenPayload(userID, issuedAt), nil
+	groups, err := claimToStrings(mapClaims["groups"])
+	if err != nil {
+		return TokenPayload{}, errors.New("invalid groups")
+	}
+
+	roles, err := claimToStrings(mapClaims["roles"])
+	if err != nil {
+		return TokenPayload{}, errors.New("invalid roles")
+	}
+
+	organizationID := 0
+	if orgID, ok := mapClaims["org_id"]; ok {
+		organizationID, err = strconv.Atoi(fmt.Sprint(orgID))
+		if err != nil || organizationID < 0 {
+			return TokenPayload{}, errors.New("invalid org_id")
+		}
+	}
+
+	organizationRole, _ := mapClaims["org_role"].(string)
+	mfaPending, _ := mapClaims["mfa_pending"].(bool)
+
+	// Tokens issued before auth_time was introduced count as authenticated
+	// long ago.
+	authTime := time.Time{}
+	if value, ok := mapClaims["auth_time"].(float64); ok {
+		authTime = time.Unix(int64(value), 0)
+	}
+
+	amr, err := claimToStrings(mapClaims["amr"])
+	if err != nil {
+		return TokenPayload{}, errors.New("invalid amr")
+	}
+
+	payload := NewTokenPayload(userID, issuedAt)
+	payload.Groups = groups
+	payload.Roles = roles
+	payload.OrganizationID = organizationID
+	payload.OrganizationRole = organizationRole
+	payload.MFAPending = mfaPending
+	payload.AuthTime = authTime
+	payload.AMR = amr
+	return payload, nil
+}
+
+func claimToStrings(claim interface{}) ([]string, error) {
+	if claim == nil {
+		return nil, nil
+	}
+
+	values, ok := claim.([]interface{})
+	if !ok {
+		return nil, errors.New("claim must be a list")
+	}
+
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			return nil, errors.New("claim must be a list of strings")
+		}
+		strs = append(strs, str)
+	}
+	return strs, nil
 }
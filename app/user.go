@@ -3,10 +3,12 @@ package main
 import "errors"
 
 type User struct {
-	ID      int    `json:"id"`
-	Email   string `json:"email"`
-	Name    string `json:"name"`
-	Picture string `json:"picture"`
+	ID            int    `json:"id"`
+	Email         string `json:"email"`
+	Name          string `json:"name"`
+	Picture       string `json:"picture"`
+	EmailVerified bool   `json:"email_verified"`
+	MFAEnabled    bool   `json:"mfa_enabled"`
 }
 
 type UserManager struct {
@@ -29,3 +31,9 @@ type ErrUserNotFound string
 func (e ErrUserNotFound) Error() string {
 	return string(e)
 }
+
+type ErrUserExists string
+
+func (e ErrUserExists) Error() string {
+	return string(e)
+}
@@ -0,0 +1,812 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Attestation policies. With none, authenticators are asked not to attest
+// and any statement is ignored. With direct, a verified packed statement is
+// required. Its certificate is not checked against trust anchors.
+const (
+	WebAuthnAttestationNone   = "none"
+	WebAuthnAttestationDirect = "direct"
+)
+
+const (
+	webAuthnSessionLifetime = 5 * time.Minute
+
+	webAuthnRegistration = "registration"
+	webAuthnSignIn       = "sign_in"
+	webAuthnVerify       = "verify"
+)
+
+// COSE algorithms of the public keys accepted for credentials.
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// Flags of the authenticator data.
+const (
+	webAuthnFlagUserPresent  = 0x01
+	webAuthnFlagUserVerified = 0x04
+	webAuthnFlagAttested     = 0x40
+)
+
+// oidFIDOGenCeAAGUID is the certificate extension holding the AAGUID of the
+// authenticator in packed attestation certificates.
+var oidFIDOGenCeAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// WebAuthnCredential is a public key credential, e.g. a passkey, registered
+// by a user.
+type WebAuthnCredential struct {
+	ID                int        `json:"id"`
+	UserID            int        `json:"-"`
+	CredentialID      []byte     `json:"-"`
+	PublicKey         []byte     `json:"-"`
+	SignCount         int64      `json:"-"`
+	Transports        []string   `json:"transports"`
+	AttestationFormat string     `json:"attestation_format"`
+	AAGUID            []byte     `json:"-"`
+	Name              string     `json:"name"`
+	CreatedAt         time.Time  `json:"created_at"`
+	LastUsedAt        *time.Time `json:"last_used_at"`
+}
+
+// WebAuthnSession is the challenge of a ceremony, which can be used once.
+// UserID is 0 when the user is not known yet, as when signing in.
+type WebAuthnSession struct {
+	UserID    int
+	Purpose   string
+	ExpiresAt time.Time
+}
+
+type ErrWebAuthnCredentialNotFound string
+
+func (e ErrWebAuthnCredentialNotFound) Error() string {
+	return string(e)
+}
+
+type ErrWebAuthnSessionNotFound string
+
+func (e ErrWebAuthnSessionNotFound) Error() string {
+	return string(e)
+}
+
+// ErrWebAuthnInvalid is returned for malformed responses and registrations
+// the relying party does not accept.
+type ErrWebAuthnInvalid string
+
+func (e ErrWebAuthnInvalid) Error() string {
+	return string(e)
+}
+
+// The options are passed to navigator.credentials.create() and get() by the
+// web app, which decodes the base64url fields to buffers.
+type WebAuthnCreationOptions struct {
+	Challenge              string                         `json:"challenge"`
+	RP                     WebAuthnRelyingParty           `json:"rp"`
+	User                   WebAuthnUserEntity             `json:"user"`
+	PubKeyCredParams       []WebAuthnCredentialParameters `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	ExcludeCredentials     []WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection WebAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                         `json:"attestation"`
+}
+
+type WebAuthnRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	Timeout          int64                          `json:"timeout"`
+	RPID             string                         `json:"rpId"`
+	AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                         `json:"userVerification"`
+}
+
+type WebAuthnRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebAuthnUserEntity struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type WebAuthnCredentialParameters struct {
+	Type string `json:"type"`
+	Alg  int64  `json:"alg"`
+}
+
+type WebAuthnCredentialDescriptor struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id"`
+	Transports []string `json:"transports,omitempty"`
+}
+
+type WebAuthnAuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// WebAuthnAttestationResponse is the credential returned by
+// navigator.credentials.create(), with buffers encoded as base64url.
+type WebAuthnAttestationResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string   `json:"clientDataJSON"`
+		AttestationObject string   `json:"attestationObject"`
+		Transports        []string `json:"transports"`
+	} `json:"response"`
+}
+
+// WebAuthnAssertionResponse is the credential returned by
+// navigator.credentials.get(), with buffers encoded as base64url.
+type WebAuthnAssertionResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type webAuthnAuthenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	AAGUID       []byte
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// WebAuthn runs the registration and authentication ceremonies of WebAuthn
+// for passkeys and security keys. Credentials sign users in on their own,
+// with user verification, or as second factor after another sign-in.
+type WebAuthn struct {
+	enabled       bool
+	rpID          string
+	rpName        string
+	origin        string
+	attestation   string
+	repository    WebAuthnRepository
+	authenticator Authenticator
+}
+
+func NewWebAuthn(
+	enabled bool,
+	rpID string,
+	rpName string,
+	origin string,
+	attestation string,
+	repository WebAuthnRepository,
+	authenticator Authenticator,
+) (WebAuthn, error) {
+	if attestation != WebAuthnAttestationNone && attestation != WebAuthnAttestationDirect {
+		return WebAuthn{}, fmt.Errorf("unknown attestation policy %q", attestation)
+	}
+
+	return WebAuthn{
+		enabled:       enabled,
+		rpID:          rpID,
+		rpName:        rpName,
+		origin:        strings.TrimSuffix(origin, "/"),
+		attestation:   attestation,
+		repository:    repository,
+		authenticator: authenticator,
+	}, nil
+}
+
+func (w WebAuthn) Enabled() bool {
+	return w.enabled
+}
+
+// BeginRegistration returns the options to create a credential for the user.
+// Credentials the user already has are excluded.
+func (w WebAuthn) BeginRegistration(user User) (WebAuthnCreationOptions, error) {
+	credentials, err := w.repository.GetUserWebAuthnCredentials(user.ID)
+	if err != nil {
+		return WebAuthnCreationOptions{}, err
+	}
+
+	challenge, err := w.createSession(user.ID, webAuthnRegistration)
+	if err != nil {
+		return WebAuthnCreationOptions{}, err
+	}
+
+	displayName := user.Name
+	if len(displayName) < 1 {
+		displayName = user.Email
+	}
+
+	return WebAuthnCreationOptions{
+		Challenge: challenge,
+		RP:        WebAuthnRelyingParty{ID: w.rpID, Name: w.rpName},
+		User: WebAuthnUserEntity{
+			ID:          base64.RawURLEncoding.EncodeToString(webAuthnUserHandle(user.ID)),
+			Name:        user.Email,
+			DisplayName: displayName,
+		},
+		PubKeyCredParams: []WebAuthnCredentialParameters{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:            webAuthnSessionLifetime.Milliseconds(),
+		ExcludeCredentials: webAuthnCredentialDescriptors(credentials),
+		AuthenticatorSelection: WebAuthnAuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: "preferred",
+		},
+		Attestation: w.attestation,
+	}, nil
+}
+
+// FinishRegistration verifies the new credential and stores it for the user.
+func (w WebAuthn) FinishRegistration(user User, name string, response WebAuthnAttestationResponse) (WebAuthnCredential, error) {
+	clientDataJSON, err := decodeWebAuthnBuffer(response.Response.ClientDataJSON)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if err := w.verifyClientData(clientDataJSON, "webauthn.create", webAuthnRegistration, user.ID); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	attestationObject, err := decodeWebAuthnBuffer(response.Response.AttestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	format, statement, rawAuthData, err := parseWebAuthnAttestationObject(attestationObject)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	authData, err := w.verifyAuthenticatorData(rawAuthData, false)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if authData.Flags&webAuthnFlagAttested == 0 {
+		return WebAuthnCredential{}, ErrWebAuthnInvalid("authenticator data has no credential")
+	}
+
+	publicKey, alg, err := parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		return WebAuthnCredential{}, ErrWebAuthnInvalid(fmt.Sprintf("invalid credential public key: %v", err))
+	}
+
+	if w.attestation == WebAuthnAttestationDirect {
+		if format != "packed" {
+			return WebAuthnCredential{}, ErrWebAuthnInvalid(fmt.Sprintf("attestation format %q is not accepted", format))
+		}
+		clientDataHash := sha256.Sum256(clientDataJSON)
+		signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+		if err := verifyPackedAttestation(statement, signed, publicKey, alg, authData.AAGUID); err != nil {
+			return WebAuthnCredential{}, ErrWebAuthnInvalid(fmt.Sprintf("invalid attestation: %v", err))
+		}
+	}
+
+	name = strings.TrimSpace(name)
+	if len(name) < 1 {
+		name = "Passkey"
+	}
+
+	credential := WebAuthnCredential{
+		UserID:            user.ID,
+		CredentialID:      authData.CredentialID,
+		PublicKey:         authData.PublicKey,
+		SignCount:         int64(authData.SignCount),
+		Transports:        response.Response.Transports,
+		AttestationFormat: format,
+		AAGUID:            authData.AAGUID,
+		Name:              name,
+	}
+	if credential.Transports == nil {
+		credential.Transports = []string{}
+	}
+
+	return w.repository.CreateWebAuthnCredential(credential)
+}
+
+// BeginSignIn returns the options to sign in with any discoverable
+// credential, which has to verify the user.
+func (w WebAuthn) BeginSignIn() (WebAuthnRequestOptions, error) {
+	challenge, err := w.createSession(0, webAuthnSignIn)
+	if err != nil {
+		return WebAuthnRequestOptions{}, err
+	}
+
+	return WebAuthnRequestOptions{
+		Challenge:        challenge,
+		Timeout:          webAuthnSessionLifetime.Milliseconds(),
+		RPID:             w.rpID,
+		AllowCredentials: []WebAuthnCredentialDescriptor{},
+		UserVerification: "required",
+	}, nil
+}
+
+// FinishSignIn verifies the assertion and returns a token for the user of
+// the credential. As the credential verified the user, it is not followed
+// by another factor.
+func (w WebAuthn) FinishSignIn(response WebAuthnAssertionResponse) (string, error) {
+	const userVerification = true
+	credential, err := w.verifyAssertion(response, webAuthnSignIn, 0, userVerification)
+	if err != nil {
+		return "", err
+	}
+
+	return w.authenticator.CreateToken(credential.UserID, nil, webAuthnAMR(nil, userVerification))
+}
+
+// BeginVerify returns the options to complete a sign-in pending the second
+// factor with one of the user's credentials.
+func (w WebAuthn) BeginVerify(pendingToken string) (WebAuthnRequestOptions, error) {
+	payload, err := w.authenticator.GetMFAPendingPayload(pendingToken)
+	if err != nil {
+		return WebAuthnRequestOptions{}, ErrInvalidCredentials(fmt.Sprintf("invalid mfa_pending token: %v", err))
+	}
+
+	credentials, err := w.repository.GetUserWebAuthnCredentials(payload.UserID)
+	if err != nil {
+		return WebAuthnRequestOptions{}, err
+	}
+	if len(credentials) < 1 {
+		return WebAuthnRequestOptions{}, ErrWebAuthnCredentialNotFound("no webauthn credentials registered")
+	}
+
+	challenge, err := w.createSession(payload.UserID, webAuthnVerify)
+	if err != nil {
+		return WebAuthnRequestOptions{}, err
+	}
+
+	return WebAuthnRequestOptions{
+		Challenge:        challenge,
+		Timeout:          webAuthnSessionLifetime.Milliseconds(),
+		RPID:             w.rpID,
+		AllowCredentials: webAuthnCredentialDescriptors(credentials),
+		UserVerification: "discouraged",
+	}, nil
+}
+
+// FinishVerify verifies the assertion and returns the token of the pending
+// sign-in.
+func (w WebAuthn) FinishVerify(pendingToken string, response WebAuthnAssertionResponse) (string, error) {
+	payload, err := w.authenticator.GetMFAPendingPayload(pendingToken)
+	if err != nil {
+		return "", ErrInvalidCredentials(fmt.Sprintf("invalid mfa_pending token: %v", err))
+	}
+
+	const userVerification = false
+	if _, err := w.verifyAssertion(response, webAuthnVerify, payload.UserID, userVerification); err != nil {
+		return "", err
+	}
+	if err := w.authenticator.UseMFAPendingToken(pendingToken, payload); err != nil {
+		return "", ErrInvalidCredentials(fmt.Sprintf("invalid mfa_pending token: %v", err))
+	}
+
+	return w.authenticator.CreateToken(payload.UserID, payload.Groups, webAuthnAMR(payload.AMR, userVerification))
+}
+
+// webAuthnAMR adds the methods of an assertion to amr. user is only added if
+// the UV flag was checked, as the UP flag alone does not verify the user.
+func webAuthnAMR(amr []string, userVerification bool) []string {
+	methods := []string{AMRHardwareKey}
+	if userVerification {
+		methods = append(methods, AMRUser)
+	}
+	return appendAMR(amr, append(methods, AMRMFA)...)
+}
+
+func (w WebAuthn) GetCredentials(user User) ([]WebAuthnCredential, error) {
+	return w.repository.GetUserWebAuthnCredentials(user.ID)
+}
+
+func (w WebAuthn) DeleteCredential(user User, id int) error {
+	return w.repository.DeleteWebAuthnCredential(user.ID, id)
+}
+
+// createSession returns a new challenge, whose hash is stored with the
+// ceremony it is for.
+func (w WebAuthn) createSession(userID int, purpose string) (string, error) {
+	challenge, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	session := WebAuthnSession{
+		UserID:    userID,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().Add(webAuthnSessionLifetime),
+	}
+	if err := w.repository.CreateWebAuthnSession(session, hashToken(challenge)); err != nil {
+		return "", err
+	}
+
+	return challenge, nil
+}
+
+// verifyClientData checks the client data of a response and uses up the
+// session of its challenge. userID is 0 if any user may respond.
+func (w WebAuthn) verifyClientData(clientDataJSON []byte, ceremony string, purpose string, userID int) error {
+	clientData := webAuthnClientData{}
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return ErrWebAuthnInvalid(fmt.Sprintf("invalid client data: %v", err))
+	}
+	if clientData.Type != ceremony {
+		return ErrWebAuthnInvalid(fmt.Sprintf("unexpected client data type %q", clientData.Type))
+	}
+
+	session, err := w.repository.UseWebAuthnSession(hashToken(clientData.Challenge))
+	var sessionNotFound ErrWebAuthnSessionNotFound
+	if errors.As(err, &sessionNotFound) {
+		return ErrInvalidCredentials("challenge is invalid or has already been used")
+	}
+	if err != nil {
+		return err
+	}
+	if session.Purpose != purpose || session.UserID != userID {
+		return ErrInvalidCredentials("challenge was issued for another ceremony")
+	}
+	if session.ExpiresAt.Before(time.Now()) {
+		return ErrInvalidCredentials("challenge has expired")
+	}
+
+	if clientData.Origin != w.origin {
+		return ErrInvalidCredentials(fmt.Sprintf("unexpected origin %q", clientData.Origin))
+	}
+
+	return nil
+}
+
+func (w WebAuthn) verifyAuthenticatorData(data []byte, userVerification bool) (webAuthnAuthenticatorData, error) {
+	authData, err := parseWebAuthnAuthenticatorData(data)
+	if err != nil {
+		return webAuthnAuthenticatorData{}, ErrWebAuthnInvalid(fmt.Sprintf("invalid authenticator data: %v", err))
+	}
+
+	rpIDHash := sha256.Sum256([]byte(w.rpID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return webAuthnAuthenticatorData{}, ErrInvalidCredentials("credential was created for another relying party")
+	}
+	if authData.Flags&webAuthnFlagUserPresent == 0 {
+		return webAuthnAuthenticatorData{}, ErrInvalidCredentials("user was not present")
+	}
+	if userVerification && authData.Flags&webAuthnFlagUserVerified == 0 {
+		return webAuthnAuthenticatorData{}, ErrInvalidCredentials("user was not verified")
+	}
+
+	return authData, nil
+}
+
+// verifyAssertion checks an assertion of a credential of the user, or of any
+// user if userID is 0, and records its use. Sign counts that do not increase
+// point to a cloned authenticator and are rejected, unless the authenticator
+// does not count.
+func (w WebAuthn) verifyAssertion(response WebAuthnAssertionResponse, purpose string, userID int, userVerification bool) (WebAuthnCredential, error) {
+	clientDataJSON, err := decodeWebAuthnBuffer(response.Response.ClientDataJSON)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	rawAuthData, err := decodeWebAuthnBuffer(response.Response.AuthenticatorData)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	signature, err := decodeWebAuthnBuffer(response.Response.Signature)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	credentialID, err := decodeWebAuthnBuffer(response.ID)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	if err := w.verifyClientData(clientDataJSON, "webauthn.get", purpose, userID); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	credential, err := w.repository.GetWebAuthnCredential(credentialID)
+	var credentialNotFound ErrWebAuthnCredentialNotFound
+	if errors.As(err, &credentialNotFound) {
+		return WebAuthnCredential{}, ErrInvalidCredentials("unknown credential")
+	}
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+	if userID != 0 && credential.UserID != userID {
+		return WebAuthnCredential{}, ErrInvalidCredentials("credential belongs to another user")
+	}
+
+	if len(response.Response.UserHandle) > 0 {
+		userHandle, err := decodeWebAuthnBuffer(response.Response.UserHandle)
+		if err != nil {
+			return WebAuthnCredential{}, err
+		}
+		if !bytes.Equal(userHandle, webAuthnUserHandle(credential.UserID)) {
+			return WebAuthnCredential{}, ErrInvalidCredentials("credential belongs to another user")
+		}
+	}
+
+	authData, err := w.verifyAuthenticatorData(rawAuthData, userVerification)
+	if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	publicKey, alg, err := parseCOSEKey(credential.PublicKey)
+	if err != nil {
+		return WebAuthnCredential{}, fmt.Errorf("invalid stored public key: %v", err)
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := verifyCOSESignature(publicKey, alg, signed, signature); err != nil {
+		return WebAuthnCredential{}, ErrInvalidCredentials("invalid signature")
+	}
+
+	signCount := int64(authData.SignCount)
+	if (signCount > 0 || credential.SignCount > 0) && signCount <= credential.SignCount {
+		return WebAuthnCredential{}, ErrInvalidCredentials("sign count did not increase, the authenticator may have been cloned")
+	}
+
+	if err := w.repository.UseWebAuthnCredential(credential.ID, signCount); err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	return credential, nil
+}
+
+// webAuthnUserHandle is the user.id of credentials, which authenticators
+// return with assertions of discoverable credentials.
+func webAuthnUserHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+func webAuthnCredentialDescriptors(credentials []WebAuthnCredential) []WebAuthnCredentialDescriptor {
+	descriptors := []WebAuthnCredentialDescriptor{}
+	for _, credential := range credentials {
+		descriptors = append(descriptors, WebAuthnCredentialDescriptor{
+			Type:       "public-key",
+			ID:         base64.RawURLEncoding.EncodeToString(credential.CredentialID),
+			Transports: credential.Transports,
+		})
+	}
+	return descriptors
+}
+
+// decodeWebAuthnBuffer decodes base64url, with or without padding.
+func decodeWebAuthnBuffer(s string) ([]byte, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, ErrWebAuthnInvalid(fmt.Sprintf("invalid base64url: %v", err))
+	}
+	return buf, nil
+}
+
+func parseWebAuthnAttestationObject(data []byte) (string, map[interface{}]interface{}, []byte, error) {
+	value, _, err := decodeCBOR(data)
+	if err != nil {
+		return "", nil, nil, ErrWebAuthnInvalid(fmt.Sprintf("invalid attestation object: %v", err))
+	}
+
+	object, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return "", nil, nil, ErrWebAuthnInvalid("invalid attestation object")
+	}
+	format, ok := object["fmt"].(string)
+	if !ok {
+		return "", nil, nil, ErrWebAuthnInvalid("attestation object has no format")
+	}
+	statement, ok := object["attStmt"].(map[interface{}]interface{})
+	if !ok {
+		return "", nil, nil, ErrWebAuthnInvalid("attestation object has no statement")
+	}
+	authData, ok := object["authData"].([]byte)
+	if !ok {
+		return "", nil, nil, ErrWebAuthnInvalid("attestation object has no authenticator data")
+	}
+
+	return format, statement, authData, nil
+}
+
+func parseWebAuthnAuthenticatorData(data []byte) (webAuthnAuthenticatorData, error) {
+	if len(data) < 37 {
+		return webAuthnAuthenticatorData{}, errors.New("authenticator data is too short")
+	}
+
+	authData := webAuthnAuthenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if authData.Flags&webAuthnFlagAttested == 0 {
+		return authData, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return webAuthnAuthenticatorData{}, errors.New("attested credential data is too short")
+	}
+	authData.AAGUID = rest[:16]
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return webAuthnAuthenticatorData{}, errors.New("attested credential data is too short")
+	}
+	authData.CredentialID = rest[:idLength]
+	rest = rest[idLength:]
+
+	_, n, err := decodeCBOR(rest)
+	if err != nil {
+		return webAuthnAuthenticatorData{}, fmt.Errorf("invalid credential public key: %v", err)
+	}
+	authData.PublicKey = rest[:n]
+
+	return authData, nil
+}
+
+// parseCOSEKey parses an EC2 P-256, OKP Ed25519 or RSA COSE key (RFC 8152)
+// and returns it with its algorithm.
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+	value, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	key, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errors.New("key is not a map")
+	}
+
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("invalid P-256 key")
+		}
+		publicKey := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, 0, errors.New("point is not on P-256")
+		}
+		return publicKey, alg, nil
+	case kty == 1 && alg == coseAlgEdDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if len(n) < 256 || len(e) < 1 || len(e) > 4 {
+			return nil, 0, errors.New("invalid RSA key")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, alg, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+	}
+}
+
+func verifyCOSESignature(publicKey crypto.PublicKey, alg int64, data []byte, signature []byte) error {
+	switch alg {
+	case coseAlgES256:
+		key, ok := publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match algorithm")
+		}
+		digest := sha256.Sum256(data)
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case coseAlgEdDSA:
+		key, ok := publicKey.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("key does not match algorithm")
+		}
+		if !ed25519.Verify(key, data, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case coseAlgRS256:
+		key, ok := publicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match algorithm")
+		}
+		digest := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	default:
+		return fmt.Errorf("unsupported algorithm %d", alg)
+	}
+}
+
+// verifyPackedAttestation verifies a packed attestation statement, either
+// signed by an attestation certificate or by the credential itself.
+func verifyPackedAttestation(
+	statement map[interface{}]interface{},
+	signed []byte,
+	credentialKey crypto.PublicKey,
+	credentialAlg int64,
+	aaguid []byte,
+) error {
+	alg, ok := statement["alg"].(int64)
+	if !ok {
+		return errors.New("statement has no algorithm")
+	}
+	signature, ok := statement["sig"].([]byte)
+	if !ok {
+		return errors.New("statement has no signature")
+	}
+
+	x5c, ok := statement["x5c"].([]interface{})
+	if !ok {
+		if alg != credentialAlg {
+			return errors.New("self attestation algorithm does not match the credential")
+		}
+		return verifyCOSESignature(credentialKey, alg, signed, signature)
+	}
+
+	if len(x5c) < 1 {
+		return errors.New("statement has no certificate")
+	}
+	der, ok := x5c[0].([]byte)
+	if !ok {
+		return errors.New("invalid certificate")
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	if certificate.IsCA {
+		return errors.New("attestation certificate must not be a CA")
+	}
+	for _, extension := range certificate.Extensions {
+		if !extension.Id.Equal(oidFIDOGenCeAAGUID) {
+			continue
+		}
+		var certificateAAGUID []byte
+		if _, err := asn1.Unmarshal(extension.Value, &certificateAAGUID); err != nil {
+			return err
+		}
+		if !bytes.Equal(certificateAAGUID, aaguid) {
+			return errors.New("certificate aaguid does not match the authenticator")
+		}
+	}
+
+	return verifyCOSESignature(certificate.PublicKey, alg, signed, signature)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+var _ WebAuthnRepository = (*memoryWebAuthnRepository)(nil)
+
+// memoryWebAuthnRepository keeps credentials and sessions in memory for
+// tests.
+type memoryWebAuthnRepository struct {
+	credentials map[int]WebAuthnCredential
+	sessions    map[string]WebAuthnSession
+}
+
+func newMemoryWebAuthnRepository() *memoryWebAuthnRepository {
+	return &memoryWebAuthnRepository{
+		credentials: map[int]WebAuthnCredential{},
+		sessions:    map[string]WebAuthnSession{},
+	}
+}
+
+func (r *memoryWebAuthnRepository) CreateWebAuthnCredential(credential WebAuthnCredential) (WebAuthnCredential, error) {
+	credential.ID = len(r.credentials) + 1
+	credential.CreatedAt = time.Now()
+	r.credentials[credential.ID] = credential
+	return credential, nil
+}
+
+func (r *memoryWebAuthnRepository) GetWebAuthnCredential(credentialID []byte) (WebAuthnCredential, error) {
+	for _, credential := range r.credentials {
+		if string(credential.CredentialID) == string(credentialID) {
+			return credential, nil
+		}
+	}
+	return WebAuthnCredential{}, ErrWebAuthnCredentialNotFound("webauthn credential not found")
+}
+
+func (r *memoryWebAuthnRepository) GetUserWebAuthnCredentials(userID int) ([]WebAuthnCredential, error) {
+	credentials := []WebAuthnCredential{}
+	for _, credential := range r.credentials {
+		if credential.UserID == userID {
+			credentials = append(credentials, credential)
+		}
+	}
+	return credentials, nil
+}
+
+func (r *memoryWebAuthnRepository) UseWebAuthnCredential(id int, signCount int64) error {
+	credential, ok := r.credentials[id]
+	if !ok {
+		return ErrWebAuthnCredentialNotFound("webauthn credential not found")
+	}
+	now := time.Now()
+	credential.SignCount = signCount
+	credential.LastUsedAt = &now
+	r.credentials[id] = credential
+	return nil
+}
+
+func (r *memoryWebAuthnRepository) DeleteWebAuthnCredential(userID int, id int) error {
+	if credential, ok := r.credentials[id]; !ok || credential.UserID != userID {
+		return ErrWebAuthnCredentialNotFound("webauthn credential not found")
+	}
+	delete(r.credentials, id)
+	return nil
+}
+
+func (r *memoryWebAuthnRepository) CreateWebAuthnSession(session WebAuthnSession, challengeHash string) error {
+	r.sessions[challengeHash] = session
+	return nil
+}
+
+func (r *memoryWebAuthnRepository) UseWebAuthnSession(challengeHash string) (WebAuthnSession, error) {
+	session, ok := r.sessions[challengeHash]
+	if !ok {
+		return WebAuthnSession{}, ErrWebAuthnSessionNotFound("webauthn session not found")
+	}
+	delete(r.sessions, challengeHash)
+	return session, nil
+}
+
+const (
+	testWebAuthnRPID   = "sso.example.com"
+	testWebAuthnOrigin = "https://sso.example.com"
+)
+
+// testWebAuthnAuthenticator signs assertions with an Ed25519 credential.
+type testWebAuthnAuthenticator struct {
+	credentialID []byte
+	privateKey   ed25519.PrivateKey
+}
+
+// newTestWebAuthn returns a relying party with a credential of user 1,
+// whose stored sign count is signCount.
+func newTestWebAuthn(t *testing.T, signCount int64) (WebAuthn, testWebAuthnAuthenticator) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The COSE key {1: 1, 3: -8, -1: 6, -2: x} encoded as CBOR.
+	coseKey := append([]byte{0xa4, 0x01, 0x01, 0x03, 0x27, 0x20, 0x06, 0x21, 0x58, 0x20}, publicKey...)
+
+	repository := newMemoryWebAuthnRepository()
+	authenticator := testWebAuthnAuthenticator{credentialID: []byte("credential"), privateKey: privateKey}
+	repository.CreateWebAuthnCredential(WebAuthnCredential{
+		UserID:       1,
+		CredentialID: authenticator.credentialID,
+		PublicKey:    coseKey,
+		SignCount:    signCount,
+	})
+
+	webAuthn, err := NewWebAuthn(true, testWebAuthnRPID, "SSO", testWebAuthnOrigin, WebAuthnAttestationNone, repository, newTestAuthenticator(newMemoryRepository()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return webAuthn, authenticator
+}
+
+// assert returns the assertion of the authenticator for the challenge, as
+// made on origin for rpID.
+func (a testWebAuthnAuthenticator) assert(t *testing.T, challenge string, origin string, rpID string, signCount uint32) WebAuthnAssertionResponse {
+	clientDataJSON, err := json.Marshal(webAuthnClientData{Type: "webauthn.get", Challenge: challenge, Origin: origin})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authData := append(rpIDHash[:], webAuthnFlagUserPresent|webAuthnFlagUserVerified, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[33:], signCount)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signature := ed25519.Sign(a.privateKey, append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	response := WebAuthnAssertionResponse{
+		ID:   base64.RawURLEncoding.EncodeToString(a.credentialID),
+		Type: "public-key",
+	}
+	response.Response.ClientDataJSON = base64.RawURLEncoding.EncodeToString(clientDataJSON)
+	response.Response.AuthenticatorData = base64.RawURLEncoding.EncodeToString(authData)
+	response.Response.Signature = base64.RawURLEncoding.EncodeToString(signature)
+	return response
+}
+
+func TestWebAuthnFinishSignIn(t *testing.T) {
+	tests := []struct {
+		name            string
+		origin          string
+		rpID            string
+		storedSignCount int64
+		signCount       uint32
+		valid           bool
+	}{
+		{"valid", testWebAuthnOrigin, testWebAuthnRPID, 4, 5, true},
+		{"authenticator without counter", testWebAuthnOrigin, testWebAuthnRPID, 0, 0, true},
+		{"other origin", "https://evil.example.com", testWebAuthnRPID, 4, 5, false},
+		{"origin with port", testWebAuthnOrigin + ":8443", testWebAuthnRPID, 4, 5, false},
+		{"other rp id", testWebAuthnOrigin, "evil.example.com", 4, 5, false},
+		{"same sign count", testWebAuthnOrigin, testWebAuthnRPID, 5, 5, false},
+		{"lower sign count", testWebAuthnOrigin, testWebAuthnRPID, 5, 3, false},
+		{"counter reset", testWebAuthnOrigin, testWebAuthnRPID, 5, 0, false},
+	}
+	for _, test := range tests {
+		webAuthn, authenticator := newTestWebAuthn(t, test.storedSignCount)
+		options, err := webAuthn.BeginSignIn()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = webAuthn.FinishSignIn(authenticator.assert(t, options.Challenge, test.origin, test.rpID, test.signCount))
+		if test.valid && err != nil {
+			t.Errorf("%s: expected the assertion to be accepted, got %v", test.name, err)
+		}
+		var invalidCredentials ErrInvalidCredentials
+		if !test.valid && !errors.As(err, &invalidCredentials) {
+			t.Errorf("%s: expected the assertion to be rejected, got %v", test.name, err)
+		}
+	}
+}
+
+func TestWebAuthnRejectsReplayedSignCount(t *testing.T) {
+	webAuthn, authenticator := newTestWebAuthn(t, 0)
+
+	for i, signCount := range []uint32{1, 1} {
+		options, err := webAuthn.BeginSignIn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = webAuthn.FinishSignIn(authenticator.assert(t, options.Challenge, testWebAuthnOrigin, testWebAuthnRPID, signCount))
+		if expected := i == 0; (err == nil) != expected {
+			t.Errorf("assertion %d: expected accepted %v, got %v", i+1, expected, err)
+		}
+	}
+}
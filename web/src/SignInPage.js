@@ -1,33 +1,49 @@
 import React from 'react';
+import { Spinner } from 'react-bootstrap';
 import SignInButton from './SignInButton';
-import FacebookIcon from './Facebook.png';
-import GithubIcon from './Github.png';
-import GoogleIcon from './Google.png';
 
-const facebookSignInLink = 'https://localhost/api/v1/single-sign-on/facebook/sign-in';
-const googleSignInLink = 'https://localhost/api/v1/single-sign-on/google/sign-in';
-const githubSignInLink = 'https://localhost/api/v1/single-sign-on/github/sign-in';
+const providersLink = 'https://localhost/api/v1/single-sign-on/providers';
 
 class SignInPage extends React.Component {
+
+    constructor(props) {
+        super(props);
+        this.state = { providers: null };
+    }
+
+    async componentDidMount() {
+        const providers = await fetch(providersLink)
+            .then(rsp => {
+                if (rsp.ok) return rsp.json();
+                throw Error(rsp.status + ': ' + rsp.statusText);
+            })
+            .then(rsp => rsp['providers'])
+            .catch(err => {
+                console.log(err);
+                return [];
+            });
+        this.setState({ providers: providers });
+    }
+
     render() {
+        const providers = this.state.providers;
+        var body = (<Spinner animation="border" />);
+
+        if (providers) {
+            body = providers.map(provider => (
+                <SignInButton
+                    key={provider['name']}
+                    identityProviderName={provider['display_name']}
+                    identityProviderIcon={provider['icon']}
+                    signInLink={provider['sign_in_url']}
+                />
+            ));
+        }
+
         return (
             <div style={{ display: 'flex', flexDirection: 'column', justifyContent: 'center', alignItems: 'center', height: '100vh' }}>
                 <div style={{ width: '400px' }}>
-                    <SignInButton
-                        identityProviderName='Facebook'
-                        identityProviderIcon={FacebookIcon}
-                        signInLink={facebookSignInLink}
-                    />
-                    <SignInButton
-                        identityProviderName='Github'
-                        identityProviderIcon={GithubIcon}
-                        signInLink={githubSignInLink}
-                    />
-                    <SignInButton
-                        identityProviderName='Google'
-                        identityProviderIcon={GoogleIcon}
-                        signInLink={googleSignInLink}
-                    />
+                    {body}
                 </div>
             </div >
         );